@@ -10,13 +10,22 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/VivaLaPanda/uta-stream/db"
+	"github.com/VivaLaPanda/uta-stream/events"
+	"github.com/VivaLaPanda/uta-stream/history"
 	"github.com/VivaLaPanda/uta-stream/mixer"
 	"github.com/VivaLaPanda/uta-stream/queue"
+	"github.com/VivaLaPanda/uta-stream/queue/auto"
 	"github.com/VivaLaPanda/uta-stream/resource"
 	"github.com/VivaLaPanda/uta-stream/resource/cache"
+	"github.com/VivaLaPanda/uta-stream/resource/download"
+	"github.com/VivaLaPanda/uta-stream/resource/library"
 	"github.com/gorilla/mux"
 )
 
@@ -28,6 +37,7 @@ type key int
 
 const (
 	requestIDKey key = 0
+	userKey      key = 1
 )
 
 var (
@@ -38,13 +48,13 @@ var (
 // modifies the state of the server. Several components are passed in and then
 // requests to the API translate into operations against those components
 // This function call will block the caller until the server is killed
-func ServeApi(m *mixer.Mixer, c *cache.Cache, q *queue.Queue, listenerCount func() int, port int, authCfgFilename string) {
+func ServeApi(m *mixer.Mixer, c *cache.Cache, q *queue.Queue, a *auto.AQEngine, h *history.History, lib *library.Library, database *db.DB, limits Limits, voteSkip VoteSkip, listenerCounts func() map[string]int, port int, authCfgFilename string) {
 	logger := log.New(os.Stdout, "http: ", log.LstdFlags)
 	logger.Println("Server is starting...")
 
 	basePath := "/api"
 
-	amw, err := NewAuthMiddleware(authCfgFilename, basePath)
+	amw, err := NewAuthMiddleware(authCfgFilename, basePath, database)
 	if err != nil {
 		logger.Fatalf("Couldn't find/parse provided auth config file. Err: %v\n", err)
 	}
@@ -54,20 +64,93 @@ func ServeApi(m *mixer.Mixer, c *cache.Cache, q *queue.Queue, listenerCount func
 	router := baseRouter.PathPrefix(basePath).Subrouter()
 	router.Use(amw.Middleware)
 	router.Use(headerMiddleware)
+	router.Use(timeoutMiddleware)
+	rl := newRateLimiter(limits, q)
+	router.Use(rl.Middleware)
+	currentSong := func() *resource.Song { return m.CurrentSongInfo }
+	sv := newSkipVoter(voteSkip, currentSong, m.Skip, listenerCounts)
 	router.Handle("/", index()).
 		Methods("GET")
 	router.Handle("/auth", authTest(amw)).
 		Methods("GET")
-	router.Handle("/enqueue", queuer(q, c, q.AddToQueue)).
+	router.Handle("/enqueue", djOnly(q, queuer(q, c, q.AddToQueue))).
 		Methods("POST")
-	router.Handle("/playnext", queuer(q, c, q.PlayNext)).
+	router.Handle("/playnext", djOnly(q, queuer(q, c, q.PlayNext))).
 		Methods("POST")
-	router.Handle("/skip", skip(m)).
+	router.Handle("/enqueue-playlist", djOnly(q, playlistQueuer(q, c, rl, limits.PlaylistCap))).
 		Methods("POST")
-	router.Handle("/shuffle", shuffle(m, q)).
+	router.Handle("/upload", uploader(q, c, limits.UploadSize)).
 		Methods("POST")
-	router.Handle("/playing", playing(m, q, listenerCount)).
+	router.Handle("/skip", djOnly(q, skip(m))).
+		Methods("POST")
+	router.Handle("/shuffle", djOnly(q, shuffle(m, q))).
+		Methods("POST")
+	router.Handle("/voteskip", djOnly(q, castSkipVote(sv))).
+		Methods("POST")
+	router.Handle("/pause", djOnly(q, pause(m))).
+		Methods("POST")
+	router.Handle("/resume", djOnly(q, resume(m))).
+		Methods("POST")
+	router.Handle("/playing", playing(m, q, a, sv, listenerCounts)).
+		Methods("GET")
+	router.Handle("/queue", getQueue(q)).
+		Methods("GET")
+	router.Handle("/remove", djOnly(q, remove(q))).
+		Methods("POST")
+	router.Handle("/move", djOnly(q, move(q))).
+		Methods("POST")
+	router.Handle("/dump", djOnly(q, dump(q))).
+		Methods("POST")
+	router.Handle("/requeue", djOnly(q, requeue(q))).
+		Methods("POST")
+	router.Handle("/like", rate(m, a, 1)).
+		Methods("POST")
+	router.Handle("/dislike", rate(m, a, -1)).
+		Methods("POST")
+	router.Handle("/autoq/songs", autoqSongs(a)).
+		Methods("GET")
+	router.Handle("/autoq/suffixes", autoqSuffixes(a)).
+		Methods("GET")
+	router.Handle("/autoq/next", autoqNext(a)).
+		Methods("GET")
+	router.Handle("/autoq/veto", djOnly(q, veto(q))).
+		Methods("POST")
+	router.Handle("/autoq/forget", autoqForget(a)).
+		Methods("POST")
+	router.Handle("/autoq/blacklist", getBlacklist(a)).
+		Methods("GET")
+	router.Handle("/autoq/blacklist", blacklist(a)).
+		Methods("POST")
+	router.Handle("/autoq/unblacklist", unblacklist(a)).
+		Methods("POST")
+	router.Handle("/events", eventFeed()).
 		Methods("GET")
+	router.Handle("/history", getHistory(h)).
+		Methods("GET")
+	router.Handle("/mode", getMode(q)).
+		Methods("GET")
+	router.Handle("/mode", setMode(q)).
+		Methods("POST")
+	router.Handle("/dj/claim", claimDJ(q)).
+		Methods("POST")
+	router.Handle("/dj/release", releaseDJ(q)).
+		Methods("POST")
+	router.Handle("/library", getLibrary(lib)).
+		Methods("GET")
+	router.Handle("/library/rescan", rescanLibrary(lib)).
+		Methods("POST")
+	router.Handle("/quota", getQuota(rl)).
+		Methods("GET")
+	router.Handle("/tokens", listTokens(amw)).
+		Methods("GET")
+	router.Handle("/tokens", mintToken(amw)).
+		Methods("POST")
+	router.Handle("/tokens/label", labelToken(amw)).
+		Methods("POST")
+	router.Handle("/tokens/expire", expireToken(amw)).
+		Methods("POST")
+	router.Handle("/tokens/revoke", revokeToken(amw)).
+		Methods("POST")
 	router.NotFoundHandler = http.HandlerFunc(notFound)
 
 	nextRequestID := func() string {
@@ -77,12 +160,14 @@ func ServeApi(m *mixer.Mixer, c *cache.Cache, q *queue.Queue, listenerCount func
 	// Basic server setup
 	listenAddr := fmt.Sprintf("127.0.0.1:%d", port)
 	server := &http.Server{
-		Addr:         listenAddr,
-		Handler:      tracing(nextRequestID)(logging(logger)(router)),
-		ErrorLog:     logger,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
+		Addr:     listenAddr,
+		Handler:  tracing(nextRequestID)(logging(logger)(router)),
+		ErrorLog: logger,
+		// Only the headers, a whole upload won't come in that fast. Neither
+		// is there a WriteTimeout, it would cut off the event feed.
+		// timeoutMiddleware limits everything else instead.
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       15 * time.Second,
 	}
 
 	done := make(chan bool)
@@ -133,13 +218,15 @@ func index() http.Handler {
 	})
 }
 
-// authCanary is used to validate whether you have access to a particular route
+// authCanary is used to validate whether you have access to a particular route.
+// Pass method too to check for that method specifically.
 func authTest(amw *authMiddleware) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		token := r.Header.Get("Authorization")
 		route := "/api" + r.URL.Query().Get("route")
+		method := r.URL.Query().Get("method")
 
-		if amw.ValidateToken(token, route) {
+		if !amw.isEnabled() || amw.ValidateToken(token, route, method) {
 			w.WriteHeader(http.StatusOK)
 		} else {
 			w.WriteHeader(http.StatusForbidden)
@@ -147,6 +234,206 @@ func authTest(amw *authMiddleware) http.Handler {
 	})
 }
 
+// getQuota reports where the user stands against the rate limits
+func getQuota(rl *rateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respString, _ := json.Marshal(rl.Quota(r))
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, string(respString))
+	})
+}
+
+// tokenInfo is what the API shows of a minted token, everything but the hash
+type tokenInfo struct {
+	ID       string     `json:"id"`
+	Label    string     `json:"label"`
+	Name     string     `json:"name"`
+	Roles    []string   `json:"roles"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Expired  bool       `json:"expired"`
+}
+
+func newTokenInfo(record *tokenRecord) tokenInfo {
+	return tokenInfo{
+		ID:       record.ID,
+		Label:    record.Label,
+		Name:     record.Name,
+		Roles:    record.Roles,
+		Created:  record.Created,
+		Expires:  record.Expires,
+		LastUsed: record.LastUsed,
+		Expired:  record.expired(time.Now()),
+	}
+}
+
+// parseExpiry reads an expiry given either as an RFC3339 time or as a
+// duration from now, eg 720h
+func parseExpiry(value string) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+	after, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expiry should be an RFC3339 time or a duration like 720h")
+	}
+	return time.Now().Add(after), nil
+}
+
+// writeTokenResponse sends the token info back along with the message, or
+// the error if there was one
+func writeTokenResponse(w http.ResponseWriter, message string, record *tokenRecord, err error) {
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	jsonData, _ := json.Marshal(newTokenInfo(record))
+	fmt.Fprintf(w, `{"message": %q,
+		               "token":%s}`, message, jsonData)
+}
+
+// tokensAvailable stops the request if tokens can't be minted. Returns
+// whether the request can carry on.
+func tokensAvailable(amw *authMiddleware, w http.ResponseWriter) bool {
+	if amw.tokens == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "{\"error\":\"token management needs a database.\"}")
+		return false
+	}
+	return true
+}
+
+// listTokens shows every minted token, without their secrets
+func listTokens(amw *authMiddleware) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tokensAvailable(amw, w) {
+			return
+		}
+		records, err := amw.tokens.List()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "{\"error\":\"failed to read tokens.\"}")
+			log.Printf("Failed to list tokens, err: %v", err)
+			return
+		}
+
+		infos := make([]tokenInfo, len(records))
+		for idx, record := range records {
+			infos[idx] = newTokenInfo(record)
+		}
+		respString, _ := json.Marshal(struct {
+			Tokens []tokenInfo `json:"tokens"`
+		}{infos})
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, string(respString))
+	})
+}
+
+// mintToken makes a new token for the user in name with the comma separated
+// roles. The token is in the response and can't be retrieved again. See
+// canMint for who can mint what.
+func mintToken(amw *authMiddleware) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tokensAvailable(amw, w) {
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("name") == "" || query.Get("roles") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "{\"error\":\"/tokens expects a name and roles in the request.\n"+
+				"eg api.example/tokens?name=alice&roles=listener,requester&label=laptop&expires=720h\"}")
+			return
+		}
+
+		var expires *time.Time
+		if query.Get("expires") != "" {
+			at, err := parseExpiry(query.Get("expires"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+				return
+			}
+			expires = &at
+		}
+
+		roles := strings.Split(query.Get("roles"), ",")
+		callerRoles, callerName := amw.resolve(r.Header.Get("Authorization"))
+		if err := amw.canMint(callerRoles, callerName, query.Get("name"), roles); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		token, record, err := amw.tokens.Mint(query.Get("label"), query.Get("name"), roles, expires)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "{\"error\":\"failed to mint token.\"}")
+			log.Printf("Failed to mint token, err: %v", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		jsonData, _ := json.Marshal(newTokenInfo(record))
+		fmt.Fprintf(w, `{"message": "token minted, it won't be shown again",
+			               "secret":%q,
+			               "token":%s}`, token, jsonData)
+	})
+}
+
+// labelToken changes the label on the token with the id
+func labelToken(amw *authMiddleware) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tokensAvailable(amw, w) {
+			return
+		}
+		record, err := amw.tokens.Label(r.URL.Query().Get("id"), r.URL.Query().Get("label"))
+		writeTokenResponse(w, "token labelled successfully", record, err)
+	})
+}
+
+// expireToken sets when the token with the id stops working, right away if
+// no time is given
+func expireToken(amw *authMiddleware) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tokensAvailable(amw, w) {
+			return
+		}
+		at := time.Now()
+		if r.URL.Query().Get("at") != "" {
+			var err error
+			if at, err = parseExpiry(r.URL.Query().Get("at")); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+				return
+			}
+		}
+		record, err := amw.tokens.Expire(r.URL.Query().Get("id"), at)
+		writeTokenResponse(w, "token expiry set successfully", record, err)
+	})
+}
+
+// revokeToken deletes the token with the id
+func revokeToken(amw *authMiddleware) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tokensAvailable(amw, w) {
+			return
+		}
+		if err := amw.tokens.Revoke(r.URL.Query().Get("id")); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "{\"message\":\"token revoked successfully\"}")
+	})
+}
+
 // queuer is a function which will handle requests to add a song unto the queue
 // in some way (front of queue, back of queue, etc). Queues may result in immediate
 // queueing of cached resource, or of a placeholder to be swapped once we are done with the DL
@@ -175,8 +462,11 @@ func queuer(q *queue.Queue, c *cache.Cache, qFunc QFunc) http.Handler {
 			return
 		}
 
-		if r.URL.Query().Get("title") != "" {
-			songToQueue.Title = r.URL.Query().Get("title")
+		// The title only renames this request, not the song the cache hands
+		// out to everyone else
+		songToQueue = c.Queued(songToQueue, userFromRequest(r))
+		if title := r.URL.Query().Get("title"); title != "" {
+			songToQueue.SetDetails(func(song *resource.Song) { song.Title = title })
 		}
 
 		qFunc(songToQueue)
@@ -188,6 +478,118 @@ func queuer(q *queue.Queue, c *cache.Cache, qFunc QFunc) http.Handler {
 	})
 }
 
+// How many playlist songs are looked up at once
+const playlistLookups = 4
+
+// playlistItem is how one song from a playlist fared
+type playlistItem struct {
+	URL   string         `json:"url"`
+	Track *resource.Song `json:"track,omitempty"`
+	Error string         `json:"error,omitempty"`
+}
+
+// playlistQueuer expands a playlist or album into its songs and queues them
+// in order. At most limit songs are queued (capped at playlistCap), and never
+// more than the user has room for in the queue or left of their hourly
+// enqueues. Each song queued counts as an enqueue.
+func playlistQueuer(q *queue.Queue, c *cache.Cache, rl *rateLimiter, playlistCap int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		playlistURL := r.URL.Query().Get("playlist")
+		if playlistURL == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "{\"error\":\"/enqueue-playlist expects a playlist url in the request.\n"+
+				"eg api.example/enqueue-playlist?playlist=https://www.youtube.com/playlist?list=PL...\"}")
+			return
+		}
+		limit := playlistCap
+		if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+			requested, err := strconv.Atoi(rawLimit)
+			if err != nil || requested < 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, "{\"error\":\"limit should be a positive number.\"}")
+				return
+			}
+			if playlistCap == 0 || requested < playlistCap {
+				limit = requested
+			}
+		}
+
+		urls, err := download.ExpandPlaylist(playlistURL, limit)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+		room := len(urls)
+		quota := rl.Quota(r)
+		if quota.MaxQueued > 0 && quota.MaxQueued-quota.Queued < room {
+			room = quota.MaxQueued - quota.Queued
+		}
+		// The limiter already counted this request, that enqueue goes to the
+		// first song
+		if quota.EnqueuesPerHour > 0 && quota.EnqueuesPerHour-quota.EnqueuesThisHour+1 < room {
+			room = quota.EnqueuesPerHour - quota.EnqueuesThisHour + 1
+		}
+
+		// Looking a song up fetches its details, so do a few at once
+		songs := make([]*resource.Song, len(urls))
+		errs := make([]error, len(urls))
+		lookups := make(chan struct{}, playlistLookups)
+		wg := &sync.WaitGroup{}
+		for idx := range urls {
+			if idx >= room {
+				errs[idx] = fmt.Errorf("you don't have room for more songs in the queue")
+				continue
+			}
+			wg.Add(1)
+			go func(idx int) {
+				defer wg.Done()
+				lookups <- struct{}{}
+				defer func() { <-lookups }()
+				songs[idx], errs[idx] = c.Lookup(urls[idx])
+			}(idx)
+		}
+		wg.Wait()
+
+		queued := make(map[string]bool)
+		for _, song := range q.GetQueue() {
+			if !song.AutoPick {
+				queued[song.ResourceID()] = true
+			}
+		}
+		accepted, rejected := []playlistItem{}, []playlistItem{}
+		for idx, song := range songs {
+			if errs[idx] == nil && queued[song.ResourceID()] {
+				errs[idx] = fmt.Errorf("already in the queue")
+			}
+			if errs[idx] != nil {
+				rejected = append(rejected, playlistItem{URL: urls[idx], Error: errs[idx].Error()})
+				continue
+			}
+			queued[song.ResourceID()] = true
+
+			song = c.Queued(song, userFromRequest(r))
+			q.AddToQueue(song)
+			accepted = append(accepted, playlistItem{URL: urls[idx], Track: song})
+		}
+		if len(accepted) > 1 {
+			rl.RecordEnqueues(r, len(accepted)-1)
+		}
+
+		status := http.StatusOK
+		if len(accepted) == 0 {
+			status = http.StatusBadRequest
+		}
+		respString, _ := json.Marshal(struct {
+			Message  string         `json:"message"`
+			Accepted []playlistItem `json:"accepted"`
+			Rejected []playlistItem `json:"rejected"`
+		}{fmt.Sprintf("queued %d of %d songs", len(accepted), len(urls)), accepted, rejected})
+		w.WriteHeader(status)
+		fmt.Fprintln(w, string(respString))
+	})
+}
+
 // skip will skip the currently playing song. Expect some delay
 func skip(e *mixer.Mixer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -213,7 +615,227 @@ func shuffle(e *mixer.Mixer, q *queue.Queue) http.Handler {
 	})
 }
 
-func playing(m *mixer.Mixer, q *queue.Queue, listenerCount func() int) http.Handler {
+// pause will hold the current song where it is, listeners get silence meanwhile
+func pause(m *mixer.Mixer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Pause()
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "{\"message\":\"stream paused successfully\"}")
+	})
+}
+
+// resume will carry on playing the current song from where it was paused
+func resume(m *mixer.Mixer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Resume()
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "{\"message\":\"stream resumed successfully\"}")
+	})
+}
+
+// getQueue lists the songs waiting in the queue, next up first
+func getQueue(q *queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respString, err := json.Marshal(struct {
+			Queue []*resource.Song `json:"queue"`
+		}{q.GetQueue()})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "{\"error\":\"Failed to format response: %v\"}", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, string(respString))
+	})
+}
+
+// remove takes a song out of the queue, either by its position or by the
+// resource ID it was queued with
+func remove(q *queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var removed *resource.Song
+		var err error
+		if position := r.URL.Query().Get("position"); position != "" {
+			idx, convErr := strconv.Atoi(position)
+			if convErr != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, "{\"error\":\"position should be a number.\"}")
+				return
+			}
+			removed, err = q.Remove(idx)
+		} else if song := r.URL.Query().Get("song"); song != "" {
+			removed, err = q.RemoveByID(song)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "{\"error\":\"/remove expects a position or a song resource identifier in the request.\n"+
+				"eg api.example/remove?position=0\"}")
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		jsonData, _ := removed.MarshalJSON()
+		fmt.Fprintf(w, `{"message": "successfully removed",
+			               "track":%s}`, jsonData)
+	})
+}
+
+// move shifts a song from one position in the queue to another
+func move(q *queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, fromErr := strconv.Atoi(r.URL.Query().Get("from"))
+		to, toErr := strconv.Atoi(r.URL.Query().Get("to"))
+		if fromErr != nil || toErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "{\"error\":\"/move expects numeric from and to positions in the request.\n"+
+				"eg api.example/move?from=3&to=0\"}")
+			return
+		}
+
+		if err := q.Move(from, to); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "{\"message\":\"song moved successfully\"}")
+	})
+}
+
+// dump empties the queue. Whatever is playing right now carries on
+func dump(q *queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q.Dump()
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "{\"message\":\"queue dumped successfully\"}")
+	})
+}
+
+// requeue puts the last song that finished playing back on the end of the queue
+func requeue(q *queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		song, err := q.RequeueLast(userFromRequest(r))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		jsonData, _ := song.MarshalJSON()
+		fmt.Fprintf(w, `{"message": "successfully requeued",
+			               "track":%s}`, jsonData)
+	})
+}
+
+// rate likes (vote 1) or dislikes (vote -1) the current song on behalf of
+// whoever is asking. The autoq plays well liked songs more often.
+func rate(m *mixer.Mixer, a *auto.AQEngine, vote int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := m.CurrentSongInfo
+		if current == nil || current.ResourceID() == "" {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintln(w, "{\"error\":\"nothing is playing.\"}")
+			return
+		}
+
+		score, err := a.Rate(current.ResourceID(), limitKey(r), vote)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		message := "song liked successfully"
+		if vote < 0 {
+			message = "song disliked successfully"
+		}
+		w.WriteHeader(http.StatusOK)
+		jsonData, _ := current.MarshalJSON()
+		fmt.Fprintf(w, `{"message": %q,
+			               "score": %d,
+			               "track":%s}`, message, score, jsonData)
+	})
+}
+
+// djOnly stops anyone but the DJ from using the route while the station is
+// in DJ mode
+func djOnly(q *queue.Queue, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !q.CanControl(userFromRequest(r)) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "{\"error\":\"the station is in DJ mode, only the DJ can do that.\"}")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getMode reports the station mode and who is DJing
+func getMode(q *queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respString, _ := json.Marshal(struct {
+			Mode queue.Mode `json:"mode"`
+			Dj   string     `json:"dj"`
+		}{q.Mode(), q.DJ()})
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, string(respString))
+	})
+}
+
+// setMode switches the station between dj, community and hybrid mode
+func setMode(q *queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode, err := queue.ParseMode(r.URL.Query().Get("mode"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		q.SetMode(mode)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "{\"message\":\"switched to %s mode successfully\"}\n", mode)
+	})
+}
+
+// claimDJ makes whoever is asking the DJ, if the decks are free
+func claimDJ(q *queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if err := q.ClaimDJ(user); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "{\"message\":%q}\n", user+" is now the DJ")
+	})
+}
+
+// releaseDJ lets the DJ step down
+func releaseDJ(q *queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := q.ReleaseDJ(userFromRequest(r)); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "{\"message\":\"released the DJ spot successfully\"}")
+	})
+}
+
+func playing(m *mixer.Mixer, q *queue.Queue, a *auto.AQEngine, sv *skipVoter, listenerCounts func() map[string]int) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		// Note that these string cats are less expensive than they look
@@ -222,17 +844,37 @@ func playing(m *mixer.Mixer, q *queue.Queue, listenerCount func() int) http.Hand
 
 		// Format playing
 		queued := q.GetQueue()
+		mountListeners := listenerCounts()
+		listenerCount := 0
+		for _, count := range mountListeners {
+			listenerCount += count
+		}
+		tally := sv.Tally()
+		score := 0
+		if current := m.CurrentSongInfo; current != nil && current.ResourceID() != "" {
+			score = a.Score(current.ResourceID())
+		}
 
 		respStruct := struct {
-			CurrentSong   *resource.Song   `json:"currentSong"`
-			Upcoming      []*resource.Song `json:"upcoming"`
-			Dj            string           `json:"dj"`
-			ListenerCount int              `json:"listenerCount"`
+			CurrentSong    *resource.Song   `json:"currentSong"`
+			Upcoming       []*resource.Song `json:"upcoming"`
+			Dj             string           `json:"dj"`
+			Mode           queue.Mode       `json:"mode"`
+			ListenerCount  int              `json:"listenerCount"`
+			MountListeners map[string]int   `json:"mountListeners"`
+			Paused         bool             `json:"paused"`
+			SkipVotes      voteTally        `json:"skipVotes"`
+			Score          int              `json:"score"`
 		}{
 			m.CurrentSongInfo,
 			queued,
-			"",
-			listenerCount(),
+			q.DJ(),
+			q.Mode(),
+			listenerCount,
+			mountListeners,
+			m.Paused(),
+			tally,
+			score,
 		}
 
 		respString, err := json.Marshal(respStruct)
@@ -247,6 +889,107 @@ func playing(m *mixer.Mixer, q *queue.Queue, listenerCount func() int) http.Hand
 	})
 }
 
+// getHistory lists what has played, newest first. The optional from and to
+// (RFC3339 times) narrow it down to songs that were playing in that range,
+// and offset and limit page through the results.
+func getHistory(h *history.History) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var from, to time.Time
+		var err error
+		query := r.URL.Query()
+		if query.Get("from") != "" {
+			if from, err = time.Parse(time.RFC3339, query.Get("from")); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, "{\"error\":\"from should be an RFC3339 time, eg 2020-01-01T15:00:00Z.\"}")
+				return
+			}
+		}
+		if query.Get("to") != "" {
+			if to, err = time.Parse(time.RFC3339, query.Get("to")); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, "{\"error\":\"to should be an RFC3339 time, eg 2020-01-01T15:00:00Z.\"}")
+				return
+			}
+		}
+
+		offset, limit := 0, 50
+		if query.Get("offset") != "" {
+			offset, err = strconv.Atoi(query.Get("offset"))
+		}
+		if err == nil && query.Get("limit") != "" {
+			limit, err = strconv.Atoi(query.Get("limit"))
+		}
+		if err != nil || offset < 0 || limit < 1 || limit > 500 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "{\"error\":\"offset should be 0 or more and limit between 1 and 500.\"}")
+			return
+		}
+
+		entries, total, err := h.Query(from, to, offset, limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "{\"error\":\"failed to read history.\"}")
+			log.Printf("Failed to read history, err: %v", err)
+			return
+		}
+
+		respString, err := json.Marshal(struct {
+			History []history.Entry `json:"history"`
+			Total   int             `json:"total"`
+		}{entries, total})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "{\"error\":\"Failed to format response: %v\"}", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, string(respString))
+	})
+}
+
+// eventFeed streams events to the client as server-sent events for as long as
+// they stay connected
+func eventFeed() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "{\"error\":\"streaming isn't supported.\"}")
+			return
+		}
+
+		feed, unsubscribe := events.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		// Comments keep proxies from deciding the connection is dead
+		keepAlive := time.NewTicker(15 * time.Second)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			case event := <-feed:
+				eventData, err := json.Marshal(event)
+				if err != nil {
+					log.Printf("Failed to format %s event. Err: %v\n", event.Type, err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, eventData)
+			}
+			flusher.Flush()
+		}
+	})
+}
+
 func logging(logger *log.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -279,6 +1022,25 @@ func tracing(nextRequestID func() string) func(http.Handler) http.Handler {
 	}
 }
 
+// timeoutMiddleware gives requests 10 seconds to be answered. Streaming
+// routes are left alone since they're meant to stay open.
+func timeoutMiddleware(next http.Handler) http.Handler {
+	timeoutMessage := "{\"error\":\"request timed out.\"}"
+	limited := http.TimeoutHandler(next, 10*time.Second, timeoutMessage)
+	// Looking up every song in a playlist or receiving an upload takes a while
+	slow := http.TimeoutHandler(next, 5*time.Minute, timeoutMessage)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/events":
+			next.ServeHTTP(w, r)
+		case "/api/enqueue-playlist", "/api/upload":
+			slow.ServeHTTP(w, r)
+		default:
+			limited.ServeHTTP(w, r)
+		}
+	})
+}
+
 func headerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add headers to all responses
@@ -1,65 +1,168 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/db"
 )
 
-// Each token represents a list of endpoints which one is authorized to
-// hit
+// How often the auth config file is checked for changes
+var authReloadInterval = 5 * time.Second
+
+// Each token is given a list of roles, and each role is a set of routes
+// one is authorized to hit
 type authMiddleware struct {
 	data     authData
 	enabled  bool
 	basePath string
+
+	filename string
+	modTime  time.Time
+	lock     *sync.RWMutex
+	tokens   *tokenStore // minted tokens, nil if there's no database
 }
 
 type authData struct {
-	TokenRoles map[string][]string `json:"tokenRoles"`
-	RoleNames  map[string]string   `json:"roleNames"`
+	Roles      map[string][]permission `json:"roles"`
+	TokenRoles map[string][]string     `json:"tokenRoles"`
+	RoleNames  map[string]string       `json:"roleNames"`
+}
+
+// permission allows access to the routes matching the pattern (relative to
+// the base path, see path.Match for the syntax) using any of the methods.
+// No methods means every method is allowed, and a route of * allows
+// everything (basically sudo).
+type permission struct {
+	Route   string   `json:"route"`
+	Methods []string `json:"methods"`
+}
+
+// allows reports whether the permission covers the request. An empty method
+// matches any of the permission's methods.
+func (p permission) allows(basePath string, route string, method string) bool {
+	if p.Route != "*" {
+		matched, err := path.Match(basePath+p.Route, route)
+		if err != nil || !matched {
+			return false
+		}
+	}
+	if len(p.Methods) == 0 || method == "" {
+		return true
+	}
+	for _, allowed := range p.Methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
 }
 
 // NewAuthMiddleware will prepare the struct which handles state for the
-// authorization middleware
-func NewAuthMiddleware(authConfigFile string, basePath string) (amw *authMiddleware, err error) {
-	data := &authData{}
-	authMiddleware := &authMiddleware{*data, false, basePath}
+// authorization middleware. Once loaded the config file is watched, and
+// changes to it are picked up without a restart. Tokens minted through the
+// API are kept in the database, pass nil to only use the config file.
+func NewAuthMiddleware(authConfigFile string, basePath string, database *db.DB) (amw *authMiddleware, err error) {
+	authMiddleware := &authMiddleware{
+		basePath: basePath,
+		filename: authConfigFile,
+		lock:     &sync.RWMutex{},
+	}
+	if database != nil {
+		authMiddleware.tokens = newTokenStore(database)
+	}
 	if authConfigFile == "" {
 		return authMiddleware, nil
 	}
-	configFile, err := os.Open(authConfigFile)
+
+	if err = authMiddleware.load(); err != nil {
+		return authMiddleware, err
+	}
+	go authMiddleware.watch(authReloadInterval)
+
+	return authMiddleware, nil
+}
+
+// load reads the config file into the middleware, leaving the old config in
+// place if the file can't be read
+func (amw *authMiddleware) load() error {
+	fileInfo, err := os.Stat(amw.filename)
 	if err != nil {
-		return authMiddleware, fmt.Errorf("failed to initialize auth middleware: %v", err)
+		return fmt.Errorf("failed to initialize auth middleware: %v", err)
+	}
+	configFile, err := os.Open(amw.filename)
+	if err != nil {
+		return fmt.Errorf("failed to initialize auth middleware: %v", err)
 	}
 	defer configFile.Close()
 
+	data := &authData{}
 	decoder := json.NewDecoder(configFile)
 	err = decoder.Decode(data)
 	if err != nil {
-		return authMiddleware, fmt.Errorf("failed to parse config file: %v", err)
+		return fmt.Errorf("failed to parse config file: %v", err)
 	}
-	authMiddleware.data = *data
 
-	authMiddleware.enabled = true
-	return authMiddleware, nil
+	amw.lock.Lock()
+	amw.data = *data
+	amw.modTime = fileInfo.ModTime()
+	amw.enabled = true
+	amw.lock.Unlock()
+
+	return nil
+}
+
+// watch polls the config file, reloading it whenever it changes
+func (amw *authMiddleware) watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		fileInfo, err := os.Stat(amw.filename)
+		if err != nil {
+			continue
+		}
+		amw.lock.RLock()
+		changed := !fileInfo.ModTime().Equal(amw.modTime)
+		amw.lock.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err = amw.load(); err != nil {
+			log.Printf("Failed to reload %s, keeping the old auth config. Err: %v\n", amw.filename, err)
+			// Don't keep retrying the same broken file
+			amw.lock.Lock()
+			amw.modTime = fileInfo.ModTime()
+			amw.lock.Unlock()
+			continue
+		}
+		log.Printf("Reloaded auth config from %s\n", amw.filename)
+	}
 }
 
 // Authorizer middleware. If auth isn't enabled it'll just pass on the req
-// Otherwise it checks the token's routes against the one being requested
+// Otherwise it checks the token's roles against the route and method being requested
 func (amw *authMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !amw.enabled {
+		if !amw.isEnabled() {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		token := r.Header.Get("Authorization")
-		route := r.URL.Path
-
-		if amw.ValidateToken(token, route) {
+		roles, name := amw.resolve(r.Header.Get("Authorization"))
+		if amw.allowed(roles, r.URL.Path, r.Method) {
 			// Pass down the request to the next middleware (or final handler)
-			next.ServeHTTP(w, r)
+			// along with who is making it
+			ctx := context.WithValue(r.Context(), userKey, name)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		} else {
 			// Write an error and stop the handler chain
 			http.Error(w, "Forbidden", http.StatusForbidden)
@@ -67,36 +170,102 @@ func (amw *authMiddleware) Middleware(next http.Handler) http.Handler {
 	})
 }
 
-func (amw *authMiddleware) ValidateToken(token string, route string) (valid bool) {
-	// Check if we have a valid token at all
+func (amw *authMiddleware) isEnabled() bool {
+	amw.lock.RLock()
+	defer amw.lock.RUnlock()
+	return amw.enabled
+}
+
+// resolve finds the roles and user name for the Authorization header. Minted
+// tokens are checked first, then the ones in the config file. Tokens we don't
+// know get the roles of the default token, *, but no name: they could be
+// anyone, so they shouldn't share whatever is kept per user.
+func (amw *authMiddleware) resolve(token string) (roles []string, name string) {
 	if len(token) < 7 || token[:7] != "Bearer " {
-		// Apply the default token
-		token = "Bearer *"
-	}
-	token = token[7:]
-	if roles, found := amw.data.TokenRoles[token]; found {
-		for _, role := range roles {
-			// Wildcard perms (basically sudo)
-			if role == "*" {
-				return true
-			}
+		token = "*"
+	} else {
+		token = token[7:]
+	}
 
-			if route == amw.basePath+role {
-				return true
-			}
+	if amw.tokens != nil && strings.Contains(token, ".") {
+		if record, valid := amw.tokens.Check(token); valid {
+			return record.Roles, record.Name
 		}
-		return false
-	} else {
-		// Wildcard role
-		for _, role := range amw.data.TokenRoles["*"] {
-			if role == "*" {
-				return true
-			}
+	}
+
+	amw.lock.RLock()
+	defer amw.lock.RUnlock()
+	if _, found := amw.data.TokenRoles[token]; !found || token == "*" {
+		return amw.data.TokenRoles["*"], ""
+	}
+	return amw.data.TokenRoles[token], amw.data.RoleNames[token]
+}
 
-			if route == amw.basePath+role {
+// allowed checks whether any of the roles allow the method on the route. An
+// empty method checks whether the route is allowed at all. Roles that aren't
+// defined in the config are treated as route patterns, as they were before
+// roles existed.
+func (amw *authMiddleware) allowed(roles []string, route string, method string) bool {
+	amw.lock.RLock()
+	defer amw.lock.RUnlock()
+
+	for _, role := range roles {
+		permissions, isRole := amw.data.Roles[role]
+		if !isRole {
+			permissions = []permission{{Route: role}}
+		}
+		for _, perm := range permissions {
+			if perm.allows(amw.basePath, route, method) {
 				return true
 			}
 		}
-		return false
 	}
+	return false
+}
+
+// canMint checks whether the caller, with their roles and name, may mint a
+// token for name with the roles. Only roles defined in the config can be given
+// out, and only ones the caller has themselves. Tokens for anyone but
+// themselves can only be minted by callers with the * role.
+func (amw *authMiddleware) canMint(callerRoles []string, callerName string, name string, roles []string) error {
+	held := make(map[string]bool)
+	for _, role := range callerRoles {
+		held[role] = true
+	}
+	if name != callerName && !held["*"] {
+		return fmt.Errorf("only the * role can mint tokens for someone else")
+	}
+
+	amw.lock.RLock()
+	defer amw.lock.RUnlock()
+	for _, role := range roles {
+		if _, defined := amw.data.Roles[role]; !defined && role != "*" {
+			return fmt.Errorf("%s isn't a role in the auth config", role)
+		}
+		if !held[role] && !held["*"] {
+			return fmt.Errorf("you can't give out %s, you don't have it", role)
+		}
+	}
+	return nil
+}
+
+// UserName gives the name of the user a token belongs to, from the roleNames
+// in the config or the name it was minted for. Unknown tokens have no name.
+func (amw *authMiddleware) UserName(token string) string {
+	_, name := amw.resolve(token)
+	return name
+}
+
+// userFromRequest gives the name of the user making the request, or an empty
+// string if we don't know who they are
+func userFromRequest(r *http.Request) string {
+	user, _ := r.Context().Value(userKey).(string)
+	return user
+}
+
+// ValidateToken checks whether the token's roles allow the method on the
+// route. An empty method checks whether the route is allowed at all.
+func (amw *authMiddleware) ValidateToken(token string, route string, method string) (valid bool) {
+	roles, _ := amw.resolve(token)
+	return amw.allowed(roles, route, method)
 }
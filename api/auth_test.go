@@ -1,11 +1,15 @@
 package api
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestPopulate(t *testing.T) {
-	amw, err := NewAuthMiddleware("", "")
+	amw, err := NewAuthMiddleware("", "", nil)
 	if err != nil {
 		t.Errorf("Err should be nil, was given empty string\n")
 	}
@@ -13,7 +17,7 @@ func TestPopulate(t *testing.T) {
 		t.Errorf("Middleware shouldn't enabled, was given empty string\n")
 	}
 
-	amw, err = NewAuthMiddleware("foo.bar", "")
+	amw, err = NewAuthMiddleware("foo.bar", "", nil)
 	if err == nil {
 		t.Errorf("Err should not be nil, was given nonexistent file\n")
 	}
@@ -21,7 +25,7 @@ func TestPopulate(t *testing.T) {
 		t.Errorf("Middleware shouldn't enabled, was given nonexistent file\n")
 	}
 
-	amw, err = NewAuthMiddleware("test_auth.json", "")
+	amw, err = NewAuthMiddleware("test_auth.json", "", nil)
 	if err != nil {
 		t.Errorf("Err should be nil, valid file was provided. err: %s\n", err)
 		return
@@ -42,7 +46,7 @@ func TestPopulate(t *testing.T) {
 }
 
 func TestValidateToken(t *testing.T) {
-	amw, err := NewAuthMiddleware("test_auth.json", "")
+	amw, err := NewAuthMiddleware("test_auth.json", "", nil)
 	if err != nil {
 		t.Errorf("Err should be nil, valid file was provided\n")
 	}
@@ -50,13 +54,100 @@ func TestValidateToken(t *testing.T) {
 		t.Errorf("Middleware should be enabled, was given valid file\n")
 	}
 
-	valid := amw.ValidateToken("Bearer foo", "enqueue")
+	valid := amw.ValidateToken("Bearer foo", "enqueue", "POST")
 	if !valid {
 		t.Errorf("Route should match token's \n")
 	}
 
-	valid = amw.ValidateToken("Bearer su", "enqueue")
+	valid = amw.ValidateToken("Bearer su", "enqueue", "POST")
 	if !valid {
 		t.Errorf("Route should match token's \n")
 	}
 }
+
+func TestUserName(t *testing.T) {
+	amw, err := NewAuthMiddleware("test_auth.json", "", nil)
+	if err != nil {
+		t.Errorf("Err should be nil, valid file was provided\n")
+		return
+	}
+
+	if name := amw.UserName("Bearer foo"); name != "some-user" {
+		t.Errorf("Token foo should belong to some-user, got %s\n", name)
+	}
+	if name := amw.UserName("Bearer unknown"); name != "" {
+		t.Errorf("Unknown tokens shouldn't have a name, got %s\n", name)
+	}
+	if name := amw.UserName(""); name != "" {
+		t.Errorf("Missing tokens shouldn't have a name, got %s\n", name)
+	}
+	if !amw.ValidateToken("", "skip", "") {
+		t.Errorf("Missing tokens should still get the default token's roles\n")
+	}
+}
+
+func TestRoles(t *testing.T) {
+	amw, err := NewAuthMiddleware("test_auth.json", "/api", nil)
+	if err != nil {
+		t.Errorf("Err should be nil, valid file was provided\n")
+		return
+	}
+
+	cases := []struct {
+		route  string
+		method string
+		valid  bool
+	}{
+		{"/api/playing", "GET", true},
+		{"/api/playing", "POST", false},
+		{"/api/dj/claim", "POST", true},
+		{"/api/dj/release", "POST", true},
+		{"/api/dj/claim/extra", "POST", false},
+		{"/api/skip", "post", true},
+		{"/api/enqueue", "POST", false},
+		{"/api/queue", "", true},
+	}
+	for _, c := range cases {
+		if valid := amw.ValidateToken("Bearer bar", c.route, c.method); valid != c.valid {
+			t.Errorf("%s %s should give %v for bar's roles, gave %v\n", c.method, c.route, c.valid, valid)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	authReloadInterval = 10 * time.Millisecond
+	cfgFile := filepath.Join(t.TempDir(), "auth.json")
+	ioutil.WriteFile(cfgFile, []byte(`{"tokenRoles": {"foo": ["/skip"]}}`), 0660)
+
+	amw, err := NewAuthMiddleware(cfgFile, "/api", nil)
+	if err != nil {
+		t.Errorf("Err should be nil, valid file was provided. err: %s\n", err)
+		return
+	}
+	if amw.ValidateToken("Bearer foo", "/api/enqueue", "POST") {
+		t.Errorf("foo shouldn't be able to enqueue yet\n")
+	}
+
+	ioutil.WriteFile(cfgFile, []byte(`{"tokenRoles": {"foo": ["/skip", "/enqueue"]}}`), 0660)
+	// Make sure the change is visible even on filesystems with coarse mtimes
+	later := time.Now().Add(time.Second)
+	os.Chtimes(cfgFile, later, later)
+
+	deadline := time.Now().Add(time.Second)
+	for !amw.ValidateToken("Bearer foo", "/api/enqueue", "POST") {
+		if time.Now().After(deadline) {
+			t.Errorf("Config change wasn't picked up\n")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A broken file keeps the old config
+	ioutil.WriteFile(cfgFile, []byte(`{"tokenRoles": `), 0660)
+	later = later.Add(time.Second)
+	os.Chtimes(cfgFile, later, later)
+	time.Sleep(50 * time.Millisecond)
+	if !amw.ValidateToken("Bearer foo", "/api/enqueue", "POST") {
+		t.Errorf("Broken config shouldn't replace the working one\n")
+	}
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/VivaLaPanda/uta-stream/queue"
+	"github.com/VivaLaPanda/uta-stream/queue/auto"
+)
+
+// writeAutoqJSON writes whatever the autoq gave back as the response
+func writeAutoqJSON(w http.ResponseWriter, resp interface{}) {
+	respString, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "{\"error\":\"Failed to format response: %v\"}", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, string(respString))
+}
+
+// songParam gets the song resource identifier the route acts on, writing an
+// error if there isn't one
+func songParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	song := r.URL.Query().Get("song")
+	if song == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "{\"error\":\"%s expects a song resource identifier in the request.\"}\n", r.URL.Path)
+		return "", false
+	}
+	return song, true
+}
+
+// autoqSongs lists every song the autoq knows about
+func autoqSongs(a *auto.AQEngine) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAutoqJSON(w, struct {
+			Songs []string `json:"songs"`
+		}{a.Songs()})
+	})
+}
+
+// autoqSuffixes shows the songs which have followed a prefix and how likely
+// each is to be picked. The prefix is resource identifiers separated by
+// spaces, it defaults to what the autoq is on right now.
+func autoqSuffixes(a *auto.AQEngine) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix, given := r.URL.Query()["prefix"]
+		key := a.Prefix()
+		if given {
+			key = prefix[0]
+		}
+
+		writeAutoqJSON(w, struct {
+			Prefix   string        `json:"prefix"`
+			Suffixes []auto.Suffix `json:"suffixes"`
+		}{key, a.Suffixes(key)})
+	})
+}
+
+// autoqNext shows what the autoq would pick next and why
+func autoqNext(a *auto.AQEngine) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAutoqJSON(w, a.Predict())
+	})
+}
+
+// autoqForget removes a song from the autoq entirely
+func autoqForget(a *auto.AQEngine) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		song, ok := songParam(w, r)
+		if !ok {
+			return
+		}
+		if err := a.Forget(song); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "{\"message\":%q}\n", "forgot "+song+" successfully")
+	})
+}
+
+// getBlacklist lists the songs the autoq will never pick
+func getBlacklist(a *auto.AQEngine) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAutoqJSON(w, struct {
+			Songs []string `json:"songs"`
+		}{a.Blacklisted()})
+	})
+}
+
+// blacklist stops the autoq from ever picking a song
+func blacklist(a *auto.AQEngine) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		song, ok := songParam(w, r)
+		if !ok {
+			return
+		}
+		if err := a.Blacklist(song); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "{\"message\":%q}\n", "blacklisted "+song+" successfully")
+	})
+}
+
+// unblacklist lets the autoq pick a song again
+func unblacklist(a *auto.AQEngine) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		song, ok := songParam(w, r)
+		if !ok {
+			return
+		}
+		if err := a.Unblacklist(song); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "{\"message\":%q}\n", "unblacklisted "+song+" successfully")
+	})
+}
+
+// veto throws out one of the autoq's upcoming picks, another takes its place
+func veto(q *queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		song, ok := songParam(w, r)
+		if !ok {
+			return
+		}
+		vetoed, err := q.Veto(song)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		jsonData, _ := vetoed.MarshalJSON()
+		fmt.Fprintf(w, `{"message": "successfully vetoed",
+			               "track":%s}`, jsonData)
+	})
+}
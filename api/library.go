@@ -0,0 +1,50 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/VivaLaPanda/uta-stream/resource/library"
+)
+
+// libraryAvailable writes an error if there's no library to work with
+func libraryAvailable(lib *library.Library, w http.ResponseWriter) bool {
+	if lib == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "{\"error\":\"no library directories are configured.\"}")
+		return false
+	}
+	return true
+}
+
+// getLibrary reports what's in the library and how the last scan went
+func getLibrary(lib *library.Library) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !libraryAvailable(lib, w) {
+			return
+		}
+		respString, _ := json.Marshal(lib.Status())
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, string(respString))
+	})
+}
+
+// rescanLibrary starts a scan of the library. Big libraries take a while, so
+// it runs in the background, check on it with GET /library.
+func rescanLibrary(lib *library.Library) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !libraryAvailable(lib, w) {
+			return
+		}
+		if lib.Status().Scanning {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintln(w, "{\"error\":\"the library is already being scanned.\"}")
+			return
+		}
+
+		go lib.Scan()
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "{\"message\":\"library rescan started\"}")
+	})
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/queue"
+)
+
+// Limits caps how much each user can do. A zero value means no limit.
+type Limits struct {
+	MaxQueued       int           // songs one user can have waiting in the queue
+	EnqueuesPerHour int           // enqueues and playnexts one user can make an hour
+	SkipCooldown    time.Duration // how long a user has to wait between skips
+	PlaylistCap     int           // songs one playlist can add to the queue
+	UploadSize      int64         // bytes one upload can be
+}
+
+// How often users that haven't done anything limited in a while are forgotten
+const pruneInterval = 10 * time.Minute
+
+// Routes each kind of limit applies to
+var (
+	enqueueRoutes = map[string]bool{
+		"/api/enqueue": true, "/api/playnext": true, "/api/enqueue-playlist": true, "/api/requeue": true,
+	}
+	skipRoutes = map[string]bool{"/api/skip": true, "/api/shuffle": true}
+)
+
+// quota is where a user stands against the limits
+type quota struct {
+	User              string `json:"user"`
+	Queued            int    `json:"queued"`
+	MaxQueued         int    `json:"maxQueued"`
+	EnqueuesThisHour  int    `json:"enqueuesThisHour"`
+	EnqueuesPerHour   int    `json:"enqueuesPerHour"`
+	EnqueueRetryAfter int    `json:"enqueueRetryAfter"` // seconds until another enqueue is allowed
+	SkipCooldown      int    `json:"skipCooldown"`
+	SkipRetryAfter    int    `json:"skipRetryAfter"` // seconds until another skip is allowed
+}
+
+// rateLimiter enforces the limits per user. Requests from users we can't
+// name are counted by address instead.
+type rateLimiter struct {
+	limits Limits
+	q      *queue.Queue
+	now    func() time.Time
+
+	lock      *sync.Mutex
+	enqueues  map[string][]time.Time // recent enqueues, oldest first
+	lastSkip  map[string]time.Time
+	lastPrune time.Time
+}
+
+func newRateLimiter(limits Limits, q *queue.Queue) *rateLimiter {
+	return &rateLimiter{
+		limits:   limits,
+		q:        q,
+		now:      time.Now,
+		lock:     &sync.Mutex{},
+		enqueues: make(map[string][]time.Time),
+		lastSkip: make(map[string]time.Time),
+	}
+}
+
+// prune forgets users whose enqueues and skips no longer count against them,
+// there'd be one for every address that ever showed up otherwise. Only does
+// anything every pruneInterval. Must be called with the lock held.
+func (rl *rateLimiter) prune() {
+	now := rl.now()
+	if now.Sub(rl.lastPrune) < pruneInterval {
+		return
+	}
+	rl.lastPrune = now
+
+	for key, recent := range rl.enqueues {
+		if len(recent) == 0 || now.Sub(recent[len(recent)-1]) >= time.Hour {
+			delete(rl.enqueues, key)
+		}
+	}
+	for key, lastSkip := range rl.lastSkip {
+		if now.Sub(lastSkip) >= rl.limits.SkipCooldown {
+			delete(rl.lastSkip, key)
+		}
+	}
+}
+
+// limitKey gives who the request is counted against
+func limitKey(r *http.Request) string {
+	if user := userFromRequest(r); user != "" {
+		return user
+	}
+	// Strip the port so reconnecting doesn't reset the count
+	host := r.RemoteAddr
+	if idx := strings.LastIndex(host, ":"); idx != -1 {
+		host = host[:idx]
+	}
+	return "addr:" + host
+}
+
+// seconds rounds the duration up to whole seconds, for Retry-After
+func seconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+// check works out the user's quota. Must be called with the lock held.
+func (rl *rateLimiter) check(key string, user string) quota {
+	now := rl.now()
+	q := quota{
+		User:            user,
+		MaxQueued:       rl.limits.MaxQueued,
+		EnqueuesPerHour: rl.limits.EnqueuesPerHour,
+		SkipCooldown:    seconds(rl.limits.SkipCooldown),
+	}
+
+	// Only songs with a name on them can be counted
+	if user != "" {
+		for _, song := range rl.q.GetQueue() {
+			if song.QueuedBy == user {
+				q.Queued++
+			}
+		}
+	}
+
+	// Forget enqueues more than an hour old
+	recent := rl.enqueues[key]
+	for len(recent) > 0 && now.Sub(recent[0]) >= time.Hour {
+		recent = recent[1:]
+	}
+	if len(recent) > 0 {
+		rl.enqueues[key] = recent
+	} else {
+		delete(rl.enqueues, key)
+	}
+	q.EnqueuesThisHour = len(recent)
+
+	if rl.limits.EnqueuesPerHour > 0 && len(recent) >= rl.limits.EnqueuesPerHour {
+		q.EnqueueRetryAfter = seconds(recent[len(recent)-rl.limits.EnqueuesPerHour].Add(time.Hour).Sub(now))
+	}
+	if lastSkip, exists := rl.lastSkip[key]; exists && rl.limits.SkipCooldown > 0 {
+		q.SkipRetryAfter = seconds(lastSkip.Add(rl.limits.SkipCooldown).Sub(now))
+	}
+
+	return q
+}
+
+// Quota gives where the user making the request stands against the limits
+func (rl *rateLimiter) Quota(r *http.Request) quota {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.check(limitKey(r), userFromRequest(r))
+}
+
+// RecordEnqueues counts n more enqueues against the user making the request,
+// for requests that queue more than one song
+func (rl *rateLimiter) RecordEnqueues(r *http.Request, n int) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	key, now := limitKey(r), rl.now()
+	for i := 0; i < n; i++ {
+		rl.enqueues[key] = append(rl.enqueues[key], now)
+	}
+}
+
+// statusRecorder remembers the status the handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware turns away requests that would go over the user's limits with a
+// 429, and counts the ones that succeed
+func (rl *rateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isEnqueue, isSkip := enqueueRoutes[r.URL.Path], skipRoutes[r.URL.Path]
+		// Uploads only count as enqueues when they're queued
+		if r.URL.Path == "/api/upload" && r.URL.Query().Get("queue") != "" {
+			isEnqueue = true
+		}
+		if r.Method != http.MethodPost || (!isEnqueue && !isSkip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, user := limitKey(r), userFromRequest(r)
+		rl.lock.Lock()
+		rl.prune()
+		q := rl.check(key, user)
+
+		retryAfter, reason := 0, ""
+		if isEnqueue && q.MaxQueued > 0 && q.Queued >= q.MaxQueued {
+			// Frees up when one of their songs plays, we can't know when that is
+			retryAfter, reason = 60, fmt.Sprintf("you already have %d songs in the queue", q.Queued)
+		} else if isEnqueue && q.EnqueueRetryAfter > 0 {
+			retryAfter, reason = q.EnqueueRetryAfter, fmt.Sprintf("you can only queue %d songs an hour", q.EnqueuesPerHour)
+		} else if isSkip && q.SkipRetryAfter > 0 {
+			retryAfter, reason = q.SkipRetryAfter, "you skipped too recently"
+		}
+
+		// Count the request up front so simultaneous ones can't sneak past
+		// the limit, and take it back if it fails
+		now := rl.now()
+		lastSkip, skippedBefore := rl.lastSkip[key]
+		if reason == "" {
+			if isEnqueue {
+				rl.enqueues[key] = append(rl.enqueues[key], now)
+			} else {
+				rl.lastSkip[key] = now
+			}
+		}
+		rl.lock.Unlock()
+
+		if reason != "" {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintf(w, "{\"error\":\"%s, try again in %d seconds.\"}\n", reason, retryAfter)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if recorder.status < 400 {
+			return
+		}
+
+		rl.lock.Lock()
+		if isEnqueue {
+			recent := rl.enqueues[key]
+			for idx := len(recent) - 1; idx >= 0; idx-- {
+				if recent[idx].Equal(now) {
+					rl.enqueues[key] = append(recent[:idx], recent[idx+1:]...)
+					break
+				}
+			}
+		} else if skippedBefore {
+			rl.lastSkip[key] = lastSkip
+		} else {
+			delete(rl.lastSkip, key)
+		}
+		rl.lock.Unlock()
+	})
+}
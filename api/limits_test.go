@@ -0,0 +1,155 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/db"
+	"github.com/VivaLaPanda/uta-stream/queue"
+	"github.com/VivaLaPanda/uta-stream/queue/auto"
+	"github.com/VivaLaPanda/uta-stream/resource"
+	"github.com/VivaLaPanda/uta-stream/resource/cache"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
+)
+
+func newTestQueue(t *testing.T) *queue.Queue {
+	database := db.OpenTemp(t)
+	store, _ := storage.NewLocalStore(t.TempDir())
+	c := cache.NewCache(database, "", store)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	return queue.NewQueue(database, a, c, queue.CommunityMode, 0, store)
+}
+
+// limitedRequest sends a request as the user through the limiter to a
+// handler that responds with status
+func limitedRequest(rl *rateLimiter, user string, route string, status int) *httptest.ResponseRecorder {
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	req := httptest.NewRequest("POST", route, nil)
+	req = req.WithContext(context.WithValue(req.Context(), userKey, user))
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestEnqueueLimit(t *testing.T) {
+	rl := newRateLimiter(Limits{EnqueuesPerHour: 2}, newTestQueue(t))
+	now := time.Date(2020, 1, 1, 15, 0, 0, 0, time.UTC)
+	rl.now = func() time.Time { return now }
+
+	// Failed requests don't count
+	limitedRequest(rl, "", "/api/enqueue", http.StatusBadRequest)
+	limitedRequest(rl, "", "/api/enqueue", http.StatusOK)
+	now = now.Add(10 * time.Minute)
+	limitedRequest(rl, "", "/api/playnext", http.StatusOK)
+
+	resp := limitedRequest(rl, "", "/api/enqueue", http.StatusOK)
+	if resp.Code != http.StatusTooManyRequests {
+		t.Errorf("Third enqueue in an hour should be refused, got %d\n", resp.Code)
+		return
+	}
+	// The first enqueue frees up 50 minutes from now
+	if resp.Header().Get("Retry-After") != "3000" {
+		t.Errorf("Retry-After should be 3000, got %s\n", resp.Header().Get("Retry-After"))
+	}
+
+	now = now.Add(50 * time.Minute)
+	if resp = limitedRequest(rl, "", "/api/enqueue", http.StatusOK); resp.Code != http.StatusOK {
+		t.Errorf("Enqueue should be allowed once the first is an hour old, got %d\n", resp.Code)
+	}
+}
+
+func TestSkipCooldown(t *testing.T) {
+	rl := newRateLimiter(Limits{SkipCooldown: 30 * time.Second}, newTestQueue(t))
+	now := time.Date(2020, 1, 1, 15, 0, 0, 0, time.UTC)
+	rl.now = func() time.Time { return now }
+
+	limitedRequest(rl, "", "/api/skip", http.StatusOK)
+	now = now.Add(10 * time.Second)
+	resp := limitedRequest(rl, "", "/api/skip", http.StatusOK)
+	if resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") != "20" {
+		t.Errorf("Skip during cooldown should be refused for 20s. Code: %d, Retry-After: %s\n",
+			resp.Code, resp.Header().Get("Retry-After"))
+	}
+
+	// Each user has their own cooldown, and other routes aren't limited
+	if resp = limitedRequest(rl, "alice", "/api/skip", http.StatusOK); resp.Code != http.StatusOK {
+		t.Errorf("Another user's skip shouldn't be limited, got %d\n", resp.Code)
+	}
+	if resp = limitedRequest(rl, "", "/api/pause", http.StatusOK); resp.Code != http.StatusOK {
+		t.Errorf("Unlimited route was refused, got %d\n", resp.Code)
+	}
+}
+
+func TestMaxQueued(t *testing.T) {
+	q := newTestQueue(t)
+	rl := newRateLimiter(Limits{MaxQueued: 1}, q)
+
+	song, _ := resource.NewSong("https://example.com/a.mp3")
+	song.QueuedBy = "alice"
+	q.AddToQueue(song)
+
+	if resp := limitedRequest(rl, "alice", "/api/enqueue", http.StatusOK); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("alice already has a song queued, enqueue should be refused. Got %d\n", resp.Code)
+	}
+	if resp := limitedRequest(rl, "bob", "/api/enqueue", http.StatusOK); resp.Code != http.StatusOK {
+		t.Errorf("bob has nothing queued, enqueue should be allowed. Got %d\n", resp.Code)
+	}
+}
+
+func TestUploadLimit(t *testing.T) {
+	rl := newRateLimiter(Limits{EnqueuesPerHour: 1}, newTestQueue(t))
+
+	// Uploading alone isn't queueing anything
+	limitedRequest(rl, "", "/api/upload", http.StatusOK)
+	if resp := limitedRequest(rl, "", "/api/upload?queue=enqueue", http.StatusOK); resp.Code != http.StatusOK {
+		t.Errorf("Plain uploads shouldn't count as enqueues, got %d\n", resp.Code)
+	}
+	if resp := limitedRequest(rl, "", "/api/upload?queue=playnext", http.StatusOK); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("Queued uploads should count as enqueues, got %d\n", resp.Code)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	rl := newRateLimiter(Limits{EnqueuesPerHour: 5, SkipCooldown: 30 * time.Second}, newTestQueue(t))
+	now := time.Date(2020, 1, 1, 15, 0, 0, 0, time.UTC)
+	rl.now = func() time.Time { return now }
+
+	limitedRequest(rl, "", "/api/requeue", http.StatusOK)
+	limitedRequest(rl, "", "/api/skip", http.StatusOK)
+	if len(rl.enqueues) != 1 {
+		t.Errorf("Requeueing should count as an enqueue\n")
+	}
+
+	// Someone else coming along after an hour clears out the idle address
+	now = now.Add(time.Hour)
+	limitedRequest(rl, "alice", "/api/enqueue", http.StatusOK)
+	if _, exists := rl.enqueues["addr:192.0.2.1"]; exists || len(rl.lastSkip) != 0 {
+		t.Errorf("Idle users should be forgotten. Enqueues: %v, skips: %v\n", rl.enqueues, rl.lastSkip)
+	}
+	if len(rl.enqueues["alice"]) != 1 {
+		t.Errorf("Active users should be kept. Enqueues: %v\n", rl.enqueues)
+	}
+}
+
+func TestRecordEnqueues(t *testing.T) {
+	rl := newRateLimiter(Limits{EnqueuesPerHour: 3}, newTestQueue(t))
+
+	// A playlist that queued three songs
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.RecordEnqueues(r, 2)
+	}))
+	req := httptest.NewRequest("POST", "/api/enqueue-playlist", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if quota := rl.Quota(req); quota.EnqueuesThisHour != 3 {
+		t.Errorf("Every song in the playlist should count, got %d enqueues\n", quota.EnqueuesThisHour)
+	}
+	if resp := limitedRequest(rl, "", "/api/enqueue", http.StatusOK); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("Enqueue after using up the hour on a playlist should be refused, got %d\n", resp.Code)
+	}
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/db"
+)
+
+// How often a token's last used time is written back, so busy tokens don't
+// mean a database write for every request
+var lastUsedResolution = time.Minute
+
+// tokenRecord is what we keep about a minted token. Only a salted hash of the
+// secret is kept, the token itself is shown once when minted and never again.
+type tokenRecord struct {
+	ID       string     `json:"id"`
+	Label    string     `json:"label"`
+	Name     string     `json:"name"`
+	Roles    []string   `json:"roles"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Salt     string     `json:"salt"`
+	Hash     string     `json:"hash"`
+}
+
+// expired reports whether the token has passed its expiry
+func (t *tokenRecord) expired(now time.Time) bool {
+	return t.Expires != nil && !now.Before(*t.Expires)
+}
+
+// tokenStore keeps minted tokens in the database. Tokens look like
+// <id>.<secret>, the id is used to find the record and the secret is checked
+// against its hash.
+type tokenStore struct {
+	db   *db.DB
+	lock *sync.Mutex
+}
+
+func newTokenStore(database *db.DB) *tokenStore {
+	return &tokenStore{db: database, lock: &sync.Mutex{}}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSecret(salt string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *tokenStore) get(id string) (*tokenRecord, error) {
+	recordData, err := s.db.Get(db.TokensBucket, id)
+	if err != nil || recordData == nil {
+		return nil, err
+	}
+	record := &tokenRecord{}
+	if err = json.Unmarshal(recordData, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *tokenStore) put(record *tokenRecord) error {
+	recordData, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(db.TokensBucket, record.ID, recordData)
+}
+
+// Mint makes a new token for the named user with the provided roles. The
+// token returned is the only time the secret is ever available.
+func (s *tokenStore) Mint(label string, name string, roles []string, expires *time.Time) (token string, record *tokenRecord, err error) {
+	id, err := randomHex(8)
+	if err == nil {
+		token, err = randomHex(32)
+	}
+	salt := ""
+	if err == nil {
+		salt, err = randomHex(16)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate token. Err: %v", err)
+	}
+
+	record = &tokenRecord{
+		ID:      id,
+		Label:   label,
+		Name:    name,
+		Roles:   roles,
+		Created: time.Now(),
+		Expires: expires,
+		Salt:    salt,
+		Hash:    hashSecret(salt, token),
+	}
+	if err = s.put(record); err != nil {
+		return "", nil, fmt.Errorf("failed to save token. Err: %v", err)
+	}
+
+	return id + "." + token, record, nil
+}
+
+// Check finds the record for the token, as long as it's valid and hasn't
+// expired
+func (s *tokenStore) Check(token string) (*tokenRecord, bool) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record, err := s.get(parts[0])
+	if err != nil || record == nil {
+		return nil, false
+	}
+	if !hmac.Equal([]byte(hashSecret(record.Salt, parts[1])), []byte(record.Hash)) {
+		return nil, false
+	}
+	now := time.Now()
+	if record.expired(now) {
+		return nil, false
+	}
+
+	if record.LastUsed == nil || now.Sub(*record.LastUsed) >= lastUsedResolution {
+		record.LastUsed = &now
+		if err = s.put(record); err != nil {
+			log.Printf("Failed to record use of token %s. Err: %v\n", record.ID, err)
+		}
+	}
+
+	return record, true
+}
+
+// List gives every minted token, including expired ones
+func (s *tokenStore) List() ([]*tokenRecord, error) {
+	records := []*tokenRecord{}
+	err := s.db.ForEach(db.TokensBucket, func(key string, value []byte) error {
+		record := &tokenRecord{}
+		if err := json.Unmarshal(value, record); err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	})
+
+	return records, err
+}
+
+// update applies change to the record for the id and saves it
+func (s *tokenStore) update(id string, change func(record *tokenRecord)) (*tokenRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("no token with id %s", id)
+	}
+	change(record)
+
+	return record, s.put(record)
+}
+
+// Label changes the label of the token with the id
+func (s *tokenStore) Label(id string, label string) (*tokenRecord, error) {
+	return s.update(id, func(record *tokenRecord) {
+		record.Label = label
+	})
+}
+
+// Expire sets when the token with the id stops working
+func (s *tokenStore) Expire(id string, at time.Time) (*tokenRecord, error) {
+	return s.update(id, func(record *tokenRecord) {
+		record.Expires = &at
+	})
+}
+
+// Revoke deletes the token with the id, it stops working right away
+func (s *tokenStore) Revoke(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record, err := s.get(id)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("no token with id %s", id)
+	}
+
+	return s.db.Delete(db.TokensBucket, id)
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/db"
+)
+
+func TestMintCheck(t *testing.T) {
+	database := db.OpenTemp(t)
+	store := newTokenStore(database)
+
+	token, record, err := store.Mint("laptop", "alice", []string{"listener"}, nil)
+	if err != nil {
+		t.Errorf("Failed to mint token. Err: %v\n", err)
+		return
+	}
+	if !strings.HasPrefix(token, record.ID+".") {
+		t.Errorf("Token should start with its id. Token: %s, id: %s\n", token, record.ID)
+	}
+
+	// Only the hash should be stored
+	stored, _ := database.Get(db.TokensBucket, record.ID)
+	secret := strings.SplitN(token, ".", 2)[1]
+	if strings.Contains(string(stored), secret) {
+		t.Errorf("Token secret was stored in plaintext\n")
+	}
+
+	checked, valid := store.Check(token)
+	if !valid || checked.Name != "alice" || checked.LastUsed == nil {
+		t.Errorf("Minted token should be valid and have its use recorded. Record: %+v\n", checked)
+	}
+	if _, valid = store.Check(record.ID + ".wrong"); valid {
+		t.Errorf("Token with the wrong secret shouldn't be valid\n")
+	}
+	if _, valid = store.Check("nonsense"); valid {
+		t.Errorf("Malformed token shouldn't be valid\n")
+	}
+}
+
+func TestExpireRevoke(t *testing.T) {
+	store := newTokenStore(db.OpenTemp(t))
+	token, record, _ := store.Mint("", "alice", []string{"listener"}, nil)
+
+	store.Label(record.ID, "phone")
+	store.Expire(record.ID, time.Now().Add(time.Hour))
+	records, _ := store.List()
+	if len(records) != 1 || records[0].Label != "phone" || records[0].Expires == nil {
+		t.Errorf("Token wasn't updated. Records: %+v\n", records)
+	}
+	if _, valid := store.Check(token); !valid {
+		t.Errorf("Token expiring in the future should still be valid\n")
+	}
+
+	store.Expire(record.ID, time.Now())
+	if _, valid := store.Check(token); valid {
+		t.Errorf("Expired token shouldn't be valid\n")
+	}
+
+	if err := store.Revoke(record.ID); err != nil {
+		t.Errorf("Failed to revoke token. Err: %v\n", err)
+	}
+	if err := store.Revoke(record.ID); err == nil {
+		t.Errorf("Revoking a missing token should give an error\n")
+	}
+}
+
+func TestMintedTokenAuth(t *testing.T) {
+	amw, err := NewAuthMiddleware("test_auth.json", "/api", db.OpenTemp(t))
+	if err != nil {
+		t.Errorf("Err should be nil, valid file was provided. err: %s\n", err)
+		return
+	}
+	token, _, _ := amw.tokens.Mint("", "alice", []string{"listener"}, nil)
+
+	if !amw.ValidateToken("Bearer "+token, "/api/playing", "GET") {
+		t.Errorf("Minted token should get its role's routes\n")
+	}
+	if amw.ValidateToken("Bearer "+token, "/api/dj/claim", "POST") {
+		t.Errorf("Minted token shouldn't get routes outside its roles\n")
+	}
+	if name := amw.UserName("Bearer " + token); name != "alice" {
+		t.Errorf("Minted token should belong to alice, got %s\n", name)
+	}
+}
+
+func TestCanMint(t *testing.T) {
+	amw, err := NewAuthMiddleware("test_auth.json", "/api", db.OpenTemp(t))
+	if err != nil {
+		t.Errorf("Err should be nil, valid file was provided. err: %s\n", err)
+		return
+	}
+
+	// bar is dj-user, with the listener and dj roles
+	roles, name := amw.resolve("Bearer bar")
+	if err := amw.canMint(roles, name, "dj-user", []string{"listener"}); err != nil {
+		t.Errorf("Should be able to mint a token with a role we have. Err: %v\n", err)
+	}
+	if err := amw.canMint(roles, name, "alice", []string{"listener"}); err == nil {
+		t.Errorf("Shouldn't be able to mint a token for someone else\n")
+	}
+	if err := amw.canMint(roles, name, "dj-user", []string{"*"}); err == nil {
+		t.Errorf("Shouldn't be able to give out a role we don't have\n")
+	}
+	if err := amw.canMint(roles, name, "dj-user", []string{"enqueue"}); err == nil {
+		t.Errorf("Shouldn't be able to give out a role that isn't in the config\n")
+	}
+
+	// su has *
+	roles, name = amw.resolve("Bearer su")
+	if err := amw.canMint(roles, name, "alice", []string{"listener", "dj"}); err != nil {
+		t.Errorf("* should be able to mint for anyone. Err: %v\n", err)
+	}
+	if err := amw.canMint(roles, name, "alice", []string{"made-up"}); err == nil {
+		t.Errorf("Even * shouldn't give out roles that aren't in the config\n")
+	}
+}
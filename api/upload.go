@@ -0,0 +1,94 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/VivaLaPanda/uta-stream/queue"
+	"github.com/VivaLaPanda/uta-stream/resource/cache"
+	"github.com/VivaLaPanda/uta-stream/resource/download"
+)
+
+// Uploads bigger than this are written to a temp file while they're parsed
+const uploadMemory = 1 << 20
+
+// uploadQueues are the ways an upload can be queued right away
+func uploadQueues(q *queue.Queue) map[string]QFunc {
+	return map[string]QFunc{"enqueue": q.AddToQueue, "playnext": q.PlayNext}
+}
+
+// uploader takes an audio file sent as a multipart form, with the audio in
+// "file" and optionally a "title" and "artist". The song can be queued by
+// passing ?queue=enqueue or ?queue=playnext. maxSize caps the size of the
+// upload in bytes, 0 means no limit.
+func uploader(q *queue.Queue, c *cache.Cache, maxSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queueAs := r.URL.Query().Get("queue")
+		qFunc, validQueue := uploadQueues(q)[queueAs]
+		if queueAs != "" && !validQueue {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "{\"error\":\"queue should be enqueue or playnext.\"}")
+			return
+		}
+		if queueAs != "" && !q.CanControl(userFromRequest(r)) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "{\"error\":\"the station is in DJ mode, only the DJ can do that.\"}")
+			return
+		}
+
+		tooLarge := fmt.Sprintf("{\"error\":\"uploads can be at most %.1f MB.\"}", float64(maxSize)/(1<<20))
+		if maxSize > 0 {
+			if r.ContentLength > maxSize {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				fmt.Fprintln(w, tooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		}
+		if err := r.ParseMultipartForm(uploadMemory); err != nil {
+			if strings.Contains(err.Error(), "request body too large") {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				fmt.Fprintln(w, tooLarge)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "{\"error\":%q}\n", "couldn't read the upload: "+err.Error())
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "{\"error\":\"/upload expects an audio file in the file field of a multipart form.\"}")
+			return
+		}
+		defer file.Close()
+
+		song, err := c.Upload(file, header.Filename, r.FormValue("title"), r.FormValue("artist"))
+		if errors.Is(err, download.ErrNotAudio) {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			fmt.Fprintf(w, "{\"error\":%q}\n", header.Filename+" is "+err.Error())
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "{\"error\":\"failed to store upload.\"}")
+			log.Printf("Failed to store upload %s, err: %v", header.Filename, err)
+			return
+		}
+
+		message := "successfully uploaded"
+		if validQueue {
+			song = c.Queued(song, userFromRequest(r))
+			qFunc(song)
+			message = "successfully uploaded and queued"
+		}
+
+		w.WriteHeader(http.StatusOK)
+		jsonData, _ := song.MarshalJSON()
+		fmt.Fprintf(w, "{\"message\":%q,\"track\":%s}\n", message, jsonData)
+	})
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VivaLaPanda/uta-stream/db"
+	"github.com/VivaLaPanda/uta-stream/resource/cache"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
+)
+
+// uploadRequest sends the file to the upload handler as a multipart form
+func uploadRequest(handler http.Handler, filename string, contents string, query string) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	if filename != "" {
+		part, _ := form.CreateFormFile("file", filename)
+		part.Write([]byte(contents))
+	}
+	form.WriteField("title", "Title")
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/api/upload"+query, body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestUploadRejects(t *testing.T) {
+	store, _ := storage.NewLocalStore(t.TempDir())
+	c := cache.NewCache(db.OpenTemp(t), "", store)
+	handler := uploader(newTestQueue(t), c, 1024)
+
+	testTable := []struct {
+		name     string
+		filename string
+		contents string
+		query    string
+		status   int
+	}{
+		{"no file", "", "", "", http.StatusBadRequest},
+		{"too large", "song.mp3", strings.Repeat("a", 2048), "", http.StatusRequestEntityTooLarge},
+		{"wrong format", "song.exe", "audio", "", http.StatusUnsupportedMediaType},
+		{"bad queue", "song.mp3", "audio", "?queue=later", http.StatusBadRequest},
+	}
+
+	for _, test := range testTable {
+		if resp := uploadRequest(handler, test.filename, test.contents, test.query); resp.Code != test.status {
+			t.Errorf("Upload with %s should get %d, got %d: %s\n", test.name, test.status, resp.Code, resp.Body.String())
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/VivaLaPanda/uta-stream/resource"
+)
+
+// VoteSkip sets how many votes it takes to skip a song. The song is skipped
+// once the votes are more than Fraction of the listeners, or reach Votes,
+// whichever comes first. Zero turns that threshold off. When no listeners are
+// counted it never takes fewer than MinVotes.
+type VoteSkip struct {
+	Fraction float64
+	Votes    int
+	MinVotes int
+}
+
+// voteTally is where the vote to skip the current song stands
+type voteTally struct {
+	Votes  int `json:"votes"`
+	Needed int `json:"needed"`
+}
+
+// skipVoter counts votes to skip the current song. Each voter gets one vote
+// per song, and the votes are thrown out whenever the song changes.
+type skipVoter struct {
+	thresholds     VoteSkip
+	current        func() *resource.Song
+	skip           func()
+	listenerCounts func() map[string]int
+
+	lock   *sync.Mutex
+	song   *resource.Song
+	voters map[string]bool
+}
+
+func newSkipVoter(thresholds VoteSkip, current func() *resource.Song, skip func(), listenerCounts func() map[string]int) *skipVoter {
+	return &skipVoter{
+		thresholds:     thresholds,
+		current:        current,
+		skip:           skip,
+		listenerCounts: listenerCounts,
+		lock:           &sync.Mutex{},
+		voters:         make(map[string]bool),
+	}
+}
+
+// totalListeners adds up the listeners across every mount
+func totalListeners(listenerCounts func() map[string]int) int {
+	total := 0
+	for _, count := range listenerCounts() {
+		total += count
+	}
+	return total
+}
+
+// needed gives how many votes it takes to skip with the provided listeners
+func (sv *skipVoter) needed(listeners int) int {
+	needed := math.MaxInt32
+	if sv.thresholds.Fraction > 0 {
+		needed = int(math.Floor(sv.thresholds.Fraction*float64(listeners))) + 1
+	}
+	if sv.thresholds.Votes > 0 && sv.thresholds.Votes < needed {
+		needed = sv.thresholds.Votes
+	}
+	// With nobody counted the fraction would let a single vote skip
+	if listeners == 0 && needed < sv.thresholds.MinVotes {
+		needed = sv.thresholds.MinVotes
+	}
+	return needed
+}
+
+// sync throws out the votes if the song has changed since they were cast.
+// Must be called with the lock held.
+func (sv *skipVoter) sync(current *resource.Song) {
+	if current != sv.song {
+		sv.song = current
+		sv.voters = make(map[string]bool)
+	}
+}
+
+// Tally gives the votes against the current song
+func (sv *skipVoter) Tally() voteTally {
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+	sv.sync(sv.current())
+	return voteTally{len(sv.voters), sv.needed(totalListeners(sv.listenerCounts))}
+}
+
+// Vote records the voter's vote against the current song, skipping it if
+// that's enough votes. Voting twice on the same song doesn't count.
+func (sv *skipVoter) Vote(voter string) (tally voteTally, skipped bool) {
+	sv.lock.Lock()
+	sv.sync(sv.current())
+	sv.voters[voter] = true
+	tally = voteTally{len(sv.voters), sv.needed(totalListeners(sv.listenerCounts))}
+	skipped = tally.Votes >= tally.Needed
+	if skipped {
+		sv.voters = make(map[string]bool)
+	}
+	sv.lock.Unlock()
+
+	if skipped {
+		sv.skip()
+	}
+	return tally, skipped
+}
+
+// castSkipVote casts the requester's vote to skip the current song
+func castSkipVote(sv *skipVoter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tally, skipped := sv.Vote(limitKey(r))
+
+		message := "vote counted"
+		if skipped {
+			message = "vote counted, song skipped"
+		}
+		respString, _ := json.Marshal(struct {
+			Message string    `json:"message"`
+			Skipped bool      `json:"skipped"`
+			Votes   voteTally `json:"votes"`
+		}{message, skipped, tally})
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, string(respString))
+	})
+}
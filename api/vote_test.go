@@ -0,0 +1,81 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/VivaLaPanda/uta-stream/resource"
+)
+
+func TestVoteSkip(t *testing.T) {
+	song := &resource.Song{Title: "first"}
+	skips := 0
+	listeners := map[string]int{"/stream.mp3": 3, "/stream.ogg": 1}
+	sv := newSkipVoter(VoteSkip{Fraction: 0.5}, func() *resource.Song { return song }, func() { skips++ },
+		func() map[string]int { return listeners })
+
+	// 4 listeners, so it takes 3 votes to get past half
+	if tally := sv.Tally(); tally.Votes != 0 || tally.Needed != 3 {
+		t.Errorf("Expected 0/3 votes before anyone voted, got %d/%d\n", tally.Votes, tally.Needed)
+	}
+	sv.Vote("alice")
+	tally, skipped := sv.Vote("alice")
+	if skipped || tally.Votes != 1 {
+		t.Errorf("Voting twice should only count once, got %d votes\n", tally.Votes)
+	}
+	sv.Vote("addr:10.0.0.1")
+
+	// A new song throws out the votes
+	song = &resource.Song{Title: "second"}
+	if tally = sv.Tally(); tally.Votes != 0 {
+		t.Errorf("Votes should reset when the song changes, got %d\n", tally.Votes)
+	}
+
+	sv.Vote("alice")
+	sv.Vote("bob")
+	if tally, skipped = sv.Vote("carol"); !skipped || skips != 1 {
+		t.Errorf("Third vote of 4 listeners should skip, got %d/%d\n", tally.Votes, tally.Needed)
+	}
+}
+
+func TestVoteSkipThreshold(t *testing.T) {
+	song := &resource.Song{Title: "first"}
+	listeners := map[string]int{"/stream.mp3": 100}
+	sv := newSkipVoter(VoteSkip{Fraction: 0.5, Votes: 2}, func() *resource.Song { return song }, func() {},
+		func() map[string]int { return listeners })
+
+	// The absolute threshold wins when it's lower
+	if tally := sv.Tally(); tally.Needed != 2 {
+		t.Errorf("Expected 2 votes needed, got %d\n", tally.Needed)
+	}
+	sv.Vote("alice")
+	if _, skipped := sv.Vote("bob"); !skipped {
+		t.Errorf("Second vote should have skipped\n")
+	}
+
+	// The fraction wins when it's lower
+	listeners["/stream.mp3"] = 1
+	if tally := sv.Tally(); tally.Needed != 1 {
+		t.Errorf("Expected 1 vote needed, got %d\n", tally.Needed)
+	}
+}
+
+func TestVoteSkipNoListeners(t *testing.T) {
+	song := &resource.Song{Title: "first"}
+	listeners := map[string]int{"/stream.mp3": 0}
+	sv := newSkipVoter(VoteSkip{Fraction: 0.5, MinVotes: 2}, func() *resource.Song { return song }, func() {},
+		func() map[string]int { return listeners })
+
+	// Nobody counted shouldn't let one vote skip
+	if _, skipped := sv.Vote("alice"); skipped {
+		t.Errorf("A single vote with no listeners counted shouldn't skip\n")
+	}
+	if _, skipped := sv.Vote("bob"); !skipped {
+		t.Errorf("Second vote should have reached the minimum and skipped\n")
+	}
+
+	// The minimum only applies when nobody is counted
+	listeners["/stream.mp3"] = 1
+	if tally := sv.Tally(); tally.Needed != 1 {
+		t.Errorf("Expected 1 vote needed with 1 listener, got %d\n", tally.Needed)
+	}
+}
@@ -0,0 +1,240 @@
+// Package db wraps the embedded key value store that holds the persistent
+// state of the server. Each component keeps its data in its own bucket and
+// writes only what changed, every write being its own crash safe transaction.
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets used by the various components
+const (
+	CacheBucket     = "cache"
+	QueueBucket     = "queue"
+	AutoqBucket     = "autoq"
+	HistoryBucket   = "history"
+	TokensBucket    = "tokens"
+	RatingsBucket   = "ratings"
+	BlacklistBucket = "blacklist"
+	LibraryBucket   = "library"
+)
+
+// DB is a handle on the database file. It is safe for concurrent use.
+type DB struct {
+	bolt *bolt.DB
+}
+
+// Open will open (or create) the database at the provided filename. Only one
+// process may have the file open at once.
+func Open(filename string) (*DB, error) {
+	boltDB, err := bolt.Open(filename, 0660, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s. Err: %v", filename, err)
+	}
+
+	return &DB{bolt: boltDB}, nil
+}
+
+// Close releases the database file
+func (d *DB) Close() error {
+	return d.bolt.Close()
+}
+
+// Put stores the value under the key in the provided bucket, creating the
+// bucket if needed
+func (d *DB) Put(bucket string, key string, value []byte) error {
+	return d.bolt.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+// Get returns the value stored under the key, or nil if there isn't one
+func (d *DB) Get(bucket string, key string) (value []byte, err error) {
+	err = d.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		// Bolt's slices are only valid during the transaction
+		if stored := b.Get([]byte(key)); stored != nil {
+			value = append([]byte{}, stored...)
+		}
+		return nil
+	})
+
+	return value, err
+}
+
+// Delete removes the key from the bucket. Deleting a missing key isn't an error.
+func (d *DB) Delete(bucket string, key string) error {
+	return d.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// ForEach calls fn for every key in the bucket, in key order. The value passed
+// to fn is only valid until fn returns.
+func (d *DB) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	return d.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// ForEachBefore calls fn for the keys at or before the provided key, in
+// reverse key order, until fn returns false. An empty key starts from the last
+// key in the bucket. The value passed to fn is only valid until fn returns.
+func (d *DB) ForEachBefore(bucket string, key string, fn func(key string, value []byte) (bool, error)) error {
+	return d.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		var k, v []byte
+		if key == "" {
+			k, v = c.Last()
+		} else if k, v = c.Seek([]byte(key)); k == nil {
+			// Everything is before the key
+			k, v = c.Last()
+		} else if string(k) != key {
+			// Seek lands on the first key after, step back onto the one before
+			k, v = c.Prev()
+		}
+
+		for ; k != nil; k, v = c.Prev() {
+			more, err := fn(string(k), v)
+			if err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Replace swaps the whole contents of the bucket for the provided entries
+// in a single transaction, so readers see either all of the old data or all
+// of the new
+func (d *DB) Replace(bucket string, entries map[string][]byte) error {
+	return d.bolt.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucket)) != nil {
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucket([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for k, v := range entries {
+			if err = b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Sync makes the bucket hold exactly the provided entries, in a single
+// transaction. Unlike Replace only what differs is touched: keys whose value
+// changed are written and keys missing from entries are deleted.
+func (d *DB) Sync(bucket string, entries map[string][]byte) error {
+	return d.bolt.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		// Bolt doesn't allow deleting while iterating
+		stale := [][]byte{}
+		err = b.ForEach(func(k, v []byte) error {
+			if _, keep := entries[string(k)]; !keep {
+				stale = append(stale, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		for k, v := range entries {
+			if bytes.Equal(b.Get([]byte(k)), v) {
+				continue
+			}
+			if err = b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// IsEmpty reports whether the bucket has no keys in it
+func (d *DB) IsEmpty(bucket string) (empty bool, err error) {
+	err = d.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			empty = true
+			return nil
+		}
+		k, _ := b.Cursor().First()
+		empty = k == nil
+		return nil
+	})
+
+	return empty, err
+}
+
+// Migrate is used to import the flat files that were used for persistence
+// before the database. If the legacy file exists and the bucket is still empty
+// load is called to import it, after which the file is renamed so the import
+// only ever happens once.
+func (d *DB) Migrate(bucket string, legacyFilename string, load func(filename string) error) error {
+	if legacyFilename == "" {
+		return nil
+	}
+	if _, err := os.Stat(legacyFilename); os.IsNotExist(err) {
+		return nil
+	}
+
+	empty, err := d.IsEmpty(bucket)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		log.Printf("Not importing %s, the %s bucket already has data\n", legacyFilename, bucket)
+		return nil
+	}
+
+	log.Printf("Importing %s into the %s bucket\n", legacyFilename, bucket)
+	if err = load(legacyFilename); err != nil {
+		return fmt.Errorf("failed to import %s. Err: %v", legacyFilename, err)
+	}
+
+	return os.Rename(legacyFilename, legacyFilename+".migrated")
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutGet(t *testing.T) {
+	database := OpenTemp(t)
+
+	value, err := database.Get("foo", "missing")
+	if err != nil || value != nil {
+		t.Errorf("Get on a missing bucket should give nil, nil. Got %v, %v\n", value, err)
+	}
+
+	if err = database.Put("foo", "bar", []byte("baz")); err != nil {
+		t.Errorf("Failed to put. Err: %v\n", err)
+		return
+	}
+	value, _ = database.Get("foo", "bar")
+	if string(value) != "baz" {
+		t.Errorf("Value changed after put and get. e: %s, a: %s\n", "baz", value)
+	}
+
+	database.Delete("foo", "bar")
+	value, _ = database.Get("foo", "bar")
+	if value != nil {
+		t.Errorf("Value still there after delete: %s\n", value)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	database := OpenTemp(t)
+	database.Put("foo", "old", []byte("1"))
+
+	err := database.Replace("foo", map[string][]byte{"b": []byte("2"), "a": []byte("1")})
+	if err != nil {
+		t.Errorf("Failed to replace. Err: %v\n", err)
+		return
+	}
+
+	keys := []string{}
+	database.ForEach("foo", func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("Bucket didn't contain exactly the replaced keys in order: %v\n", keys)
+	}
+}
+
+func TestSync(t *testing.T) {
+	database := OpenTemp(t)
+	database.Put("foo", "old", []byte("1"))
+	database.Put("foo", "same", []byte("2"))
+	database.Put("foo", "changed", []byte("3"))
+
+	err := database.Sync("foo", map[string][]byte{"same": []byte("2"), "changed": []byte("4"), "new": []byte("5")})
+	if err != nil {
+		t.Errorf("Failed to sync. Err: %v\n", err)
+		return
+	}
+
+	found := make(map[string]string)
+	database.ForEach("foo", func(key string, value []byte) error {
+		found[key] = string(value)
+		return nil
+	})
+	if len(found) != 3 || found["same"] != "2" || found["changed"] != "4" || found["new"] != "5" {
+		t.Errorf("Bucket didn't contain exactly the synced entries: %v\n", found)
+	}
+}
+
+func TestForEachBefore(t *testing.T) {
+	database := OpenTemp(t)
+	for _, key := range []string{"b", "d", "f", "h"} {
+		database.Put("foo", key, []byte(key))
+	}
+
+	walk := func(from string, stopAt string) string {
+		walked := ""
+		database.ForEachBefore("foo", from, func(key string, value []byte) (bool, error) {
+			walked += key
+			return key != stopAt, nil
+		})
+		return walked
+	}
+
+	testTable := []struct {
+		from     string
+		stopAt   string
+		expected string
+	}{
+		{"", "", "hfdb"},
+		{"f", "", "fdb"},
+		{"e", "", "db"},
+		{"z", "", "hfdb"},
+		{"a", "", ""},
+		{"", "f", "hf"},
+	}
+	for _, test := range testTable {
+		if actual := walk(test.from, test.stopAt); actual != test.expected {
+			t.Errorf("Walking back from %q gave the wrong keys: E: %s, A: %s\n", test.from, test.expected, actual)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	database := OpenTemp(t)
+	legacyFile := filepath.Join(t.TempDir(), "legacy.db")
+	ioutil.WriteFile(legacyFile, []byte("data"), 0660)
+
+	loads := 0
+	load := func(filename string) error {
+		loads++
+		return database.Put("foo", "imported", []byte("yes"))
+	}
+
+	if err := database.Migrate("foo", legacyFile, load); err != nil {
+		t.Errorf("Failed to migrate. Err: %v\n", err)
+		return
+	}
+	if _, err := os.Stat(legacyFile); !os.IsNotExist(err) {
+		t.Errorf("Legacy file should have been moved aside after migrating\n")
+	}
+
+	// Put the file back, the bucket has data now so it shouldn't be imported again
+	ioutil.WriteFile(legacyFile, []byte("data"), 0660)
+	database.Migrate("foo", legacyFile, load)
+	if loads != 1 {
+		t.Errorf("Legacy file should be loaded exactly once, was loaded %d times\n", loads)
+	}
+}
@@ -0,0 +1,18 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// OpenTemp opens a database in a temporary directory that is removed, along
+// with the database, once the test finishes. Meant for tests that need a
+// database to hand to the component they're testing.
+func OpenTemp(t testing.TB) *DB {
+	database, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database. Err: %v\n", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
@@ -0,0 +1,108 @@
+// Package events lets the components of the server announce what they're
+// doing, eg songs starting or downloads failing, to anyone who wants to
+// follow along. Subscribers that fall behind miss events rather than holding
+// up playback, except for those that subscribed reliably, which publishing
+// waits for.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of event that get published
+const (
+	SongStart        = "song-start"
+	SongEnd          = "song-end"
+	Skip             = "skip"
+	Enqueue          = "enqueue"
+	DownloadProgress = "download-progress"
+	DownloadFailure  = "download-failure"
+	ListenerCount    = "listener-count"
+	ModeChange       = "mode-change"
+)
+
+// How many events a subscriber can have waiting before it starts missing them
+const subscriberBuffer = 64
+
+// Event is something that happened. Data depends on the type and is meant
+// to be marshalled to JSON.
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// subscription is what a subscriber wants to be sent
+type subscription struct {
+	types    map[string]bool // nil for every type
+	reliable bool            // wait for the subscriber instead of dropping events
+}
+
+var subscribers = make(map[chan Event]subscription)
+var subscribersLock = sync.RWMutex{}
+
+// Publish sends the event to every current subscriber
+func Publish(eventType string, data interface{}) {
+	event := Event{Type: eventType, Time: time.Now(), Data: data}
+
+	subscribersLock.RLock()
+	defer subscribersLock.RUnlock()
+	for subscriber, sub := range subscribers {
+		if sub.types != nil && !sub.types[eventType] {
+			continue
+		}
+		if sub.reliable {
+			subscriber <- event
+			continue
+		}
+		select {
+		case subscriber <- event:
+		default:
+			// Subscriber is behind, they'll have to do without
+		}
+	}
+}
+
+// Subscribe gives a channel that will receive every event published from
+// now on. Call unsubscribe once done so the channel can be cleaned up.
+func Subscribe() (feed <-chan Event, unsubscribe func()) {
+	return subscribe(subscription{})
+}
+
+// SubscribeReliable gives a channel that will receive every event of the
+// provided types published from now on, for subscribers that can't afford to
+// miss any. Once its buffer is full publishing waits for the subscriber, so it
+// should keep reading until it unsubscribes.
+func SubscribeReliable(eventTypes ...string) (feed <-chan Event, unsubscribe func()) {
+	sub := subscription{types: make(map[string]bool), reliable: true}
+	for _, eventType := range eventTypes {
+		sub.types[eventType] = true
+	}
+	return subscribe(sub)
+}
+
+func subscribe(sub subscription) (feed <-chan Event, unsubscribe func()) {
+	subscriber := make(chan Event, subscriberBuffer)
+
+	subscribersLock.Lock()
+	subscribers[subscriber] = sub
+	subscribersLock.Unlock()
+
+	once := sync.Once{}
+	return subscriber, func() {
+		once.Do(func() {
+			if sub.reliable {
+				// Publish may be waiting on us while holding the lock
+				go func() {
+					for range subscriber {
+					}
+				}()
+			}
+			subscribersLock.Lock()
+			delete(subscribers, subscriber)
+			subscribersLock.Unlock()
+			close(subscriber)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package events
+
+import "testing"
+
+func TestPublishSubscribe(t *testing.T) {
+	feed, unsubscribe := Subscribe()
+	Publish(Skip, "foo")
+
+	event := <-feed
+	if event.Type != Skip || event.Data != "foo" {
+		t.Errorf("Received the wrong event: %+v\n", event)
+	}
+
+	unsubscribe()
+	unsubscribe() // Should be safe to call twice
+	Publish(Skip, "bar")
+	if _, open := <-feed; open {
+		t.Errorf("Feed should be closed after unsubscribing\n")
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	feed, unsubscribe := Subscribe()
+	defer unsubscribe()
+
+	// Publishing to a full subscriber shouldn't block
+	for idx := 0; idx < subscriberBuffer*2; idx++ {
+		Publish(Enqueue, idx)
+	}
+	if len(feed) != subscriberBuffer {
+		t.Errorf("Subscriber should have a full buffer, has %d events\n", len(feed))
+	}
+}
+
+func TestReliableSubscriber(t *testing.T) {
+	feed, unsubscribe := SubscribeReliable(SongEnd)
+
+	// Publishing waits for the subscriber instead of dropping events, and
+	// types they didn't ask for aren't sent
+	published := make(chan bool)
+	go func() {
+		for idx := 0; idx < subscriberBuffer*2; idx++ {
+			Publish(DownloadProgress, idx)
+			Publish(SongEnd, idx)
+		}
+		published <- true
+	}()
+	for idx := 0; idx < subscriberBuffer*2; idx++ {
+		event := <-feed
+		if event.Type != SongEnd || event.Data != idx {
+			t.Errorf("Received the wrong event: %+v\n", event)
+			break
+		}
+	}
+	<-published
+
+	// Unsubscribing while publishing is waiting on us shouldn't hang
+	for idx := 0; idx < subscriberBuffer+1; idx++ {
+		go Publish(SongEnd, idx)
+	}
+	unsubscribe()
+}
@@ -4,12 +4,13 @@ go 1.16
 
 require (
 	github.com/djherbis/buffer v1.1.0 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/ipfs/go-ipfs-api v0.2.0 // indirect
+	github.com/gorilla/mux v1.8.0
+	github.com/ipfs/go-ipfs-api v0.2.0
 	github.com/ipfs/go-ipfs-files v0.0.8 // indirect
 	github.com/kkdai/youtube v1.2.4 // indirect
 	github.com/kkdai/youtube/v2 v2.7.3 // indirect
 	github.com/multiformats/go-multihash v0.0.14 // indirect
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
 	gopkg.in/djherbis/buffer.v1 v1.1.0 // indirect
 	gopkg.in/djherbis/nio.v2 v2.0.3 // indirect
@@ -0,0 +1,151 @@
+// Package history keeps a permanent log of every song that has played on the
+// stream, so you can look back and find out what that song at 3pm was.
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/db"
+	"github.com/VivaLaPanda/uta-stream/events"
+	"github.com/VivaLaPanda/uta-stream/mixer"
+)
+
+// Entry is a single play of a song
+type Entry struct {
+	ResourceID string     `json:"resourceId"`
+	Title      string     `json:"title"`
+	Start      time.Time  `json:"start"`
+	End        *time.Time `json:"end,omitempty"` // nil while the song is still playing
+	Skipped    bool       `json:"skipped"`
+	FromAuto   bool       `json:"fromAuto"`
+	QueuedBy   string     `json:"queuedBy,omitempty"`
+}
+
+// writeBuffer is how many plays can be waiting on the database before the
+// history starts holding up the events feed. Songs start and end minutes
+// apart, so it only fills if the database has stopped responding.
+const writeBuffer = 1024
+
+// History records plays into the database as the mixer reports them
+type History struct {
+	db *db.DB
+}
+
+// NewHistory will return a History that starts recording right away. Plays
+// are picked up from the song-start and song-end events, subscribed to
+// reliably so none are missed. They're handed off to a separate writer so a
+// slow write never holds up whoever published the event.
+func NewHistory(database *db.DB) *History {
+	h := &History{db: database}
+
+	feed, _ := events.SubscribeReliable(events.SongStart, events.SongEnd)
+	writes := make(chan events.Event, writeBuffer)
+	go func() {
+		for event := range feed {
+			writes <- event
+		}
+		close(writes)
+	}()
+	go func() {
+		for event := range writes {
+			songEvent, ok := event.Data.(mixer.SongEvent)
+			if !ok {
+				continue
+			}
+			switch event.Type {
+			case events.SongStart:
+				h.record(songEvent, nil)
+			case events.SongEnd:
+				h.record(songEvent, &event.Time)
+			}
+		}
+	}()
+
+	return h
+}
+
+// entryKey gives the key a play is stored under. Hex nanoseconds sort the
+// same way the times do, so the bucket is kept in the order songs played.
+func entryKey(start time.Time) string {
+	return fmt.Sprintf("%016x", start.UnixNano())
+}
+
+// record writes out the play, replacing what was written when it started if
+// it has now ended
+func (h *History) record(songEvent mixer.SongEvent, end *time.Time) error {
+	entry := Entry{
+		ResourceID: songEvent.Song.ResourceID(),
+		Title:      songEvent.Song.Title,
+		Start:      songEvent.Started,
+		End:        end,
+		Skipped:    end != nil && songEvent.Skipped,
+		FromAuto:   songEvent.FromAuto,
+		QueuedBy:   songEvent.Song.QueuedBy,
+	}
+
+	entryData, err := json.Marshal(entry)
+	if err == nil {
+		err = h.db.Put(db.HistoryBucket, entryKey(entry.Start), entryData)
+	}
+	if err != nil {
+		log.Printf("Failed to record %s in the history. Err: %v\n", entry.Title, err)
+	}
+
+	return err
+}
+
+// Query finds the plays that overlap the time range, newest first. A zero
+// from or to leaves that end of the range open. offset and limit page
+// through the results, total is how many matched in all.
+func (h *History) Query(from time.Time, to time.Time, offset int, limit int) (entries []Entry, total int, err error) {
+	fromKey, toKey := "", ""
+	if !from.IsZero() {
+		fromKey = entryKey(from)
+	}
+	if !to.IsZero() {
+		toKey = entryKey(to)
+	}
+
+	// Keys are in the order songs played, so walk back from the end of the
+	// range and only decode the plays on the page being asked for
+	entries = []Entry{}
+	err = h.db.ForEachBefore(db.HistoryBucket, toKey, func(key string, value []byte) (bool, error) {
+		onPage := total >= offset && (limit <= 0 || total < offset+limit)
+		if key >= fromKey && !onPage {
+			total++
+			return true, nil
+		}
+
+		entry := Entry{}
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return false, err
+		}
+		if key < fromKey {
+			// Started before the range, it only counts if it was still playing.
+			// Songs play one after another, so once one ended before the range
+			// so did everything older. Songs that never got an end (still
+			// playing, or we crashed) only count from when they started.
+			end := entry.Start
+			if entry.End != nil {
+				end = *entry.End
+			}
+			if end.Before(from) {
+				return false, nil
+			}
+		}
+
+		total++
+		if onPage {
+			entries = append(entries, entry)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read history. Err: %v", err)
+	}
+
+	return entries, total, nil
+}
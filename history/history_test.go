@@ -0,0 +1,61 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/db"
+	"github.com/VivaLaPanda/uta-stream/mixer"
+	"github.com/VivaLaPanda/uta-stream/resource"
+)
+
+// play records a song that played for a minute from start
+func play(h *History, title string, start time.Time, skipped bool) {
+	song, _ := resource.NewSong("https://example.com/" + title + ".mp3")
+	song.Title = title
+	songEvent := mixer.SongEvent{Song: song, Started: start, Skipped: skipped}
+	h.record(songEvent, nil)
+	end := start.Add(time.Minute)
+	h.record(songEvent, &end)
+}
+
+func TestRecord(t *testing.T) {
+	h := &History{db: db.OpenTemp(t)}
+	start := time.Date(2020, 1, 1, 15, 0, 0, 0, time.UTC)
+	play(h, "a", start, true)
+
+	entries, total, err := h.Query(time.Time{}, time.Time{}, 0, 0)
+	if err != nil || total != 1 {
+		t.Errorf("Expected the one play to be recorded once. Total: %d, Err: %v\n", total, err)
+		return
+	}
+	entry := entries[0]
+	if entry.Title != "a" || !entry.Start.Equal(start) || entry.End == nil || !entry.Skipped {
+		t.Errorf("Play wasn't recorded correctly: %+v\n", entry)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	h := &History{db: db.OpenTemp(t)}
+	start := time.Date(2020, 1, 1, 14, 58, 0, 0, time.UTC)
+	for idx, title := range []string{"a", "b", "c", "d", "e"} {
+		play(h, title, start.Add(time.Duration(idx)*time.Minute), false)
+	}
+
+	// b played from 14:59 to 15:00, so it overlaps 3pm along with c
+	threePm := time.Date(2020, 1, 1, 15, 0, 0, 0, time.UTC)
+	entries, total, _ := h.Query(threePm, threePm, 0, 0)
+	if total != 2 || entries[0].Title != "c" || entries[1].Title != "b" {
+		t.Errorf("Expected c then b to be playing at 3pm. Got: %+v\n", entries)
+	}
+
+	entries, total, _ = h.Query(time.Time{}, time.Time{}, 1, 2)
+	if total != 5 || len(entries) != 2 || entries[0].Title != "d" || entries[1].Title != "c" {
+		t.Errorf("Paging gave the wrong entries. Total: %d, entries: %+v\n", total, entries)
+	}
+
+	entries, _, _ = h.Query(time.Time{}, time.Time{}, 10, 2)
+	if len(entries) != 0 {
+		t.Errorf("Paging past the end should give nothing. Got: %+v\n", entries)
+	}
+}
@@ -2,39 +2,165 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/VivaLaPanda/uta-stream/api"
+	"github.com/VivaLaPanda/uta-stream/db"
+	"github.com/VivaLaPanda/uta-stream/history"
 	"github.com/VivaLaPanda/uta-stream/mixer"
 	"github.com/VivaLaPanda/uta-stream/queue"
 	"github.com/VivaLaPanda/uta-stream/queue/auto"
 	"github.com/VivaLaPanda/uta-stream/resource/cache"
+	"github.com/VivaLaPanda/uta-stream/resource/download"
+	"github.com/VivaLaPanda/uta-stream/resource/library"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
 	"github.com/VivaLaPanda/uta-stream/stream"
 )
 
 // Various runtime flags
-var autoqFilename = flag.String("autoqFilename", "autoq.db", "Where to store autoq database")
-var cacheFilename = flag.String("cacheFilename", "cache.db", "Where to store cache database")
+var dbFilename = flag.String("dbFilename", "uta.db", "Where to store the database")
+var autoqFilename = flag.String("autoqFilename", "autoq.db", "Old autoq file to import into the database, if present")
+var cacheFilename = flag.String("cacheFilename", "cache.db", "Old cache file to import into the database, if present")
 var authCfgFilename = flag.String("authCfgFilename", "auth.json", "Where to find auth config json")
+var storageBackend = flag.String("storage", "ipfs", "Where to keep song audio, either ipfs or local")
 var ipfsUrl = flag.String("ipfsUrl", "localhost:5001", "The url of the local IPFS instance")
-var enableAutoq = flag.Bool("enableAutoq", true, "Whether to use autoq feature")
+var blobDir = flag.String("blobDir", "blobs", "Where to keep song audio when using local storage")
+var enableAutoq = flag.Bool("enableAutoq", true, "Whether to use autoq feature, only used when no mode is given")
+var stationMode = flag.String("mode", "", "Who picks the music: dj, community or hybrid (community plus autoq)")
 var recentLength = flag.Int("recentLength", 3, "Don't autoq a song that was in the last N played songs")
 var chainbreakProb = flag.Float64("chainbreakProb", .05, "Allows more random autoq")
-var bitrate = flag.Int("bitrate", 160, "Affects stream smoothness/synchro")
+var autoqLookahead = flag.Int("autoqLookahead", 3, "How many autoq picks to plan ahead of time and show as upcoming")
+var bitrate = flag.Int("bitrate", 160, "Affects stream smoothness/synchro, only used when no mounts are given")
+var mountSpec = flag.String("mounts", "", "Comma separated streams to serve as path:codec:bitrate, eg /stream.mp3:mp3:160,/stream.ogg:opus:96")
+var crossfade = flag.Duration("crossfade", 4*time.Second, "How long songs overlap when transitioning, 0 to disable")
+var crossfadeCurve = flag.String("crossfadeCurve", "equalpower", "Volume curve for crossfades, linear or equalpower")
 var autoQPrefixLen = flag.Int("autoQPrefixLen", 1, "Smaller = more random") // Large values will be random if the history is short
 var apiPort = flag.Int("apiPort", 8085, "Which port to serve the API on")
 var audioPort = flag.Int("audioPort", 9090, "Which port to serve the audio stream on")
+var enableHLS = flag.Bool("hls", true, "Whether to also serve mp3 mounts as HLS playlists")
+var hlsSegment = flag.Duration("hlsSegment", 6*time.Second, "Roughly how long each HLS segment is")
+var hlsWindow = flag.Int("hlsWindow", 5, "How many segments are listed in the HLS playlist at once")
+var maxQueuedPerUser = flag.Int("maxQueuedPerUser", 0, "How many songs one user can have in the queue, 0 for no limit")
+var enqueuesPerHour = flag.Int("enqueuesPerHour", 0, "How many songs one user can queue an hour, 0 for no limit")
+var skipCooldown = flag.Duration("skipCooldown", 0, "How long a user has to wait between skips, 0 for no limit")
+var libraryDirs = flag.String("libraryDirs", "", "Comma separated directories of audio files to import into the library")
+var libraryScanInterval = flag.Duration("libraryScanInterval", 5*time.Minute, "How often to check the library directories for changes")
+var playlistCap = flag.Int("playlistCap", 50, "Most songs one playlist can add to the queue, 0 for no limit")
+var uploadMaxMB = flag.Int("uploadMaxMB", 50, "Largest audio file that can be uploaded in MB, 0 for no limit")
+var uploadFormats = flag.String("uploadFormats", "mp3,flac,ogg,opus,m4a,wav", "Comma separated file extensions that can be uploaded")
+var voteSkipFraction = flag.Float64("voteSkipFraction", 0.5, "Vote-skip once more than this fraction of listeners vote, 0 to turn off")
+var voteSkipVotes = flag.Int("voteSkipVotes", 0, "Vote-skip once this many votes are in, 0 to turn off")
+var voteSkipMinVotes = flag.Int("voteSkipMinVotes", 2, "Votes it takes to skip when no listeners are counted")
+var stationName = flag.String("stationName", "UtaStream", "Station name shown by radio players")
+var ytDlpHosts = flag.String("ytDlpHosts", "soundcloud.com,bandcamp.com,vimeo.com", "Comma separated sites besides YouTube to download through yt-dlp, subdomains included")
 
 func main() {
 	flag.Parse()
 
-	c := cache.NewCache(*cacheFilename, *ipfsUrl)
-	a := auto.NewAQEngine(*autoqFilename, c, *chainbreakProb, *autoQPrefixLen, *recentLength)
-	q := queue.NewQueue(a, c, *enableAutoq, *ipfsUrl)
-	e := mixer.NewMixer(q, *bitrate)
+	var store storage.BlobStore
+	switch *storageBackend {
+	case "ipfs":
+		store = storage.NewIpfsStore(*ipfsUrl)
+	case "local":
+		localStore, err := storage.NewLocalStore(*blobDir)
+		if err != nil {
+			log.Fatalf("Failed to set up local storage. Err: %v\n", err)
+		}
+		store = localStore
+	default:
+		log.Fatalf("Unknown storage backend %s, should be ipfs or local\n", *storageBackend)
+	}
+
+	download.SetYtDlpHosts(splitList(*ytDlpHosts))
+	download.SetUploadFormats(splitList(*uploadFormats))
+
+	database, err := db.Open(*dbFilename)
+	if err != nil {
+		log.Fatalf("Failed to open database. Err: %v\n", err)
+	}
+	defer database.Close()
+
+	c := cache.NewCache(database, *cacheFilename, store)
+	var lib *library.Library
+	if dirs := splitList(*libraryDirs); len(dirs) > 0 {
+		if lib, err = library.NewLibrary(database, dirs, c, store); err != nil {
+			log.Fatalf("Failed to set up the library. Err: %v\n", err)
+		}
+		go lib.Watch(*libraryScanInterval)
+	}
+	a := auto.NewAQEngine(database, *autoqFilename, c, *chainbreakProb, *autoQPrefixLen, *recentLength)
+	if *stationMode == "" {
+		*stationMode = string(queue.CommunityMode)
+		if *enableAutoq {
+			*stationMode = string(queue.HybridMode)
+		}
+	}
+	mode, err := queue.ParseMode(*stationMode)
+	if err != nil {
+		log.Fatalf("Failed to set up queue. Err: %v\n", err)
+	}
+	q := queue.NewQueue(database, a, c, mode, *autoqLookahead, store)
+	curve, err := mixer.CurveByName(*crossfadeCurve)
+	if err != nil {
+		log.Fatalf("Failed to set up mixer. Err: %v\n", err)
+	}
+
+	if *mountSpec == "" {
+		*mountSpec = fmt.Sprintf("/stream.mp3:mp3:%d", *bitrate)
+	}
+	mounts, err := stream.ParseMounts(*mountSpec)
+	if err != nil {
+		log.Fatalf("Failed to set up mounts. Err: %v\n", err)
+	}
+	encodings := make([]mixer.Encoding, len(mounts))
+	for idx, mount := range mounts {
+		encodings[idx] = mixer.Encoding{Codec: mount.Codec, Bitrate: mount.Bitrate}
+		if *enableHLS && mount.Codec == "mp3" {
+			if err = mount.EnableHLS(*hlsSegment, *hlsWindow); err != nil {
+				log.Fatalf("Failed to set up HLS. Err: %v\n", err)
+			}
+		}
+	}
+	// Start recording before the mixer so the first song isn't missed
+	h := history.NewHistory(database)
+	e := mixer.NewMixer(q, encodings, *crossfade, curve)
 
 	go func() {
-		stream.ServeAudioOverHttp(e.Output, *audioPort)
+		nowPlaying := func() string {
+			song := e.CurrentSongInfo
+			if song == nil {
+				return ""
+			}
+			return song.Name()
+		}
+		stream.ServeAudioOverHttp(mounts, e.Outputs, *audioPort, *stationName, nowPlaying)
 	}()
 
-	api.ServeApi(e, c, q, stream.ListenerCount, *apiPort, *authCfgFilename)
+	limits := api.Limits{
+		MaxQueued:       *maxQueuedPerUser,
+		EnqueuesPerHour: *enqueuesPerHour,
+		SkipCooldown:    *skipCooldown,
+		PlaylistCap:     *playlistCap,
+		UploadSize:      int64(*uploadMaxMB) << 20,
+	}
+	voteSkip := api.VoteSkip{
+		Fraction: *voteSkipFraction,
+		Votes:    *voteSkipVotes,
+		MinVotes: *voteSkipMinVotes,
+	}
+	api.ServeApi(e, c, q, a, h, lib, database, limits, voteSkip, mounts.ListenerCounts, *apiPort, *authCfgFilename)
+}
+
+// splitList splits a comma separated flag, dropping empty items
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
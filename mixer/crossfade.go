@@ -0,0 +1,201 @@
+package mixer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/mp3"
+)
+
+// Samples quieter than this (about -50dB) count as silence when trimming
+const silenceThreshold = 100
+
+// Silence longer than this at the end of a song is assumed to be on purpose
+// (hidden tracks and the like) and is played instead of trimmed
+const maxTrimmedSilence = 30 * time.Second
+
+// Curve gives the gains for the outgoing and incoming songs given how far
+// through the crossfade we are, from 0 to 1
+type Curve func(progress float64) (outGain float64, inGain float64)
+
+var curves = map[string]Curve{
+	"linear": func(progress float64) (float64, float64) {
+		return 1 - progress, progress
+	},
+	// Keeps the total power constant, so there's no dip in the middle of the fade
+	"equalpower": func(progress float64) (float64, float64) {
+		return math.Cos(progress * math.Pi / 2), math.Sin(progress * math.Pi / 2)
+	},
+}
+
+// CurveByName returns one of the known crossfade curves, linear or equalpower
+func CurveByName(name string) (Curve, error) {
+	curve, exists := curves[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown crossfade curve %s, should be linear or equalpower", name)
+	}
+	return curve, nil
+}
+
+// pcmBytes converts a duration into a whole number of PCM frames worth of bytes
+func pcmBytes(d time.Duration) int {
+	return int(d.Seconds()*mp3.SampleRate) * mp3.FrameSize
+}
+
+func sample(pcm []byte, idx int) int16 {
+	return int16(binary.LittleEndian.Uint16(pcm[idx:]))
+}
+
+// isSilentFrame reports whether every sample in the frame starting at idx is
+// below the silence threshold
+func isSilentFrame(pcm []byte, idx int) bool {
+	for i := idx; i < idx+mp3.FrameSize; i += mp3.SampleSize {
+		s := sample(pcm, i)
+		if s > silenceThreshold || s < -silenceThreshold {
+			return false
+		}
+	}
+	return true
+}
+
+// mixInto fades tail out and head in, writing the result over head. offset
+// is how far into the fade (in bytes) head[0] sits and total is the length
+// of the whole fade.
+func mixInto(head []byte, tail []byte, offset int, total int, curve Curve) {
+	totalFrames := float64(total / mp3.FrameSize)
+	for i := 0; i+mp3.SampleSize <= len(head) && i+mp3.SampleSize <= len(tail); i += mp3.SampleSize {
+		progress := float64((offset+i)/mp3.FrameSize) / totalFrames
+		outGain, inGain := curve(progress)
+
+		mixed := float64(sample(tail, i))*outGain + float64(sample(head, i))*inGain
+		mixed = math.Max(math.MinInt16, math.Min(math.MaxInt16, mixed))
+		binary.LittleEndian.PutUint16(head[i:], uint16(int16(mixed)))
+	}
+}
+
+// fader streams the PCM of one song at a time into out. It drops the silence
+// at either end of each song, and holds back the end of each song so that it
+// can be mixed over the start of the next one.
+type fader struct {
+	out       io.Writer
+	curve     Curve
+	fadeBytes int
+	hold      func() error // called before every write, may block to hold playback
+
+	tail  []byte // end of the previous song, waiting to be mixed into the next
+	mixed int    // how much of the tail has been mixed in so far
+}
+
+func newFader(out io.Writer, duration time.Duration, curve Curve, hold func() error) *fader {
+	return &fader{
+		out:       out,
+		curve:     curve,
+		fadeBytes: pcmBytes(duration),
+		hold:      hold,
+	}
+}
+
+// play streams the song's PCM until it runs out, mixing its start with the
+// tail of the last song and keeping back its own end as the new tail.
+func (f *fader) play(pcm io.Reader) error {
+	chunk := make([]byte, 4096*mp3.FrameSize)
+	pending := make([]byte, 0, f.fadeBytes+len(chunk))
+	leading := true
+	silentRun := 0
+	maxSilence := pcmBytes(maxTrimmedSilence)
+
+	var err error
+	for err == nil {
+		var n int
+		n, err = io.ReadFull(pcm, chunk)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		data := chunk[:n-n%mp3.FrameSize]
+
+		// Skip any silence the song starts with
+		if leading {
+			idx := 0
+			for idx < len(data) && isSilentFrame(data, idx) {
+				idx += mp3.FrameSize
+			}
+			data = data[idx:]
+			leading = len(data) == 0
+		}
+
+		// Keep track of how much silence the song currently ends with
+		for idx := 0; idx < len(data); idx += mp3.FrameSize {
+			if isSilentFrame(data, idx) {
+				silentRun += mp3.FrameSize
+			} else {
+				silentRun = 0
+			}
+		}
+		pending = append(pending, data...)
+
+		// Hold back enough for the fade, plus any trailing silence
+		held := f.fadeBytes
+		if silentRun <= maxSilence {
+			held += silentRun
+		}
+		if len(pending) > held {
+			if werr := f.write(pending[:len(pending)-held]); werr != nil {
+				return werr
+			}
+			pending = append(pending[:0], pending[len(pending)-held:]...)
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	// Drop the silence off the end, what's left over becomes the next tail
+	if silentRun <= maxSilence {
+		pending = pending[:len(pending)-silentRun]
+	}
+	if len(pending) > f.fadeBytes {
+		if werr := f.write(pending[:len(pending)-f.fadeBytes]); werr != nil {
+			return werr
+		}
+		pending = pending[len(pending)-f.fadeBytes:]
+	}
+	// Anything of the old tail the song was too short to cover fades out on its own
+	if err = f.flush(); err != nil {
+		return err
+	}
+	f.tail = append([]byte{}, pending...)
+	f.mixed = 0
+
+	return nil
+}
+
+// flush fades out whatever is left of the tail into silence
+func (f *fader) flush() error {
+	if f.mixed >= len(f.tail) {
+		return nil
+	}
+	err := f.write(make([]byte, len(f.tail)-f.mixed))
+	f.tail = nil
+	f.mixed = 0
+
+	return err
+}
+
+// write sends PCM to the output, mixing it with the tail if there is still
+// some of it left
+func (f *fader) write(data []byte) error {
+	if err := f.hold(); err != nil {
+		return err
+	}
+	if f.mixed < len(f.tail) {
+		data = append([]byte{}, data...)
+		mixInto(data, f.tail[f.mixed:], f.mixed, len(f.tail), f.curve)
+		f.mixed += len(data)
+	}
+	_, err := f.out.Write(data)
+
+	return err
+}
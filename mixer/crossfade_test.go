@@ -0,0 +1,110 @@
+package mixer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/mp3"
+)
+
+func noHold() error {
+	return nil
+}
+
+// pcmOf makes frames of stereo PCM with every sample set to value
+func pcmOf(frames int, value int16) []byte {
+	pcm := make([]byte, frames*mp3.FrameSize)
+	for i := 0; i < len(pcm); i += mp3.SampleSize {
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(value))
+	}
+	return pcm
+}
+
+func TestCurveByName(t *testing.T) {
+	for _, name := range []string{"linear", "equalpower"} {
+		curve, err := CurveByName(name)
+		if err != nil {
+			t.Errorf("Curve %s should exist. Err: %v\n", name, err)
+			continue
+		}
+		out, in := curve(0)
+		if out != 1 || in != 0 {
+			t.Errorf("Curve %s should start on the outgoing song. out: %v, in: %v\n", name, out, in)
+		}
+	}
+
+	if _, err := CurveByName("foo"); err == nil {
+		t.Errorf("Unknown curve should give an error\n")
+	}
+}
+
+func TestFaderTrimsSilence(t *testing.T) {
+	out := &bytes.Buffer{}
+	curve, _ := CurveByName("linear")
+	f := newFader(out, 0, curve, noHold)
+
+	song := append(pcmOf(100, 0), pcmOf(50, 1000)...)
+	song = append(song, pcmOf(100, 0)...)
+	if err := f.play(bytes.NewReader(song)); err != nil {
+		t.Errorf("Failed to play song. Err: %v\n", err)
+		return
+	}
+
+	if !bytes.Equal(out.Bytes(), pcmOf(50, 1000)) {
+		t.Errorf("Silence wasn't trimmed. Expected %d bytes of audio, got %d\n", 50*mp3.FrameSize, out.Len())
+	}
+}
+
+func TestFaderCrossfades(t *testing.T) {
+	out := &bytes.Buffer{}
+	curve, _ := CurveByName("linear")
+	fade := time.Second
+	fadeFrames := pcmBytes(fade) / mp3.FrameSize
+	f := newFader(out, fade, curve, noHold)
+
+	songA := pcmOf(fadeFrames*3, 1000)
+	songB := pcmOf(fadeFrames*3, -1000)
+	f.play(bytes.NewReader(songA))
+	f.play(bytes.NewReader(songB))
+	f.flush()
+
+	// The fade overlaps the songs, so we should be one fade short of both songs back to back
+	expectedLen := len(songA) + len(songB) - pcmBytes(fade)
+	if out.Len() != expectedLen {
+		t.Errorf("Crossfaded output was the wrong length. e: %d, a: %d\n", expectedLen, out.Len())
+		return
+	}
+
+	// Start of the fade is all song A, the middle is an even mix, the end is all song B
+	fadeStart := len(songA) - pcmBytes(fade)
+	if s := sample(out.Bytes(), fadeStart); s != 1000 {
+		t.Errorf("Fade should start on song A. Sample: %d\n", s)
+	}
+	if s := sample(out.Bytes(), fadeStart+pcmBytes(fade)/2); s > 10 || s < -10 {
+		t.Errorf("Middle of a linear fade between opposite songs should be near 0. Sample: %d\n", s)
+	}
+	// With nothing after it song B fades out on its own
+	if s := sample(out.Bytes(), out.Len()-pcmBytes(fade)-mp3.SampleSize); s != -1000 {
+		t.Errorf("Song B should play unmixed after the fade. Sample: %d\n", s)
+	}
+	if s := sample(out.Bytes(), out.Len()-mp3.SampleSize); s > 10 || s < -10 {
+		t.Errorf("Output should fade out to silence. Sample: %d\n", s)
+	}
+}
+
+func TestFaderHold(t *testing.T) {
+	out := &bytes.Buffer{}
+	curve, _ := CurveByName("linear")
+	holds := 0
+	f := newFader(out, 0, curve, func() error {
+		holds++
+		return nil
+	})
+
+	f.play(bytes.NewReader(pcmOf(100, 1000)))
+	if holds == 0 {
+		t.Errorf("Fader should check whether to hold before writing\n")
+	}
+}
@@ -7,58 +7,83 @@
 package mixer
 
 import (
+	"fmt"
 	"io"
 	"log"
+	"sync/atomic"
 	"time"
 
+	"github.com/VivaLaPanda/uta-stream/events"
 	"github.com/VivaLaPanda/uta-stream/mp3"
 	"github.com/VivaLaPanda/uta-stream/queue"
 	"github.com/VivaLaPanda/uta-stream/resource"
 )
 
+// Encoding is one of the formats the mixer produces its output in
+type Encoding struct {
+	Codec   string // mp3 or opus
+	Bitrate int    // in kbps
+}
+
+// SongEvent is the data published with song-start and song-end events
+type SongEvent struct {
+	Song     *resource.Song `json:"song"`
+	FromAuto bool           `json:"fromAuto"`
+	Started  time.Time      `json:"started"`
+	Skipped  bool           `json:"skipped"` // Only meaningful once the song has ended
+}
+
 // Mixer is a struct which contains the persistent state necessary to talk
 // to the queue and to interact with playback as it happens
 type Mixer struct {
-	Output            chan []byte
-	bitrate           int
+	Outputs           []chan []byte
 	currentSongReader io.ReadCloser
 	queue             *queue.Queue
 	CurrentSongInfo   *resource.Song
-	skipped           bool
-	learnFrom         bool
+	skipped           int32 // set through setFlag, Skip is called from other goroutines
+	learnFrom         int32
+	paused            int32
+	encoderInput      io.Writer
+	fader             *fader
 }
 
 // NewMixer will return a mixer struct. Said struct will have the provided queue
-// attached for internal use. The Output channel is public, and the only way
-// consume the mixer's output. You are also provided the Current song path so you
-// can check what is currently playing.
-// A reasonable default for packetsPerSecond is 2, but it determines whether
-// we send data in larger  or smaller chunks to the clients
-// The mixer object will be tied to a goroutine which will populate the output
-func NewMixer(queue *queue.Queue, bitrate int) *Mixer {
+// attached for internal use. The Outputs channels are public, and the only way
+// consume the mixer's output. There is one per provided encoding, in the same
+// order, all carrying the same audio. You are also provided the Current song
+// path so you can check what is currently playing.
+// Each song overlaps the end of the last one by the crossfade duration, with
+// the volumes following the provided curve. A duration of 0 plays songs back to back.
+// The mixer object will be tied to a goroutine which will populate the outputs
+func NewMixer(queue *queue.Queue, encodings []Encoding, crossfade time.Duration, curve Curve) *Mixer {
 	mixer := &Mixer{
-		Output:            make(chan []byte, 4), // Needs to have space to handle song transition
-		bitrate:           bitrate,
+		Outputs:           make([]chan []byte, len(encodings)),
 		currentSongReader: nil,
 		queue:             queue,
 		CurrentSongInfo:   &resource.Song{},
-		skipped:           false,
-		learnFrom:         false,
 	}
 
-	// Prep to encode the mp3
-	wavInput, mp3Output, _, err := mp3.WavToMp3(mixer.bitrate)
-	if err != nil {
-		log.Printf("Failed to prepare mp3 encoder. Err: %v\n", err)
-		return nil
-	}
+	// Prep the encoders, the mixed PCM is copied to every one of them
+	encoderInputs := make([]io.Writer, len(encodings))
+	for idx, encoding := range encodings {
+		pcmInput, encodedOutput, err := startEncoder(encoding)
+		if err != nil {
+			log.Printf("Failed to prepare %s encoder. Err: %v\n", encoding.Codec, err)
+			return nil
+		}
+		encoderInputs[idx] = pcmInput
 
-	// Take all output from the encoder and put it on the Output channel
-	go func() {
-		done := byteReader(mp3Output, mixer.Output, 500*(bitrate/8))
-		<-done
-		log.Panicf("Encoder stopped producing output\n")
-	}()
+		// Take all output from the encoder and put it on its Output channel
+		output := make(chan []byte, 4) // Needs to have space to handle song transition
+		mixer.Outputs[idx] = output
+		go func(encoding Encoding) {
+			done := byteReader(encodedOutput, output, 500*(encoding.Bitrate/8))
+			<-done
+			log.Panicf("%s encoder at %dk stopped producing output\n", encoding.Codec, encoding.Bitrate)
+		}(encoding)
+	}
+	mixer.encoderInput = io.MultiWriter(encoderInputs...)
+	mixer.fader = newFader(mixer.encoderInput, crossfade, curve, mixer.holdWhilePaused)
 
 	// Take song data and put that into the encoder
 	// also handle song transitions
@@ -67,51 +92,53 @@ func NewMixer(queue *queue.Queue, bitrate int) *Mixer {
 			// Get the next song channel and associated metadata
 			// Start broadcasting right away and set some flags/state values
 			tempSongData, tempSongReader, queueIsEmpty, fromAuto := mixer.fetchNextSong()
-			if tempSongReader == nil {
+			if !queueIsEmpty && tempSongReader == nil {
 				log.Printf("Song to be played doesn't have a valid reader: %s", tempSongData.ResourceID())
 			}
 			if !queueIsEmpty && (tempSongReader != nil) {
 				// We are good to play the song
-				mixer.learnFrom = !fromAuto
+				setFlag(&mixer.learnFrom, !fromAuto)
 				mixer.currentSongReader = tempSongReader
 				mixer.CurrentSongInfo = tempSongData
 
+				started := SongEvent{Song: tempSongData, FromAuto: fromAuto, Started: time.Now()}
+				events.Publish(events.SongStart, started)
+
 				// Take the current song and put it into the encoder
-				_, err = io.Copy(wavInput, mixer.currentSongReader)
+				err := mixer.playCurrentSong()
+				ended := started
+				ended.Skipped = flagSet(&mixer.skipped)
+				// Clear the skip now, even if the song failed, so it can't carry
+				// over and skip the next one
+				setFlag(&mixer.skipped, false)
+				events.Publish(events.SongEnd, ended)
 
 				if err != nil {
-					// If we skipped we'll always get an error, so ignore it
-					if !mixer.skipped {
-						// We can't send data to the encoder for some reason
-						// This usually means ffmpeg is struggling. Let's give it a break
-						log.Printf("Error copying into mixer output: %v\n", err)
-						time.Sleep(10 * time.Second)
-						continue
-					}
+					// We can't send data to the encoder for some reason
+					// This usually means ffmpeg is struggling. Let's give it a break
+					log.Printf("Error copying into mixer output: %v\n", err)
+					time.Sleep(10 * time.Second)
+					continue
 				}
 
-				// Avoid double closes, if we skipped we already closed the reader
-				// Seems like there should be a better way...
-				if !mixer.skipped {
-					// testing without reader close
-					mixer.currentSongReader.Close()
-				}
-				mixer.skipped = false
-
 				// We finished playing the song, record that unless we've decided not to
-				if err != nil && mixer.CurrentSongInfo.IpfsPath() != "" {
-					mixer.queue.NotifyDone(mixer.CurrentSongInfo.IpfsPath(), mixer.learnFrom)
+				if mixer.CurrentSongInfo.IpfsPath() != "" {
+					mixer.queue.NotifyDone(mixer.CurrentSongInfo.IpfsPath(), flagSet(&mixer.learnFrom))
 				}
 
 				// Put a placeholder in the song info in case the next fetch
-				// from the ipfs takes a long time
+				// from the store takes a long time
 				mixer.CurrentSongInfo = &resource.Song{
 					Title:    "Loading Next Song",
 					Duration: 0,
 				}
 
-				mixer.learnFrom = true
+				setFlag(&mixer.learnFrom, true)
 			} else if queueIsEmpty {
+				// Nothing left to fade into, so let the last song finish on its own
+				if err := mixer.fader.flush(); err != nil {
+					log.Printf("Error copying into mixer output: %v\n", err)
+				}
 				// If the queue is empty wait a bit before trying to fetch another song
 				time.Sleep(2 * time.Second)
 			}
@@ -121,6 +148,51 @@ func NewMixer(queue *queue.Queue, bitrate int) *Mixer {
 	return mixer
 }
 
+// startEncoder starts the ffmpeg pipeline that turns PCM into the encoding
+func startEncoder(encoding Encoding) (pcmInput io.WriteCloser, encodedOutput io.ReadCloser, err error) {
+	switch encoding.Codec {
+	case "mp3":
+		pcmInput, encodedOutput, _, err = mp3.PcmToMp3(encoding.Bitrate)
+	case "opus":
+		pcmInput, encodedOutput, _, err = mp3.PcmToOpus(encoding.Bitrate)
+	default:
+		err = fmt.Errorf("unknown codec %s, should be mp3 or opus", encoding.Codec)
+	}
+
+	return pcmInput, encodedOutput, err
+}
+
+// playCurrentSong decodes the current song and feeds it through the fader into
+// the encoder, returning once the song has run out or been skipped
+func (m *Mixer) playCurrentSong() error {
+	decoderInput, pcmOutput, decoded, err := mp3.DecodeToPcm()
+	if err != nil {
+		m.currentSongReader.Close()
+		return err
+	}
+
+	go func() {
+		_, err := io.Copy(decoderInput, m.currentSongReader)
+		// If we skipped we'll always get an error, so ignore it
+		if err != nil && !flagSet(&m.skipped) {
+			log.Printf("Error copying song into decoder: %v\n", err)
+		}
+		decoderInput.Close()
+
+		// Avoid double closes, if we skipped we already closed the reader
+		// Seems like there should be a better way...
+		if !flagSet(&m.skipped) {
+			m.currentSongReader.Close()
+		}
+	}()
+
+	err = m.fader.play(pcmOutput)
+	pcmOutput.Close()
+	decoded.Wait()
+
+	return err
+}
+
 // Skip will force the current song to end, thus triggering an attempt to
 // fetch the next song. Will not result in the autoq being trained
 func (m *Mixer) Skip() {
@@ -131,9 +203,64 @@ func (m *Mixer) Skip() {
 		}
 	}()
 
-	m.skipped = true
-	m.learnFrom = false
+	setFlag(&m.skipped, true)
+	setFlag(&m.learnFrom, false)
 	m.currentSongReader.Close()
+	events.Publish(events.Skip, m.CurrentSongInfo)
+}
+
+// setFlag sets one of the mixer's flags. They're shared between the playback
+// goroutines and the API, so they're only touched atomically.
+func setFlag(flag *int32, value bool) {
+	if value {
+		atomic.StoreInt32(flag, 1)
+	} else {
+		atomic.StoreInt32(flag, 0)
+	}
+}
+
+// flagSet reports whether one of the mixer's flags is set
+func flagSet(flag *int32) bool {
+	return atomic.LoadInt32(flag) == 1
+}
+
+// Pause will hold the current song where it is. Listeners are sent silence
+// until Resume is called so that their players stay connected.
+func (m *Mixer) Pause() {
+	atomic.StoreInt32(&m.paused, 1)
+}
+
+// Resume will carry on playing the current song from where it was paused
+func (m *Mixer) Resume() {
+	atomic.StoreInt32(&m.paused, 0)
+}
+
+// Paused reports whether playback is currently paused
+func (m *Mixer) Paused() bool {
+	return atomic.LoadInt32(&m.paused) == 1
+}
+
+// holdWhilePaused feeds silence to the encoder for as long as we're paused.
+// The song stops being read, so it picks up right where it left off. Skipping
+// lets go of the song, the next one is then held at its start instead.
+func (m *Mixer) holdWhilePaused() error {
+	if !m.Paused() {
+		return nil
+	}
+
+	// Silence goes out at the rate it would be played, the encoder would take
+	// it as fast as we could write it otherwise
+	interval := 100 * time.Millisecond
+	silence := make([]byte, pcmBytes(interval))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for m.Paused() && !flagSet(&m.skipped) {
+		if _, err := m.encoderInput.Write(silence); err != nil {
+			return err
+		}
+		<-ticker.C
+	}
+	return nil
 }
 
 // Will go to queue and get the next track and associated metadata
@@ -0,0 +1,64 @@
+package mixer
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/resource"
+)
+
+// countingWriter counts what's written to it, it can be read while written to
+type countingWriter struct {
+	lock    sync.Mutex
+	written int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.written += len(p)
+	return len(p), nil
+}
+
+func (c *countingWriter) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.written
+}
+
+func TestHoldWhilePaused(t *testing.T) {
+	out := &countingWriter{}
+	m := &Mixer{
+		currentSongReader: ioutil.NopCloser(strings.NewReader("")),
+		CurrentSongInfo:   &resource.Song{},
+		encoderInput:      out,
+	}
+	m.Pause()
+
+	held := make(chan error)
+	go func() {
+		held <- m.holdWhilePaused()
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	// 300ms of silence, give or take a tick
+	if written := out.count(); written > pcmBytes(500*time.Millisecond) {
+		t.Errorf("Silence should be sent in real time, got %d bytes in 300ms\n", written)
+	}
+
+	m.Skip()
+	select {
+	case err := <-held:
+		if err != nil {
+			t.Errorf("Hold returned an error: %v\n", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Skipping should end the hold even while paused\n")
+	}
+	if !m.Paused() {
+		t.Errorf("Skipping shouldn't resume playback\n")
+	}
+}
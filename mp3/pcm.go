@@ -0,0 +1,100 @@
+package mp3
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// The raw PCM format passed between the decoders, the mixer and the encoder.
+// Signed 16 bit little endian samples, interleaved stereo.
+const (
+	SampleRate = 44100
+	Channels   = 2
+	SampleSize = 2
+	FrameSize  = Channels * SampleSize
+)
+
+var pcmArgs = []string{"-f", "s16le", "-ar", strconv.Itoa(SampleRate), "-ac", strconv.Itoa(Channels)}
+
+// DecodeToPcm will provide a reader and a writer that are connected, like an io pipe
+// however, audio in any format ffmpeg understands passed into the writer will be
+// returned as loudness normalized raw PCM from the reader
+// The done waitgroup will be marked as done when the ffmpeg process is done running
+// Requires ffmpeg to be in PATH
+func DecodeToPcm() (input io.WriteCloser, output io.ReadCloser, done *sync.WaitGroup, err error) {
+	args := []string{"-y", "-loglevel", "panic", "-i", "pipe:0", "-filter:a", "loudnorm=I=-16"}
+	args = append(args, pcmArgs...)
+	args = append(args, "pipe:1")
+
+	return runFfmpeg("decoding", args)
+}
+
+// PcmToMp3 will provide a reader and a writer that are connected, like an io pipe
+// however, raw PCM passed into the writer will be returned as mp3 data at the
+// provided bitrate from the reader
+// The done waitgroup will be marked as done when the ffmpeg process is done running
+// Requires ffmpeg to be in PATH
+func PcmToMp3(bitrate int) (input io.WriteCloser, output io.ReadCloser, done *sync.WaitGroup, err error) {
+	bitrateString := fmt.Sprintf("%dk", bitrate)
+
+	args := []string{"-y", "-loglevel", "panic"}
+	args = append(args, pcmArgs...)
+	args = append(args, "-i", "pipe:0", "-b:a", bitrateString, "-f", "mp3", "pipe:1")
+
+	return runFfmpeg("encoding", args)
+}
+
+// PcmToOpus works like PcmToMp3, but the output is Opus in an Ogg container.
+// Opus only runs at 48kHz so the audio is resampled on the way through.
+// Requires ffmpeg built with libopus to be in PATH
+func PcmToOpus(bitrate int) (input io.WriteCloser, output io.ReadCloser, done *sync.WaitGroup, err error) {
+	bitrateString := fmt.Sprintf("%dk", bitrate)
+
+	args := []string{"-y", "-loglevel", "panic"}
+	args = append(args, pcmArgs...)
+	args = append(args, "-i", "pipe:0", "-c:a", "libopus", "-b:a", bitrateString, "-ar", "48000", "-f", "ogg", "pipe:1")
+
+	return runFfmpeg("encoding", args)
+}
+
+// runFfmpeg starts ffmpeg with the provided args and hands back its stdin and
+// stdout. action is only used to make the logs readable.
+func runFfmpeg(action string, args []string) (input io.WriteCloser, output io.ReadCloser, done *sync.WaitGroup, err error) {
+	// Ensure we have ffmpeg
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("ffmpeg was not found in PATH. Please install ffmpeg")
+	}
+
+	subProcess := exec.Command(ffmpeg, args...)
+	input, err = subProcess.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to pipe input into audio converter, err: %v", err)
+	}
+	output, err = subProcess.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to pipe output from audio converter, err: %v", err)
+	}
+	subProcess.Stderr = os.Stderr
+
+	done = &sync.WaitGroup{}
+	done.Add(1)
+	if err = subProcess.Start(); err != nil { //Use start, not run
+		return nil, nil, nil, fmt.Errorf("failed to start conversion, err: %v", err)
+	}
+
+	go func() {
+		err := subProcess.Wait()
+		if err != nil {
+			log.Printf("ffmpeg encountered an error while %s: %v\n", action, err)
+		}
+		done.Done()
+	}()
+
+	return input, output, done, nil
+}
@@ -4,14 +4,17 @@ package auto
 
 import (
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/VivaLaPanda/uta-stream/db"
 	"github.com/VivaLaPanda/uta-stream/resource"
 	"github.com/VivaLaPanda/uta-stream/resource/cache"
 )
@@ -20,79 +23,136 @@ type AQEngine struct {
 	markovChain *chain
 	playedSongs chan string
 	cache       *cache.Cache
+	db          *db.DB
 
 	recent       []string
 	recentLength int
 	shuffle      bool
-}
+	recentLock   *sync.RWMutex // guards recent and shuffle
+
+	ratings     map[string]*rating
+	ratingsLock *sync.RWMutex
 
-// How many minutes to wait between saves of the autoq state
-var autosaveTimer time.Duration = 5
+	blacklist     map[string]bool
+	blacklistLock *sync.RWMutex
+}
 
 // Function which will provide a new autoq struct
-// An autoq must be provided a file that it can read/write it's data to
-// so that the chain is preserved between launches. Chainbreak prob will determine
+// The chain is kept in the provided database so that it is preserved between
+// launches. If qfile points at an autoq file from before the database it will
+// be imported once. Chainbreak prob will determine
 // how often to give a random suggestion instead of the *real* one. Prefix length
 // determines how far back the autoq's "memory" goes back. Longer = more predictable
-func NewAQEngine(qfile string, cache *cache.Cache, chainbreakProb float64, prefixLength int, recentLength int) *AQEngine {
+func NewAQEngine(database *db.DB, qfile string, cache *cache.Cache, chainbreakProb float64, prefixLength int, recentLength int) *AQEngine {
 	q := &AQEngine{
-		markovChain:  newChain(prefixLength, chainbreakProb),
-		playedSongs:  make(chan string),
-		cache:        cache,
-		recent:       make([]string, recentLength),
-		recentLength: recentLength,
-		shuffle:      false,
+		markovChain:   newChain(prefixLength, chainbreakProb),
+		playedSongs:   make(chan string),
+		cache:         cache,
+		db:            database,
+		recent:        make([]string, recentLength),
+		recentLength:  recentLength,
+		shuffle:       false,
+		recentLock:    &sync.RWMutex{},
+		ratings:       make(map[string]*rating),
+		ratingsLock:   &sync.RWMutex{},
+		blacklist:     make(map[string]bool),
+		blacklistLock: &sync.RWMutex{},
 	}
+	q.markovChain.weight = q.weight
+	q.markovChain.banned = q.IsBlacklisted
 
 	// Confirm we can interact with our persitent storage
-	_, err := os.Stat(qfile)
+	err := database.Migrate(db.AutoqBucket, qfile, q.Load)
+	if err == nil {
+		err = q.loadDB()
+	}
+	if err == nil {
+		err = q.loadRatings()
+	}
 	if err == nil {
-		err = q.Load(qfile)
-	} else if os.IsNotExist(err) {
-		log.Printf("qfile %s doesn't exist. Creating new qfile", qfile)
-		err = q.Write(qfile)
+		err = q.loadBlacklist()
 	}
 
 	if err != nil {
-		errString := fmt.Sprintf("Fatal error when interacting with qfile on launch.\nErr: %v\n", err)
+		errString := fmt.Sprintf("Fatal error when interacting with the autoq database on launch.\nErr: %v\n", err)
 		panic(errString)
 	}
 
-	// Write the chain to disk occasionally to preserve it between runs
-	go func() {
-		for {
-			time.Sleep(autosaveTimer * time.Minute)
-			err := q.Write(qfile)
-			if err != nil {
-				log.Printf("WARNING! Failed to write qfile. Data will not persist until"+
-					"this is fixed. \n Err: %v\n", err)
-			}
-		}
-	}()
-
 	return q
 }
 
-// Method which will write the autoq data to the provided file. Will overwrite
-// a file if one already exists at that location.
-func (q *AQEngine) Write(filename string) error {
-	qfile, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0660)
+// The chain starts out on an empty prefix, but the database won't take an
+// empty key, so every prefix gets marked before being stored
+const dbKeyMarker = "prefix:"
+
+// persistKey saves the suffixes of a single prefix to the database.
+// Caller must hold the chain lock.
+func (q *AQEngine) persistKey(key string) error {
+	suffixData, err := json.Marshal((*q.markovChain.chainData)[key])
 	if err != nil {
 		return err
 	}
-	defer qfile.Close()
+	return q.db.Put(db.AutoqBucket, dbKeyMarker+key, suffixData)
+}
 
-	encoder := gob.NewEncoder(qfile)
-	q.markovChain.chainLock.RLock()
-	encoder.Encode(q.markovChain.chainData)
-	q.markovChain.chainLock.RUnlock()
+// loadDB reads the whole chain out of the database. Prefixes still stored as
+// a plain list of suffixes, from before transitions were counted, are
+// converted as they're read.
+func (q *AQEngine) loadDB() error {
+	q.markovChain.chainLock.Lock()
+	defer q.markovChain.chainLock.Unlock()
+
+	now := time.Now()
+	legacyKeys := []string{}
+	err := q.db.ForEach(db.AutoqBucket, func(key string, value []byte) error {
+		key = strings.TrimPrefix(key, dbKeyMarker)
+		suffixes := make(suffixes)
+		if err := json.Unmarshal(value, &suffixes); err == nil {
+			(*q.markovChain.chainData)[key] = suffixes
+			return nil
+		}
 
+		legacySuffixes := []string{}
+		if err := json.Unmarshal(value, &legacySuffixes); err != nil {
+			return fmt.Errorf("failed to parse autoq prefix %s. Err: %v", key, err)
+		}
+		(*q.markovChain.chainData)[key] = suffixesFromList(key, legacySuffixes, now)
+		legacyKeys = append(legacyKeys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Can't write while reading, so the converted prefixes are saved after
+	if len(legacyKeys) > 0 {
+		log.Printf("Converting %d autoq prefixes to counted transitions\n", len(legacyKeys))
+	}
+	for _, key := range legacyKeys {
+		if err = q.persistKey(key); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Method which will load the provided autoq data file. Will overwrite the internal
-// state of the object. Should pretty much only be used when the object is created
-// but it is left public in case a client needs to load old data or something
+// suffixesFromList converts the old list of suffixes into counted
+// transitions. Old lists could have duplicates and loops back to the prefix,
+// duplicates are counted and loops dropped.
+func suffixesFromList(key string, list []string, now time.Time) suffixes {
+	converted := make(suffixes)
+	for _, song := range list {
+		if song == key {
+			continue
+		}
+		converted.add(song, now)
+	}
+	return converted
+}
+
+// Method which will load the provided autoq data file and save it into the
+// database. Will overwrite the internal state of the object. Should pretty much
+// only be used to import the flat file from before the database existed
 func (q *AQEngine) Load(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -100,21 +160,32 @@ func (q *AQEngine) Load(filename string) error {
 	}
 	defer file.Close()
 
+	legacyChain := make(map[string][]string)
 	decoder := gob.NewDecoder(file)
-	q.markovChain.chainLock.Lock()
-	err = decoder.Decode(q.markovChain.chainData)
-	q.markovChain.chainLock.Unlock()
-
-	if err != nil {
+	if err = decoder.Decode(&legacyChain); err != nil {
 		return err
 	}
 
-	return nil
+	q.markovChain.chainLock.Lock()
+	defer q.markovChain.chainLock.Unlock()
+	now := time.Now()
+	chainData := make(map[string]suffixes)
+	entries := make(map[string][]byte)
+	for key, list := range legacyChain {
+		chainData[key] = suffixesFromList(key, list, now)
+		if entries[dbKeyMarker+key], err = json.Marshal(chainData[key]); err != nil {
+			return err
+		}
+	}
+	*q.markovChain.chainData = chainData
+
+	return q.db.Replace(db.AutoqBucket, entries)
 }
 
 // Vpop simply returns the next song according to the Markov chain
 func (q *AQEngine) Vpop() (*resource.Song, error) {
-	return q.cache.Lookup(q.generateFresh())
+	song, _ := q.generateFresh()
+	return q.cache.Lookup(song)
 }
 
 // The interface for external callers to add to the markov chain
@@ -123,9 +194,12 @@ func (q *AQEngine) Vpop() (*resource.Song, error) {
 func (q *AQEngine) NotifyPlayed(resourceID string, learnFrom bool) {
 	// if shuffle flag is set, ignore the song being given and just
 	// pick a random one
-	if q.shuffle {
+	q.recentLock.Lock()
+	shuffle := q.shuffle
+	q.shuffle = false
+	q.recentLock.Unlock()
+	if shuffle {
 		resourceID = q.markovChain.getRandom()
-		q.shuffle = false
 	}
 
 	// Put it in the recent so we don't play it again too soon
@@ -135,46 +209,74 @@ func (q *AQEngine) NotifyPlayed(resourceID string, learnFrom bool) {
 	defer q.markovChain.chainLock.Unlock()
 
 	key := q.markovChain.prefix.String()
-	// Don't put more than one of the same song in the predict list
-	if learnFrom {
-		duplicate := false
-		for _, value := range (*q.markovChain.chainData)[key] {
-			if value == resourceID {
-				duplicate = true
-			}
+	// Make sure we aren't creating a loop
+	if learnFrom && key != resourceID {
+		chainData := *q.markovChain.chainData
+		if chainData[key] == nil {
+			chainData[key] = make(suffixes)
 		}
-
-		if !duplicate {
-			// Make sure we aren't creating a loop
-			if key != resourceID {
-				log.Printf("Adding new song %s to autoqueuer\n", resourceID)
-				(*q.markovChain.chainData)[key] = append((*q.markovChain.chainData)[key], resourceID)
-			}
+		if _, known := chainData[key][resourceID]; !known {
+			log.Printf("Adding new song %s to autoqueuer\n", resourceID)
+		}
+		chainData[key].add(resourceID, time.Now())
+		if err := q.persistKey(key); err != nil {
+			log.Printf("WARNING! Failed to save autoq data. Err: %v\n", err)
 		}
 	}
 	q.markovChain.prefix.shift(resourceID)
 }
 
 func (q *AQEngine) Shuffle() {
+	q.recentLock.Lock()
 	q.shuffle = true
+	q.recentLock.Unlock()
+}
+
+// Next picks the song the chain would play after the provided songs, as if
+// they had already been played. It's how picks are planned ahead of time.
+// Songs in avoid won't be picked, and neither will the songs in after.
+func (q *AQEngine) Next(after []string, avoid []string) string {
+	p := q.markovChain.current()
+	for _, song := range after {
+		p.shift(song)
+	}
+
+	avoided := make(map[string]bool)
+	for _, song := range append(after, avoid...) {
+		avoided[song] = true
+	}
+	song, _ := q.generateFreshFrom(p, avoided)
+	if avoided[song] {
+		return ""
+	}
+	return song
 }
 
-func (q *AQEngine) generateFresh() (song string) {
-	// Add defer to store whatever ends up getting returned
+// generateFresh picks the next song, avoiding ones played recently. The
+// reason explains how it was picked.
+func (q *AQEngine) generateFresh() (song string, reason string) {
+	return q.generateFreshFrom(q.markovChain.current(), nil)
+}
+
+// generateFreshFrom picks the song to follow the prefix, avoiding ones played
+// recently and the ones in avoid
+func (q *AQEngine) generateFreshFrom(p prefix, avoid map[string]bool) (song string, reason string) {
 	count := 0
-	for song = q.markovChain.generate(); !q.isFresh(song); song = q.markovChain.generate() {
+	for song, reason = q.markovChain.generateFrom(p); !q.isFresh(song) || avoid[song]; song, reason = q.markovChain.generateFrom(p) {
 		if count > 5 {
 			// We can't seem to get a fresh song, just ask for a random one
 			log.Printf("Couldn't get a fresh song, shuffling...\n")
-			return q.markovChain.getRandom()
+			return q.markovChain.getRandom(), "couldn't find a fresh song, picked at random"
 		}
 		count++
 	}
-	return song
+	return song, reason
 }
 
 // Return what was passed in for chaining
 func (q *AQEngine) pushRecent(s string) string {
+	q.recentLock.Lock()
+	defer q.recentLock.Unlock()
 	q.recent = append(q.recent, s)
 	q.recent = q.recent[1:]
 
@@ -182,6 +284,8 @@ func (q *AQEngine) pushRecent(s string) string {
 }
 
 func (q *AQEngine) isFresh(s string) bool {
+	q.recentLock.RLock()
+	defer q.recentLock.RUnlock()
 	for _, elem := range q.recent {
 		if s == elem {
 			return false
@@ -205,52 +309,143 @@ func (p prefix) shift(word string) {
 	p[len(p)-1] = word
 }
 
-// chain contains a map ("chain") of prefixes to a list of suffixes.
+// How long it takes a transition to count for half as much. Transitions heard
+// recently count for more than ones that haven't come up in a while.
+var transitionHalfLife = 90 * 24 * time.Hour
+
+// transition is how often a suffix has followed a prefix, decayed as of Last
+type transition struct {
+	Count float64   `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+// weight gives the count decayed to now
+func (t *transition) weight(now time.Time) float64 {
+	age := now.Sub(t.Last)
+	if age <= 0 {
+		return t.Count
+	}
+	return t.Count * math.Pow(0.5, float64(age)/float64(transitionHalfLife))
+}
+
+// suffixes are the songs which have followed a prefix
+type suffixes map[string]*transition
+
+// add counts the song following the prefix once more
+func (s suffixes) add(song string, now time.Time) {
+	t, exists := s[song]
+	if !exists {
+		s[song] = &transition{Count: 1, Last: now}
+		return
+	}
+	t.Count = t.weight(now) + 1
+	t.Last = now
+}
+
+// chain contains a map ("chain") of prefixes to their suffixes.
 // A prefix is a string of prefixLen songs joined with spaces.
-// A suffix is a single song. A prefix can have multiple suffixes.
+// A suffix is a single song. A prefix can have multiple suffixes, each
+// weighted by how often it has followed the prefix. Weight, if set, further
+// scales how likely each song is to be picked, and banned songs are never
+// picked.
 type chain struct {
-	chainData      *map[string][]string
+	chainData      *map[string]suffixes
 	prefix         prefix
 	chainLock      *sync.RWMutex
 	prefixLen      int
 	chainbreakProb float64
+	weight         func(song string) float64
+	banned         func(song string) bool
 }
 
 // newChain returns a new chain with prefixes of prefixLen songs
 func newChain(prefixLen int, chainbreakProb float64) *chain {
-	chainData := make(map[string][]string)
-	return &chain{&chainData, make(prefix, prefixLen), &sync.RWMutex{}, prefixLen, chainbreakProb}
+	chainData := make(map[string]suffixes)
+	return &chain{&chainData, make(prefix, prefixLen), &sync.RWMutex{}, prefixLen, chainbreakProb, nil, nil}
 }
 
-// Returns the next song to play
-func (c *chain) generate() (song string) {
-	// Choices represents songs it might be good to play next
+// pick randomly selects one of the choices in proportion to its weight
+func (c *chain) pick(choices []string, weights []float64) string {
+	total := 0.0
+	for idx, choice := range choices {
+		if c.weight != nil {
+			weights[idx] *= c.weight(choice)
+		}
+		total += weights[idx]
+	}
+	target := rand.Float64() * total
+	for idx, weight := range weights {
+		if target < weight {
+			return choices[idx]
+		}
+		target -= weight
+	}
+	return choices[len(choices)-1]
+}
+
+// isBanned reports whether the song must never be picked
+func (c *chain) isBanned(song string) bool {
+	return c.banned != nil && c.banned(song)
+}
+
+// current gives a copy of the prefix the chain is on
+func (c *chain) current() prefix {
+	c.chainLock.RLock()
+	defer c.chainLock.RUnlock()
+	p := make(prefix, len(c.prefix))
+	copy(p, c.prefix)
+	return p
+}
+
+// choices gives the songs which have followed the prefix, leaving out banned
+// ones, along with their decayed counts
+func (c *chain) choices(p prefix) (choices []string, weights []float64) {
 	c.chainLock.RLock()
-	choices := (*c.chainData)[c.prefix.String()]
-	c.chainLock.RUnlock()
+	defer c.chainLock.RUnlock()
+	now := time.Now()
+	for choice, t := range (*c.chainData)[p.String()] {
+		if c.isBanned(choice) {
+			continue
+		}
+		choices = append(choices, choice)
+		weights = append(weights, t.weight(now))
+	}
+	return choices, weights
+}
+
+// Returns the next song to play, and the reason it was picked
+func (c *chain) generate() (song string, reason string) {
+	return c.generateFrom(c.current())
+}
+
+// generateFrom gives a song to follow the prefix, and the reason it was picked
+func (c *chain) generateFrom(p prefix) (song string, reason string) {
+	// Choices represents songs it might be good to play next
+	choices, weights := c.choices(p)
 
 	// If there are no known songs, just pick something at random
 	if len(choices) == 0 {
-		return c.getRandom()
+		return c.getRandom(), "nothing has followed the last songs, picked at random"
 	}
 
 	// Some chance of picking a random song based on chainbreakProb
 	if c.chainbreakProb != 0 && len(choices) < 4 {
 		randInt := int(1 / c.chainbreakProb)
 		if rand.Intn(randInt) == 1 {
-			return c.getRandom()
+			return c.getRandom(), "broke the chain, picked at random"
 		}
 	}
 
-	// Randomly select one of the choices
-	song = choices[rand.Intn(len(choices))]
+	// Randomly select one of the choices, favouring the ones heard most and
+	// the well liked ones
+	song = c.pick(choices, weights)
 
 	// Handle nullsong
 	if song == "" {
-		return c.getRandom()
+		return c.getRandom(), "the chain picked nothing, picked at random"
 	}
 
-	return song
+	return song, "picked from the songs that have followed the last songs"
 }
 
 func (c *chain) getRandom() (randChoice string) {
@@ -265,8 +460,8 @@ func (c *chain) getRandom() (randChoice string) {
 	idx := 0
 	for _, v := range *c.chainData {
 		if idx == idxToTarget {
-			randChoice = v[rand.Intn(len(v))]
-			if randChoice != c.prefix[len(c.prefix)-1] {
+			randChoice = randomSuffix(v)
+			if randChoice != c.prefix[len(c.prefix)-1] && !c.isBanned(randChoice) {
 				break
 			}
 			idxToTarget += 1
@@ -274,5 +469,24 @@ func (c *chain) getRandom() (randChoice string) {
 		idx += 1
 	}
 
+	// Ran out of prefixes without finding anything we're allowed to play
+	if c.isBanned(randChoice) {
+		return ""
+	}
 	return
 }
+
+// randomSuffix picks any one of the suffixes, regardless of weight
+func randomSuffix(s suffixes) string {
+	if len(s) == 0 {
+		return ""
+	}
+	target := rand.Intn(len(s))
+	for song := range s {
+		if target == 0 {
+			return song
+		}
+		target--
+	}
+	return ""
+}
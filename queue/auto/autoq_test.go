@@ -1,95 +1,84 @@
 package auto
 
 import (
+	"encoding/gob"
+	"encoding/json"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/VivaLaPanda/uta-stream/db"
 	"github.com/VivaLaPanda/uta-stream/resource/cache"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
 )
 
-func cleanupAutoq(autoqTestfile string) {
-	_, err := os.Stat(autoqTestfile)
-	if err == nil {
-		err := os.Remove(autoqTestfile)
-		if err != nil {
-			panic("Test cleanup failed")
-		}
+func newTestStore(t *testing.T) storage.BlobStore {
+	store, err := storage.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create test store. Err: %v\n", err)
 	}
+	return store
 }
 
 func TestWrite(t *testing.T) {
-	// Ensure the file isn't already there.
-	autoqTestfile := "autoq.db.test"
-	cacheFile := "cache.db.test"
-	c := cache.NewCache(cacheFile, "localhost:5001")
-	q := NewAQEngine(autoqTestfile, c, 0, 1, 0)
-	_, err := os.Stat(autoqTestfile)
-	if err != nil {
-		t.Errorf("Failed to stat qfile after initing autoq. Err: %v\n", err)
-	}
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	q := NewAQEngine(database, "", c, 0, 1, 0)
 
-	// Try writing again
-	err = q.Write(autoqTestfile)
-	if err != nil {
-		t.Errorf("Failed to write after launching. Err: %v\n", err)
-	}
+	q.NotifyPlayed("test_a", true)
+	q.NotifyPlayed("test_b", true)
 
-	cleanupAutoq(autoqTestfile)
-	cleanupAutoq(cacheFile)
+	// A fresh engine on the same database should have the same chain
+	q = NewAQEngine(database, "", c, 0, 1, 0)
+	suffixes := (*q.markovChain.chainData)["test_a"]
+	if len(suffixes) != 1 || suffixes["test_b"] == nil || suffixes["test_b"].Count != 1 {
+		t.Errorf("Chain didn't persist. Suffixes of test_a: %v\n", suffixes)
+	}
 }
 
 func TestLoad(t *testing.T) {
-	// Ensure the file isn't already there.
-	autoqTestfile := "TestLoadQfile.test"
-	cacheFile := "cache.db.test"
-	c := cache.NewCache(cacheFile, "localhost:5001")
-	q := NewAQEngine(autoqTestfile, c, 0, 1, 0)
-	_, err := os.Stat(autoqTestfile)
-	if err != nil {
-		t.Errorf("Failed to stat qfile after initing autoq. Err: %v\n", err)
+	// Write out an autoq file the way it used to be stored
+	autoqTestfile := filepath.Join(t.TempDir(), "autoq.db")
+	writeLegacyAutoq(t, autoqTestfile, map[string][]string{"test_a": {"test_b"}})
+
+	// Now try to import it
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	NewAQEngine(database, autoqTestfile, c, 0, 1, 0)
+
+	q := NewAQEngine(database, "", c, 0, 1, 0)
+	suffixes := (*q.markovChain.chainData)["test_a"]
+	if len(suffixes) != 1 || suffixes["test_b"] == nil {
+		t.Errorf("Chain didn't import. Suffixes of test_a: %v\n", suffixes)
 	}
+}
 
-	// Now try to load
-	err = q.Load(autoqTestfile)
+func writeLegacyAutoq(t *testing.T, filename string, chainData map[string][]string) {
+	file, err := os.Create(filename)
 	if err != nil {
-		t.Errorf("Failed to load qfile. Err: %v\n", err)
+		t.Fatalf("Failed to create legacy qfile. Err: %v\n", err)
 	}
-
-	cleanupAutoq(autoqTestfile)
-	cleanupAutoq(cacheFile)
+	defer file.Close()
+	gob.NewEncoder(file).Encode(chainData)
 }
 
 func TestNotifyPlayed(t *testing.T) {
 	// Bare bones notifyplayed test
-	// Ensure the file isn't already there.
-	autoqTestfile := "TestLoadQfile.test"
-	cacheFile := "cache.db.test"
-	c := cache.NewCache(cacheFile, "localhost:5001")
-	q := NewAQEngine(autoqTestfile, c, 0, 1, 0)
-	_, err := os.Stat(autoqTestfile)
-	if err != nil {
-		t.Errorf("Failed to stat qfile after initing autoq. Err: %v\n", err)
-	}
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	q := NewAQEngine(database, "", c, 0, 1, 0)
 
 	q.NotifyPlayed("test", true)
 
 	// If we didn't panic than this test is a pass
-	cleanupAutoq(autoqTestfile)
-	cleanupAutoq(cacheFile)
 }
 
 func TestVpop(t *testing.T) {
 	// Simple test of vpop
-	// Ensure the file isn't already there.
-	autoqTestfile := "TestLoadQfile.test"
-	cacheFile := "cache.db.test"
-	c := cache.NewCache(cacheFile, "localhost:5001")
-	q := NewAQEngine(autoqTestfile, c, 1, 1, 0)
-	_, err := os.Stat(autoqTestfile)
-	if err != nil {
-		t.Errorf("Failed to stat qfile after initing autoq. Err: %v\n", err)
-	}
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	q := NewAQEngine(database, "", c, 1, 1, 0)
 
 	// Create a chain which is a cycle between test_a and test_b states
 	q.NotifyPlayed("test_a", true)
@@ -114,22 +103,13 @@ func TestVpop(t *testing.T) {
 	if songPath != "test_b" {
 		t.Errorf("Autoq produced unexpected song (expected != actual). %v != %v", "test_b", songPath)
 	}
-
-	cleanupAutoq(autoqTestfile)
-	cleanupAutoq(cacheFile)
 }
 
 func TestFresh(t *testing.T) {
 	// Simple test of vpop
-	// Ensure the file isn't already there.
-	autoqTestfile := "TestLoadQfile.test"
-	cacheFile := "cache.db.test"
-	c := cache.NewCache(cacheFile, "localhost:5001")
-	q := NewAQEngine(autoqTestfile, c, 1, 1, 2)
-	_, err := os.Stat(autoqTestfile)
-	if err != nil {
-		t.Errorf("Failed to stat qfile after initing autoq. Err: %v\n", err)
-	}
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	q := NewAQEngine(database, "", c, 1, 1, 2)
 
 	// Create a chain which is a cycle between test_a and test_b states
 	q.NotifyPlayed("test_a", true)
@@ -147,53 +127,125 @@ func TestFresh(t *testing.T) {
 	if songPath == "test_b" {
 		t.Errorf("TestFresh produced unexpected song (expected != actual). %v != %v", "test_b", songPath)
 	}
-
-	cleanupAutoq(autoqTestfile)
-	cleanupAutoq(cacheFile)
 }
 
 func TestMigrate(t *testing.T) {
-	// Ensure the file isn't already there.
-	autoqTestfile := "autoq.db"
-	cacheFile := "cache.db.test"
-	c := cache.NewCache(cacheFile, "localhost:5001")
-	q := NewAQEngine(autoqTestfile, c, 0, 1, 0)
-	_, err := os.Stat(autoqTestfile)
-	if err != nil {
-		t.Errorf("Failed to stat qfile after initing autoq. Err: %v\n", err)
+	// Old autoq files could end up with duplicate suffixes and loops
+	autoqTestfile := filepath.Join(t.TempDir(), "autoq.db")
+	writeLegacyAutoq(t, autoqTestfile, map[string][]string{
+		"test_a": {"test_b", "test_b", "test_a", "test_c"},
+	})
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	NewAQEngine(database, autoqTestfile, c, 0, 1, 0)
+
+	// Duplicates become counts and loops are dropped
+	q := NewAQEngine(database, "", c, 0, 1, 0)
+	suffixes := (*q.markovChain.chainData)["test_a"]
+	if len(suffixes) != 2 || suffixes["test_b"].Count != 2 || suffixes["test_c"].Count != 1 {
+		t.Errorf("Legacy chain didn't convert. Suffixes of test_a: %v\n", suffixes)
 	}
+}
 
-	// Now try to load
-	err = q.Load(autoqTestfile)
-	if err != nil {
-		t.Errorf("Failed to load qfile. Err: %v\n", err)
+func TestMigrateDB(t *testing.T) {
+	// Before transitions were counted the database held lists of suffixes
+	database := db.OpenTemp(t)
+	database.Put(db.AutoqBucket, dbKeyMarker+"test_a", []byte(`["test_b","test_c","test_b"]`))
+	c := cache.NewCache(database, "", newTestStore(t))
+	NewAQEngine(database, "", c, 0, 1, 0)
+
+	value, _ := database.Get(db.AutoqBucket, dbKeyMarker+"test_a")
+	converted := make(suffixes)
+	if err := json.Unmarshal(value, &converted); err != nil {
+		t.Errorf("Prefix wasn't saved in the new format. Err: %v\n", err)
+		return
+	}
+	if converted["test_b"].Count != 2 || converted["test_c"].Count != 1 {
+		t.Errorf("Prefix didn't convert. Suffixes of test_a: %v\n", converted)
+	}
+}
+
+func TestTransitionCounts(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	q := NewAQEngine(database, "", c, 0, 1, 0)
+
+	// test_b follows test_a far more often than test_c does
+	for i := 0; i < 9; i++ {
+		q.NotifyPlayed("test_a", true)
+		q.NotifyPlayed("test_b", true)
+	}
+	q.NotifyPlayed("test_a", true)
+	q.NotifyPlayed("test_c", true)
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		q.markovChain.prefix.shift("test_a")
+		song, _ := q.markovChain.generate()
+		counts[song]++
+	}
+	if counts["test_b"] < 4*counts["test_c"] {
+		t.Errorf("Picks weren't weighted by transition count: %v\n", counts)
+	}
+}
+
+func TestDecay(t *testing.T) {
+	now := time.Now()
+	old := &transition{Count: 8, Last: now.Add(-2 * transitionHalfLife)}
+	if weight := old.weight(now); weight < 1.99 || weight > 2.01 {
+		t.Errorf("Two half lives should quarter the weight, got %f\n", weight)
 	}
 
-	for k, v := range *q.markovChain.chainData {
-		(*q.markovChain.chainData)[k] = cleanAutoq(v, k)
-		if len((*q.markovChain.chainData)[k]) > 3 {
-			(*q.markovChain.chainData)[k] = (*q.markovChain.chainData)[k][:3]
-		}
+	s := suffixes{"test_a": old}
+	s.add("test_a", now)
+	if s["test_a"].Count < 2.99 || s["test_a"].Count > 3.01 || !s["test_a"].Last.Equal(now) {
+		t.Errorf("Adding should decay then count, got %v\n", s["test_a"])
+	}
+}
+
+func TestRate(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	q := NewAQEngine(database, "", c, 0, 1, 0)
+
+	q.Rate("test_a", "alice", 1)
+	q.Rate("test_a", "bob", 1)
+	// Voting again replaces the old vote
+	q.Rate("test_a", "bob", -1)
+	if score, _ := q.Rate("test_b", "alice", -1); score != -1 {
+		t.Errorf("Expected test_b to have a score of -1, got %d\n", score)
 	}
 
-	q.Write(autoqTestfile)
+	// A fresh engine on the same database should have the same ratings
+	q = NewAQEngine(database, "", c, 0, 1, 0)
+	if score := q.Score("test_a"); score != 0 {
+		t.Errorf("Expected test_a to have a score of 0, got %d\n", score)
+	}
+	if score := q.Score("test_b"); score != -1 {
+		t.Errorf("Expected test_b to have a score of -1, got %d\n", score)
+	}
 }
 
-func cleanAutoq(elements []string, key string) []string {
-	// Use map to record duplicates as we find them.
-	encountered := map[string]bool{}
-	result := []string{}
-
-	for v := range elements {
-		if encountered[elements[v]] == true || key == elements[v] {
-			// Do not add duplicate.
-		} else {
-			// Record this element as an encountered element.
-			encountered[elements[v]] = true
-			// Append to result slice.
-			result = append(result, elements[v])
-		}
-	}
-	// Return the new slice.
-	return result
+func TestWeightedPick(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	q := NewAQEngine(database, "", c, 0, 1, 0)
+
+	for _, voter := range []string{"alice", "bob", "carol"} {
+		q.Rate("test_liked", voter, 1)
+		q.Rate("test_disliked", voter, -1)
+	}
+
+	// Liked is 4 times as likely as unrated, disliked a quarter as likely
+	counts := make(map[string]int)
+	choices := []string{"test_liked", "test_unrated", "test_disliked"}
+	for i := 0; i < 10000; i++ {
+		counts[q.markovChain.pick(choices, []float64{1, 1, 1})]++
+	}
+	if counts["test_liked"] < 2*counts["test_unrated"] || counts["test_unrated"] < 2*counts["test_disliked"] {
+		t.Errorf("Picks weren't weighted by rating: %v\n", counts)
+	}
+	if counts["test_disliked"] == 0 {
+		t.Errorf("Disliked songs should still get picked occasionally\n")
+	}
 }
@@ -0,0 +1,217 @@
+package auto
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/db"
+)
+
+// Suffix describes a song that has followed a prefix
+type Suffix struct {
+	ResourceID  string    `json:"resourceID"`
+	Count       float64   `json:"count"` // times it has followed the prefix, decayed to now
+	LastHeard   time.Time `json:"lastHeard"`
+	Score       int       `json:"score"`
+	Blacklisted bool      `json:"blacklisted"`
+	Probability float64   `json:"probability"` // chance the chain picks it, before chainbreaks and freshness
+}
+
+// Prediction is what the engine would pick next, and why
+type Prediction struct {
+	Prefix     string   `json:"prefix"`
+	Candidates []Suffix `json:"candidates"`
+	Pick       string   `json:"pick"`
+	Reason     string   `json:"reason"`
+	Fresh      bool     `json:"fresh"` // false if the pick has been played recently
+}
+
+// Songs lists every song the chain knows about, as a prefix or a suffix
+func (q *AQEngine) Songs() []string {
+	q.markovChain.chainLock.RLock()
+	defer q.markovChain.chainLock.RUnlock()
+
+	known := make(map[string]bool)
+	for key, suffixes := range *q.markovChain.chainData {
+		for _, song := range strings.Split(key, " ") {
+			known[song] = true
+		}
+		for song := range suffixes {
+			known[song] = true
+		}
+	}
+	// The chain starts on an empty prefix, which isn't a song
+	delete(known, "")
+
+	songs := make([]string, 0, len(known))
+	for song := range known {
+		songs = append(songs, song)
+	}
+	sort.Strings(songs)
+	return songs
+}
+
+// Prefix gives the prefix the chain is currently on, the last songs played
+func (q *AQEngine) Prefix() string {
+	q.markovChain.chainLock.RLock()
+	defer q.markovChain.chainLock.RUnlock()
+	return q.markovChain.prefix.String()
+}
+
+// Suffixes lists the songs that have followed the prefix, most likely first.
+// A prefix is prefixLength resource IDs separated by spaces.
+func (q *AQEngine) Suffixes(prefix string) []Suffix {
+	q.markovChain.chainLock.RLock()
+	now := time.Now()
+	found := []Suffix{}
+	for song, t := range (*q.markovChain.chainData)[prefix] {
+		found = append(found, Suffix{ResourceID: song, Count: t.weight(now), LastHeard: t.Last})
+	}
+	q.markovChain.chainLock.RUnlock()
+
+	// Work out the chances the same way pick does
+	total := 0.0
+	weights := make([]float64, len(found))
+	for idx := range found {
+		found[idx].Score = q.Score(found[idx].ResourceID)
+		found[idx].Blacklisted = q.IsBlacklisted(found[idx].ResourceID)
+		if !found[idx].Blacklisted {
+			weights[idx] = found[idx].Count * q.weight(found[idx].ResourceID)
+			total += weights[idx]
+		}
+	}
+	if total > 0 {
+		for idx := range found {
+			found[idx].Probability = weights[idx] / total
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].Probability != found[j].Probability {
+			return found[i].Probability > found[j].Probability
+		}
+		return found[i].ResourceID < found[j].ResourceID
+	})
+	return found
+}
+
+// Predict shows what the engine would pick next and why, without playing it.
+// Picks are random, so asking again may give a different answer.
+func (q *AQEngine) Predict() Prediction {
+	prefix := q.Prefix()
+	pick, reason := q.generateFresh()
+	return Prediction{
+		Prefix:     prefix,
+		Candidates: q.Suffixes(prefix),
+		Pick:       pick,
+		Reason:     reason,
+		Fresh:      q.isFresh(pick),
+	}
+}
+
+// Forget removes the song from the chain entirely, every prefix it is part of
+// and every prefix it follows
+func (q *AQEngine) Forget(resourceID string) error {
+	if resourceID == "" {
+		return fmt.Errorf("can't forget a song without a resource ID")
+	}
+
+	q.markovChain.chainLock.Lock()
+	defer q.markovChain.chainLock.Unlock()
+
+	chainData := *q.markovChain.chainData
+	found := false
+	for key, suffixes := range chainData {
+		inPrefix := false
+		for _, song := range strings.Split(key, " ") {
+			if song == resourceID {
+				inPrefix = true
+			}
+		}
+		_, inSuffixes := suffixes[resourceID]
+		if !inPrefix && !inSuffixes {
+			continue
+		}
+		found = true
+
+		delete(suffixes, resourceID)
+		if inPrefix || len(suffixes) == 0 {
+			delete(chainData, key)
+			if err := q.db.Delete(db.AutoqBucket, dbKeyMarker+key); err != nil {
+				return fmt.Errorf("failed to remove autoq prefix %s. Err: %v", key, err)
+			}
+			continue
+		}
+		if err := q.persistKey(key); err != nil {
+			return fmt.Errorf("failed to save autoq prefix %s. Err: %v", key, err)
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("%s isn't in the autoq", resourceID)
+	}
+	return nil
+}
+
+// loadBlacklist reads the blacklisted songs out of the database
+func (q *AQEngine) loadBlacklist() error {
+	q.blacklistLock.Lock()
+	defer q.blacklistLock.Unlock()
+
+	return q.db.ForEach(db.BlacklistBucket, func(key string, value []byte) error {
+		q.blacklist[key] = true
+		return nil
+	})
+}
+
+// Blacklist stops the song from ever being picked by the autoq. It can still
+// be queued by hand.
+func (q *AQEngine) Blacklist(resourceID string) error {
+	if resourceID == "" {
+		return fmt.Errorf("can't blacklist a song without a resource ID")
+	}
+
+	q.blacklistLock.Lock()
+	defer q.blacklistLock.Unlock()
+	added := []byte(time.Now().Format(time.RFC3339))
+	if err := q.db.Put(db.BlacklistBucket, resourceID, added); err != nil {
+		return fmt.Errorf("failed to save blacklist. Err: %v", err)
+	}
+	q.blacklist[resourceID] = true
+	return nil
+}
+
+// Unblacklist lets the autoq pick the song again
+func (q *AQEngine) Unblacklist(resourceID string) error {
+	q.blacklistLock.Lock()
+	defer q.blacklistLock.Unlock()
+	if !q.blacklist[resourceID] {
+		return fmt.Errorf("%s isn't blacklisted", resourceID)
+	}
+	if err := q.db.Delete(db.BlacklistBucket, resourceID); err != nil {
+		return fmt.Errorf("failed to save blacklist. Err: %v", err)
+	}
+	delete(q.blacklist, resourceID)
+	return nil
+}
+
+// IsBlacklisted reports whether the song is kept out of the autoq
+func (q *AQEngine) IsBlacklisted(resourceID string) bool {
+	q.blacklistLock.RLock()
+	defer q.blacklistLock.RUnlock()
+	return q.blacklist[resourceID]
+}
+
+// Blacklisted lists every blacklisted song
+func (q *AQEngine) Blacklisted() []string {
+	q.blacklistLock.RLock()
+	defer q.blacklistLock.RUnlock()
+	songs := make([]string, 0, len(q.blacklist))
+	for song := range q.blacklist {
+		songs = append(songs, song)
+	}
+	sort.Strings(songs)
+	return songs
+}
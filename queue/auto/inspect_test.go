@@ -0,0 +1,124 @@
+package auto
+
+import (
+	"testing"
+
+	"github.com/VivaLaPanda/uta-stream/db"
+	"github.com/VivaLaPanda/uta-stream/resource/cache"
+)
+
+func TestSongsAndSuffixes(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	q := NewAQEngine(database, "", c, 0, 1, 0)
+
+	q.NotifyPlayed("test_a", true)
+	q.NotifyPlayed("test_b", true)
+	q.NotifyPlayed("test_a", true)
+	q.NotifyPlayed("test_b", true)
+	q.NotifyPlayed("test_a", true)
+	q.NotifyPlayed("test_c", true)
+
+	songs := q.Songs()
+	if len(songs) != 3 || songs[0] != "test_a" || songs[2] != "test_c" {
+		t.Errorf("Expected the three songs played, got %v\n", songs)
+	}
+
+	// test_b has followed test_a twice, test_c once
+	suffixes := q.Suffixes("test_a")
+	if len(suffixes) != 2 || suffixes[0].ResourceID != "test_b" {
+		t.Errorf("Expected test_b to be the most likely suffix, got %v\n", suffixes)
+		return
+	}
+	if suffixes[0].Probability < 0.66 || suffixes[0].Probability > 0.67 {
+		t.Errorf("Expected test_b to be picked 2/3 of the time, got %f\n", suffixes[0].Probability)
+	}
+}
+
+func TestForget(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	q := NewAQEngine(database, "", c, 0, 1, 0)
+
+	q.NotifyPlayed("test_a", true)
+	q.NotifyPlayed("test_b", true)
+	q.NotifyPlayed("test_c", true)
+	q.NotifyPlayed("test_a", true)
+	q.NotifyPlayed("test_c", true)
+
+	if err := q.Forget("test_b"); err != nil {
+		t.Errorf("Failed to forget test_b. Err: %v\n", err)
+	}
+	if err := q.Forget("test_b"); err == nil {
+		t.Errorf("Forgetting a song twice should fail\n")
+	}
+
+	// Should stay forgotten in a fresh engine
+	q = NewAQEngine(database, "", c, 0, 1, 0)
+	for _, song := range q.Songs() {
+		if song == "test_b" {
+			t.Errorf("test_b is still in the chain\n")
+		}
+	}
+	if suffixes := q.Suffixes("test_a"); len(suffixes) != 1 || suffixes[0].ResourceID != "test_c" {
+		t.Errorf("Expected only test_c to follow test_a, got %v\n", suffixes)
+	}
+}
+
+func TestBlacklist(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	q := NewAQEngine(database, "", c, 0, 1, 0)
+
+	q.NotifyPlayed("test_a", true)
+	q.NotifyPlayed("test_b", true)
+	q.NotifyPlayed("test_a", true)
+	q.NotifyPlayed("test_c", true)
+	q.NotifyPlayed("test_a", true)
+
+	q.Blacklist("test_b")
+	q = NewAQEngine(database, "", c, 0, 1, 0)
+	if !q.IsBlacklisted("test_b") {
+		t.Errorf("Blacklist didn't persist\n")
+	}
+
+	q.markovChain.prefix.shift("test_a")
+	for i := 0; i < 100; i++ {
+		if song, _ := q.markovChain.generate(); song == "test_b" {
+			t.Errorf("Picked a blacklisted song\n")
+			return
+		}
+		if song := q.markovChain.getRandom(); song == "test_b" {
+			t.Errorf("Randomly picked a blacklisted song\n")
+			return
+		}
+	}
+
+	q.Unblacklist("test_b")
+	if len(q.Blacklisted()) != 0 {
+		t.Errorf("Expected an empty blacklist, got %v\n", q.Blacklisted())
+	}
+}
+
+func TestPredictWhilePlaying(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", newTestStore(t))
+	q := NewAQEngine(database, "", c, 0, 1, 2)
+	q.NotifyPlayed("test_a", true)
+	q.NotifyPlayed("test_b", true)
+
+	// The API predicts while the mixer reports plays, run with -race to
+	// check that's safe
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			q.Predict()
+		}
+		done <- true
+	}()
+	for i := 0; i < 50; i++ {
+		q.Shuffle()
+		q.NotifyPlayed("test_a", true)
+	}
+	<-done
+}
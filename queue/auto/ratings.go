@@ -0,0 +1,100 @@
+package auto
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/VivaLaPanda/uta-stream/db"
+)
+
+// rating is how everyone has voted on a song. Votes are kept per voter so
+// that voting again changes their vote instead of adding another.
+type rating struct {
+	Votes map[string]int `json:"votes"`
+}
+
+// score adds up the votes
+func (r *rating) score() int {
+	score := 0
+	for _, vote := range r.Votes {
+		score += vote
+	}
+	return score
+}
+
+// loadRatings reads every song's rating out of the database
+func (q *AQEngine) loadRatings() error {
+	q.ratingsLock.Lock()
+	defer q.ratingsLock.Unlock()
+
+	return q.db.ForEach(db.RatingsBucket, func(key string, value []byte) error {
+		songRating := &rating{}
+		if err := json.Unmarshal(value, songRating); err != nil {
+			return fmt.Errorf("failed to parse rating of %s. Err: %v", key, err)
+		}
+		q.ratings[key] = songRating
+		return nil
+	})
+}
+
+// Rate records the voter liking (a positive vote) or disliking (a negative
+// vote) the song, replacing any vote they made on it before. Returns the
+// song's score afterwards.
+func (q *AQEngine) Rate(resourceID string, voter string, vote int) (score int, err error) {
+	if resourceID == "" {
+		return 0, fmt.Errorf("can't rate a song without a resource ID")
+	}
+	if vote > 1 {
+		vote = 1
+	} else if vote < -1 {
+		vote = -1
+	}
+
+	q.ratingsLock.Lock()
+	defer q.ratingsLock.Unlock()
+	songRating, exists := q.ratings[resourceID]
+	if !exists {
+		songRating = &rating{Votes: make(map[string]int)}
+	}
+	oldVote, voted := songRating.Votes[voter]
+	songRating.Votes[voter] = vote
+
+	ratingData, err := json.Marshal(songRating)
+	if err == nil {
+		err = q.db.Put(db.RatingsBucket, resourceID, ratingData)
+	}
+	if err != nil {
+		// Put things back how they were
+		if voted {
+			songRating.Votes[voter] = oldVote
+		} else {
+			delete(songRating.Votes, voter)
+		}
+		return songRating.score(), fmt.Errorf("failed to save rating. Err: %v", err)
+	}
+	q.ratings[resourceID] = songRating
+
+	return songRating.score(), nil
+}
+
+// Score gives the song's likes minus its dislikes
+func (q *AQEngine) Score(resourceID string) int {
+	q.ratingsLock.RLock()
+	defer q.ratingsLock.RUnlock()
+	if songRating, exists := q.ratings[resourceID]; exists {
+		return songRating.score()
+	}
+	return 0
+}
+
+// weight turns the song's score into how likely the chain is to pick it.
+// Each like adds as much weight as an unrated song has, and a song with n
+// more dislikes than likes is 1/(n+1) as likely as an unrated one, so
+// disliked songs fade out without ever disappearing entirely.
+func (q *AQEngine) weight(resourceID string) float64 {
+	score := q.Score(resourceID)
+	if score >= 0 {
+		return float64(1 + score)
+	}
+	return 1 / float64(1-score)
+}
@@ -0,0 +1,129 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/VivaLaPanda/uta-stream/resource"
+)
+
+// fillLookahead has the autoq pick songs until there are n waiting after the
+// queue. Picks follow on from each other, as if everything before them had
+// already played. Looking a pick up starts its download, but its audio isn't
+// read out of the store until it's popped.
+func (q *Queue) fillLookahead(n int) {
+	q.fillLock.Lock()
+	defer q.fillLock.Unlock()
+
+	for {
+		q.lock.Lock()
+		if !q.AutoqEnabled || len(q.picks) >= n {
+			q.lock.Unlock()
+			return
+		}
+		after := []string{}
+		// The song playing now hasn't been learned from yet
+		if q.current != nil && q.current != q.lastPlayed {
+			after = append(after, q.current.ResourceID())
+		}
+		for _, pick := range q.picks {
+			after = append(after, pick.ResourceID())
+		}
+		avoid := []string{}
+		for resourceID := range q.vetoed {
+			avoid = append(avoid, resourceID)
+		}
+		q.lock.Unlock()
+
+		resourceID := q.autoq.Next(after, avoid)
+		if resourceID == "" {
+			return
+		}
+		song, err := q.cache.Lookup(resourceID)
+		if err != nil {
+			log.Printf("Failed to look up autoq pick %s. Err: %v\n", resourceID, err)
+			return
+		}
+		song = q.cache.Queued(song, "")
+		song.AutoPick = true
+
+		q.lock.Lock()
+		if !q.AutoqEnabled {
+			q.lock.Unlock()
+			return
+		}
+		q.picks = append(q.picks, song)
+		q.lock.Unlock()
+	}
+}
+
+// nextPick takes the first of the autoq's picks, picking one on the spot if
+// there aren't any waiting. Picks that were blacklisted while they waited are
+// passed over.
+func (q *Queue) nextPick() *resource.Song {
+	// Blacklisted songs aren't picked, so this only goes round again for the
+	// picks that were already waiting
+	for attempt := 0; attempt <= q.lookahead; attempt++ {
+		q.fillLookahead(1)
+
+		q.lock.Lock()
+		if len(q.picks) == 0 {
+			q.lock.Unlock()
+			break
+		}
+		pick := q.picks[0]
+		q.picks = q.picks[1:]
+		// The lineup has moved on, vetoes were only ever about it
+		q.vetoed = make(map[string]bool)
+		q.lock.Unlock()
+
+		if q.autoq.IsBlacklisted(pick.ResourceID()) {
+			log.Printf("Passing over autoq pick %s, it has been blacklisted\n", pick.ResourceID())
+			continue
+		}
+		return pick
+	}
+
+	// Everything the chain knows has been vetoed or is already lined up,
+	// settle for whatever it gives us
+	song, err := q.autoq.Vpop()
+	if err != nil {
+		return nil
+	}
+	song = q.cache.Queued(song, "")
+	song.AutoPick = true
+	return song
+}
+
+// clearLookahead throws out every pick, and with them the vetoes
+func (q *Queue) clearLookahead() {
+	q.lock.Lock()
+	q.picks = nil
+	q.vetoed = make(map[string]bool)
+	q.lock.Unlock()
+}
+
+// Veto throws out the autoq's upcoming pick of the song, and another is
+// picked in its place. Vetoed songs aren't picked again until the next autoq
+// pick plays, blacklist them in the autoq to keep them out for good.
+func (q *Queue) Veto(resourceID string) (*resource.Song, error) {
+	q.lock.Lock()
+	var vetoed *resource.Song
+	for idx, pick := range q.picks {
+		if pick.ResourceID() == resourceID {
+			vetoed = pick
+			q.picks = append(q.picks[:idx], q.picks[idx+1:]...)
+			break
+		}
+	}
+	if vetoed == nil {
+		q.lock.Unlock()
+		return nil, fmt.Errorf("%s isn't one of the upcoming autoq picks", resourceID)
+	}
+	q.vetoed[resourceID] = true
+	q.lock.Unlock()
+
+	go q.fillLookahead(q.lookahead)
+
+	return vetoed, nil
+}
@@ -0,0 +1,119 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/VivaLaPanda/uta-stream/events"
+)
+
+// Mode controls who gets to pick what the station plays
+type Mode string
+
+const (
+	// DJMode only lets the current DJ queue and skip songs
+	DJMode Mode = "dj"
+	// CommunityMode lets anyone queue and skip songs
+	CommunityMode Mode = "community"
+	// HybridMode is community mode, but the autoq fills in when the queue runs dry
+	HybridMode Mode = "hybrid"
+)
+
+// ParseMode turns the name of a mode into a Mode, failing if it isn't one we know
+func ParseMode(name string) (Mode, error) {
+	switch mode := Mode(name); mode {
+	case DJMode, CommunityMode, HybridMode:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown station mode %s, should be dj, community or hybrid", name)
+	}
+}
+
+// Mode gives the mode the station is in
+func (q *Queue) Mode() Mode {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.mode
+}
+
+// SetMode switches the station into the provided mode. The autoq only runs in
+// hybrid mode, and leaving DJ mode lets go of the current DJ.
+func (q *Queue) SetMode(mode Mode) {
+	q.lock.Lock()
+	q.mode = mode
+	q.AutoqEnabled = mode == HybridMode
+	if mode != DJMode {
+		q.dj = ""
+	}
+	q.lock.Unlock()
+	log.Printf("Station switched to %s mode\n", mode)
+	if mode == HybridMode {
+		go q.fillLookahead(q.lookahead)
+	} else {
+		q.clearLookahead()
+	}
+	q.publishMode()
+}
+
+// DJ gives the name of the user currently DJing, empty if nobody is
+func (q *Queue) DJ() string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.dj
+}
+
+// ClaimDJ makes the named user the DJ, as long as nobody else already is
+func (q *Queue) ClaimDJ(user string) error {
+	if user == "" {
+		return fmt.Errorf("only named users can DJ")
+	}
+
+	q.lock.Lock()
+	if q.mode != DJMode {
+		q.lock.Unlock()
+		return fmt.Errorf("the station is in %s mode, there's no DJ to be", q.mode)
+	}
+	if q.dj != "" && q.dj != user {
+		dj := q.dj
+		q.lock.Unlock()
+		return fmt.Errorf("%s is already DJing", dj)
+	}
+	q.dj = user
+	q.lock.Unlock()
+	q.publishMode()
+
+	return nil
+}
+
+// ReleaseDJ stops the named user being the DJ, if they are
+func (q *Queue) ReleaseDJ(user string) error {
+	q.lock.Lock()
+	if q.dj == "" || q.dj != user {
+		q.lock.Unlock()
+		return fmt.Errorf("%s isn't the DJ", user)
+	}
+	q.dj = ""
+	q.lock.Unlock()
+	q.publishMode()
+
+	return nil
+}
+
+// CanControl reports whether the named user is allowed to queue and skip
+// songs. In DJ mode that's only the DJ, otherwise it's anyone.
+func (q *Queue) CanControl(user string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.mode != DJMode {
+		return true
+	}
+	return q.dj != "" && q.dj == user
+}
+
+// publishMode lets subscribers know the mode or DJ changed
+func (q *Queue) publishMode() {
+	events.Publish(events.ModeChange, struct {
+		Mode Mode   `json:"mode"`
+		Dj   string `json:"dj"`
+	}{q.Mode(), q.DJ()})
+}
@@ -4,58 +4,84 @@ package queue
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"strconv"
 	"sync"
-	"time"
 
+	"github.com/VivaLaPanda/uta-stream/db"
+	"github.com/VivaLaPanda/uta-stream/events"
 	"github.com/VivaLaPanda/uta-stream/queue/auto"
 	"github.com/VivaLaPanda/uta-stream/resource"
 	"github.com/VivaLaPanda/uta-stream/resource/cache"
-
-	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
 )
 
 type Queue struct {
-	fifo          []*resource.Song
-	lock          *sync.Mutex
-	autoq         *auto.AQEngine
-	cache         *cache.Cache
-	ipfs          *shell.Shell
-	queueFilename string
-	AutoqEnabled  bool
+	fifo         []*resource.Song
+	lock         *sync.Mutex
+	autoq        *auto.AQEngine
+	cache        *cache.Cache
+	store        storage.BlobStore
+	db           *db.DB
+	AutoqEnabled bool
+	mode         Mode
+	dj           string // user in charge while in DJ mode
+
+	current    *resource.Song // most recently popped
+	lastPlayed *resource.Song // most recent song to finish playing
+
+	lookahead int              // how many autoq picks to plan ahead
+	picks     []*resource.Song // planned autoq picks, they play once the fifo is empty
+	vetoed    map[string]bool  // songs taken out of the picks, so they aren't picked again
+	fillLock  *sync.Mutex
+
+	keys        map[*resource.Song]string // database key of each queued song
+	nextKey     int
+	persistLock *sync.Mutex
 }
 
+// The flat file the queue was kept in before the database. Imported on launch if found.
+var legacyQueueFilename = "queue.db"
+
+// Where the order of the queue is kept in the database, as a list of the keys
+// the songs are under
+const orderKey = "order"
+
 // NeqQueue will return a queue structure with the provided autoq engine and cache
-// attached. enableAutoq will determine whether a Pop will attempt to fetch
-// from the autoq.
-func NewQueue(aqEngine *auto.AQEngine, cache *cache.Cache, enableAutoq bool, ipfsUrl string) *Queue {
-	queueFilename := "queue.db"
+// attached. The station starts in the provided mode, which also determines
+// whether a Pop will attempt to fetch from the autoq. Lookahead is how many
+// autoq picks are planned ahead of time. Songs are read out of the provided store when popped, and the
+// queue itself is kept in the provided database.
+func NewQueue(database *db.DB, aqEngine *auto.AQEngine, cache *cache.Cache, mode Mode, lookahead int, store storage.BlobStore) *Queue {
 	q := &Queue{
-		lock:          &sync.Mutex{},
-		autoq:         aqEngine,
-		cache:         cache,
-		AutoqEnabled:  enableAutoq,
-		queueFilename: queueFilename,
-		ipfs:          shell.NewShell(ipfsUrl),
+		lock:         &sync.Mutex{},
+		autoq:        aqEngine,
+		cache:        cache,
+		AutoqEnabled: mode == HybridMode,
+		mode:         mode,
+		store:        store,
+		db:           database,
+		lookahead:    lookahead,
+		vetoed:       make(map[string]bool),
+		fillLock:     &sync.Mutex{},
+		keys:         make(map[*resource.Song]string),
+		persistLock:  &sync.Mutex{},
 	}
-	q.ipfs.SetTimeout(time.Minute * 30)
 
 	// Confirm we can interact with our persitent storage
-	_, err := os.Stat(queueFilename)
+	err := database.Migrate(db.QueueBucket, legacyQueueFilename, q.Load)
 	if err == nil {
-		err = q.Load(queueFilename)
-	} else if os.IsNotExist(err) {
-		log.Printf("qfile %s doesn't exist. Creating new qfile", queueFilename)
-		err = q.Write(queueFilename)
+		err = q.loadDB()
 	}
 
 	if err != nil {
-		log.Fatalf("Fatal error when interacting with qfile on launch.\nErr: %v\n", err)
+		log.Fatalf("Fatal error when interacting with the queue database on launch.\nErr: %v\n", err)
 	}
 
-	// When reading in the queuefile, it's possible we crashed before and thus have
+	// When reading in the queue, it's possible we crashed before and thus have
 	// songs that never got resolved. Try to go and do that
 	for idx, song := range q.fifo {
 		if song.IpfsPath() == "" && song.URL() != nil {
@@ -68,32 +94,100 @@ func NewQueue(aqEngine *auto.AQEngine, cache *cache.Cache, enableAutoq bool, ipf
 		}
 	}
 
+	go q.fillLookahead(q.lookahead)
+
 	return q
 }
 
-// Method which will write the autoq data to the provided file. Will overwrite
-// a file if one already exists at that location.
-func (q *Queue) Write(filename string) error {
-	qfile, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+// persist saves the current contents of the queue to the database. Each song
+// keeps its own key for as long as it's queued and the order is kept apart, so
+// only songs that were added, removed or changed are written. Saves happen one
+// at a time, so an older snapshot of the queue can't land after a newer one.
+func (q *Queue) persist() error {
+	q.persistLock.Lock()
+	defer q.persistLock.Unlock()
+
+	entries := make(map[string][]byte)
+	order := []string{}
+	keys := make(map[*resource.Song]string)
+	q.lock.Lock()
+	for _, song := range q.fifo {
+		key, known := q.keys[song]
+		// The same song can be queued twice, each needs a key of its own
+		if _, taken := entries[key]; !known || taken {
+			// Zero padded so the database's key order is the order songs were added
+			key = fmt.Sprintf("%08d", q.nextKey)
+			q.nextKey++
+		}
+		songData, err := song.MarshalJSON()
+		if err != nil {
+			q.lock.Unlock()
+			return err
+		}
+		entries[key] = songData
+		order = append(order, key)
+		keys[song] = key
+	}
+	q.keys = keys
+	q.lock.Unlock()
+
+	orderData, err := json.Marshal(order)
 	if err != nil {
 		return err
 	}
-	defer qfile.Close()
-	encoder := json.NewEncoder(qfile)
+	entries[orderKey] = orderData
+
+	if err = q.db.Sync(db.QueueBucket, entries); err != nil {
+		log.Printf("Failed to save the queue. Err: %v\n", err)
+	}
+
+	return err
+}
+
+// loadDB reads the queue out of the database
+func (q *Queue) loadDB() error {
 	q.lock.Lock()
-	if len(q.fifo) == 0 {
-		qfile.WriteString("[]")
-	} else {
-		encoder.Encode(q.fifo)
+	defer q.lock.Unlock()
+
+	songs := make(map[string]*resource.Song)
+	keys := []string{}
+	var order []string
+	err := q.db.ForEach(db.QueueBucket, func(key string, value []byte) error {
+		if key == orderKey {
+			return json.Unmarshal(value, &order)
+		}
+		song := &resource.Song{}
+		if err := song.UnmarshalJSON(value); err != nil {
+			return fmt.Errorf("failed to parse queued song %s. Err: %v", key, err)
+		}
+		songs[key] = song
+		keys = append(keys, key)
+		if number, err := strconv.Atoi(key); err == nil && number >= q.nextKey {
+			q.nextKey = number + 1
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	q.lock.Unlock()
 
+	// Queues saved before the order was kept are in key order. Anything the
+	// order doesn't mention goes at the back.
+	q.fifo = make([]*resource.Song, 0, len(keys))
+	q.keys = make(map[*resource.Song]string)
+	for _, key := range append(order, keys...) {
+		if song, exists := songs[key]; exists {
+			q.fifo = append(q.fifo, song)
+			q.keys[song] = key
+			delete(songs, key)
+		}
+	}
 	return nil
 }
 
-// Method which will load the provided autoq data file. Will overwrite the internal
-// state of the object. Should pretty much only be used when the object is created
-// but it is left public in case a client needs to load old data or something
+// Method which will load the provided queue data file and save it into the
+// database. Will overwrite the internal state of the object. Should pretty much
+// only be used to import the flat file from before the database existed
 func (q *Queue) Load(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -101,17 +195,15 @@ func (q *Queue) Load(filename string) error {
 	}
 	defer file.Close()
 
-	if err == nil {
-		decoder := json.NewDecoder(file)
-		q.lock.Lock()
-		err = decoder.Decode(&q.fifo)
-		q.lock.Unlock()
-	}
+	decoder := json.NewDecoder(file)
+	q.lock.Lock()
+	err = decoder.Decode(&q.fifo)
+	q.lock.Unlock()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return q.persist()
 }
 
 // Pop returns the audio resource next in the queue along with state flags.
@@ -120,39 +212,44 @@ func (q *Queue) Pop() (song *resource.Song, songReader io.ReadCloser, emptyq boo
 	// get from autoq. If autoq gives us an empty string (no audio to play)
 	// or autoq is off, return that the queue is empty
 	fromAuto = false
+	q.lock.Lock()
 	if len(q.fifo) == 0 {
-		if q.AutoqEnabled {
+		autoqEnabled := q.AutoqEnabled
+		q.lock.Unlock()
+		if autoqEnabled {
 			fromAuto = true
-			song, err := q.autoq.Vpop()
-			if err != nil {
+			pick := q.nextPick()
+			if pick == nil {
 				return nil, nil, true, fromAuto
 			}
 
 			// TODO: If resource is IPFS but can't be fetched this blocks, effectivelly
 			// killing the server. Fix this.
-			songReader, err = song.Resolve(q.ipfs)
+			songReader, err := pick.Resolve(q.store)
 			if err != nil {
-				songData, _ := song.MarshalJSON()
+				songData, _ := pick.MarshalJSON()
 				log.Printf("Issue when resolving song (%s). Err: %v\n", songData, err)
 				return nil, nil, true, fromAuto
 			}
 
-			return song, songReader, false, fromAuto
+			q.setCurrent(pick)
+			go q.fillLookahead(q.lookahead)
+			return pick, songReader, false, fromAuto
 		} else {
 			return nil, nil, true, fromAuto
 		}
 	}
 
-	q.lock.Lock()
 	// Top (just get next element, don't remove it)
 	song = q.fifo[0]
 	// Discard top element
 	q.fifo = q.fifo[1:]
+	q.current = song
 	q.lock.Unlock()
-	q.Write(q.queueFilename)
+	q.persist()
 
 	// Resolve the resource ID in the queue
-	songReader, err := song.Resolve(q.ipfs)
+	songReader, err := song.Resolve(q.store)
 	if err != nil {
 		log.Printf("Issue when resolving song (%v). Err: %v\n", song, err)
 		return song, nil, false, fromAuto
@@ -161,9 +258,17 @@ func (q *Queue) Pop() (song *resource.Song, songReader io.ReadCloser, emptyq boo
 	return song, songReader, false, fromAuto
 }
 
+func (q *Queue) setCurrent(song *resource.Song) {
+	q.lock.Lock()
+	q.current = song
+	q.lock.Unlock()
+}
+
 // IsEmpty returns a boolean indicating whether the queue should be considered empty
 // given the state of the real queue and autoq
 func (q *Queue) IsEmpty() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
 	if len(q.fifo) == 0 {
 		if !q.AutoqEnabled {
 			return true
@@ -178,23 +283,35 @@ func (q *Queue) AddToQueue(song *resource.Song) {
 	q.lock.Lock()
 	log.Printf("Queueing %s", song.URL())
 	for _, elem := range q.fifo {
-		if elem.URL() == song.URL() {
-			log.Printf("Tried to queue a duplicate (%s), rejecting", song.Title)
+		if elem.ResourceID() == song.ResourceID() {
+			log.Printf("Tried to queue a duplicate (%s), rejecting", song.Name())
+			q.lock.Unlock()
 			return
 		}
 	}
 	q.fifo = append(q.fifo, song)
+	position := len(q.fifo) - 1
 	q.lock.Unlock()
-	q.Write(q.queueFilename)
+	q.persist()
+	publishEnqueue(song, position)
 }
 
 // Add the provided song to the queue at the front
 func (q *Queue) PlayNext(song *resource.Song) {
 	q.lock.Lock()
-	log.Printf("Adding %s(%s) to queue", song.Title, song.URL())
+	log.Printf("Adding %s(%s) to queue", song.Name(), song.URL())
 	q.fifo = append([]*resource.Song{song}, q.fifo...)
 	q.lock.Unlock()
-	q.Write(q.queueFilename)
+	q.persist()
+	publishEnqueue(song, 0)
+}
+
+// publishEnqueue lets subscribers know where a song was added to the queue
+func publishEnqueue(song *resource.Song, position int) {
+	events.Publish(events.Enqueue, struct {
+		Song     *resource.Song `json:"song"`
+		Position int            `json:"position"`
+	}{song, position})
 }
 
 // Remove all items from the queue. Will not dump the encoder (current song)
@@ -202,36 +319,110 @@ func (q *Queue) Dump() {
 	q.lock.Lock()
 	q.fifo = make([]*resource.Song, 0)
 	q.lock.Unlock()
-	q.Write(q.queueFilename)
+	q.persist()
+}
+
+// Remove takes the song at the provided position (0 is next up) out of the queue
+func (q *Queue) Remove(position int) (*resource.Song, error) {
+	q.lock.Lock()
+	if position < 0 || position >= len(q.fifo) {
+		q.lock.Unlock()
+		return nil, fmt.Errorf("position %d is outside the queue (length %d)", position, len(q.fifo))
+	}
+	song := q.fifo[position]
+	q.fifo = remove(q.fifo, position)
+	q.lock.Unlock()
+	q.persist()
+
+	return song, nil
+}
+
+// RemoveByID takes the first song matching the resource ID (or the url it was
+// queued with) out of the queue
+func (q *Queue) RemoveByID(resourceID string) (*resource.Song, error) {
+	q.lock.Lock()
+	var song *resource.Song
+	for idx, elem := range q.fifo {
+		if elem.ResourceID() == resourceID || (elem.URL() != nil && elem.URL().String() == resourceID) {
+			song = elem
+			q.fifo = remove(q.fifo, idx)
+			break
+		}
+	}
+	q.lock.Unlock()
+
+	if song == nil {
+		return nil, fmt.Errorf("%s is not in the queue", resourceID)
+	}
+	q.persist()
+
+	return song, nil
+}
+
+// Move shifts the song at position from so that it ends up at position to,
+// everything in between slides over to make room
+func (q *Queue) Move(from int, to int) error {
+	q.lock.Lock()
+	if from < 0 || from >= len(q.fifo) || to < 0 || to >= len(q.fifo) {
+		length := len(q.fifo)
+		q.lock.Unlock()
+		return fmt.Errorf("can't move %d to %d, queue only has %d songs", from, to, length)
+	}
+	song := q.fifo[from]
+	q.fifo = remove(q.fifo, from)
+	q.fifo = append(q.fifo[:to], append([]*resource.Song{song}, q.fifo[to:]...)...)
+	q.lock.Unlock()
+	q.persist()
+
+	return nil
+}
+
+// RequeueLast adds the most recent song to finish playing to the back of the
+// queue, on behalf of the named user
+func (q *Queue) RequeueLast(queuedBy string) (*resource.Song, error) {
+	q.lock.Lock()
+	lastPlayed := q.lastPlayed
+	q.lock.Unlock()
+
+	if lastPlayed == nil {
+		return nil, fmt.Errorf("nothing has finished playing yet")
+	}
+	song := lastPlayed.Copy()
+	song.QueuedBy = queuedBy
+	song.AutoPick = false
+	q.AddToQueue(song)
+
+	return song, nil
 }
 
 // Length returns the length of the real queue
 func (q *Queue) Length() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
 	return len(q.fifo)
 }
 
-// Get queue returns a copy of the real queue, and while it does so
-// attempts to resolve any placeholders
+// Get queue returns a copy of the real queue followed by the autoq's upcoming
+// picks, and while it does so attempts to resolve any placeholders
 func (q *Queue) GetQueue() []*resource.Song {
 	// Go through the queue and try to resolve any placeholders
 	q.lock.Lock()
-	indexesToDelete := make([]int, 0)
-	for idx, elem := range q.fifo {
-		err := elem.CheckFailure()
+	for idx := len(q.fifo) - 1; idx >= 0; idx-- {
+		err := q.fifo[idx].CheckFailure()
 		if err != nil {
-			log.Printf("Song %s had a download error: %s", elem.URL(), err)
-			indexesToDelete = append(indexesToDelete, idx)
+			log.Printf("Song %s had a download error: %s", q.fifo[idx].URL(), err)
+			q.fifo = remove(q.fifo, idx)
 		}
 	}
-	for _, elem := range indexesToDelete {
-		q.fifo = remove(q.fifo, elem)
-	}
 	q.lock.Unlock()
 
 	// Make a copy so whoever is reading this can't write it
-	qCopy := make([]*resource.Song, len(q.fifo))
 	q.lock.Lock()
+	qCopy := make([]*resource.Song, len(q.fifo), len(q.fifo)+len(q.picks))
 	copy(qCopy, q.fifo)
+	for _, pick := range q.picks {
+		qCopy = append(qCopy, pick)
+	}
 	q.lock.Unlock()
 
 	return qCopy
@@ -241,9 +432,9 @@ func (q *Queue) Shuffle() {
 	q.autoq.Shuffle()
 }
 
+// remove takes out the element at i, keeping the rest in order
 func remove(s []*resource.Song, i int) []*resource.Song {
-	s[len(s)-1], s[i] = s[i], s[len(s)-1]
-	return s[:len(s)-1]
+	return append(s[:i], s[i+1:]...)
 }
 
 // Used as a gateway to let the autoq know a song was played.
@@ -251,5 +442,11 @@ func remove(s []*resource.Song, i int) []*resource.Song {
 // the last song (so it doesn't suggest it again), but you *don't* want to train it
 // off what you just finished
 func (q *Queue) NotifyDone(ipfsPath string, learnFrom bool) {
+	q.lock.Lock()
+	if q.current != nil && q.current.IpfsPath() == ipfsPath {
+		q.lastPlayed = q.current
+	}
+	q.lock.Unlock()
+
 	q.autoq.NotifyPlayed(ipfsPath, learnFrom)
 }
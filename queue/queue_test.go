@@ -1,42 +1,47 @@
 package queue
 
 import (
-	"os"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/VivaLaPanda/uta-stream/db"
 	"github.com/VivaLaPanda/uta-stream/queue/auto"
 	"github.com/VivaLaPanda/uta-stream/resource"
 	"github.com/VivaLaPanda/uta-stream/resource/cache"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
 )
 
 var (
-	cacheFile = "cache.db.test"
+	store     storage.BlobStore
 	testSongA *resource.Song
 	testSongB *resource.Song
+	testSongC *resource.Song
 )
 
 func init() {
-	testSongA, _ = resource.NewSong("/ipfs/QmQmjmsqhvTNsvZGrwBMhGEX5THCoWs2GWjszJ48tnr3Uf")
-	testSongB, _ = resource.NewSong("/ipfs/QmeFmYKQD6ky5d2uB7qSBBDpo8XtSP3iSfATEpxj6KULSX")
-}
-
-func cleanup(file string) {
-	_, err := os.Stat(file)
-	if err == nil {
-		err := os.Remove(file)
-		if err != nil {
-			panic("Test cleanup failed")
-		}
+	blobDir, err := ioutil.TempDir("", "queue-test-blobs")
+	if err != nil {
+		panic("Test setup failed")
 	}
+	store, _ = storage.NewLocalStore(blobDir)
+
+	pathA, _ := store.Put(strings.NewReader("song a"))
+	pathB, _ := store.Put(strings.NewReader("song b"))
+	testSongA, _ = resource.NewSong(pathA)
+	pathC, _ := store.Put(strings.NewReader("song c"))
+	testSongB, _ = resource.NewSong(pathB)
+	testSongC, _ = resource.NewSong(pathC)
 }
 
 func TestPop(t *testing.T) {
-	autoqTestfile := "autoqTestPop.test"
-	ipfsUrl := "localhost:5001"
-	c := cache.NewCache(cacheFile, "localhost:5001")
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", store)
 	// Make sure the q starts empty
-	a := auto.NewAQEngine(autoqTestfile, c, 0, 1, 0)
-	q := NewQueue(a, c, false, ipfsUrl)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	q := NewQueue(database, a, c, CommunityMode, 0, store)
 	_, _, isEmpty, _ := q.Pop()
 	if isEmpty == false {
 		t.Errorf("Queue didn't start empty. isEmpty was false.\n")
@@ -57,17 +62,14 @@ func TestPop(t *testing.T) {
 	if song.IpfsPath() != testSongB.IpfsPath() {
 		t.Errorf("Popped_2 != enqueue_2: %v != %v\n", song, testSongB)
 	}
-
-	cleanup(autoqTestfile)
-	cleanup(cacheFile)
 }
 
 func TestPlayNext(t *testing.T) {
-	autoqTestfile := "autoqTestPlayNext.test"
 	// Make sure the q starts empty
-	c := cache.NewCache(cacheFile, "localhost:5001")
-	a := auto.NewAQEngine(autoqTestfile, c, 0, 1, 0)
-	q := NewQueue(a, c, false, "localhost:5001")
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", store)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	q := NewQueue(database, a, c, CommunityMode, 0, store)
 	_, _, isEmpty, _ := q.Pop()
 	if isEmpty == false {
 		t.Errorf("Queue didn't start empty. isEmpty was false.\n")
@@ -88,17 +90,14 @@ func TestPlayNext(t *testing.T) {
 	if song.IpfsPath() != testSongA.IpfsPath() {
 		t.Errorf("Popped_2 != pushed_2: %v != %v\n", song, testSongA)
 	}
-
-	cleanup(autoqTestfile)
-	cleanup(cacheFile)
 }
 
 func TestIsEmpty(t *testing.T) {
-	autoqTestfile := "autoqTestIsEmpty.test"
 	// Make sure the q starts empty
-	c := cache.NewCache(cacheFile, "localhost:5001")
-	a := auto.NewAQEngine(autoqTestfile, c, 0, 1, 0)
-	q := NewQueue(a, c, false, "localhost:5001")
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", store)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	q := NewQueue(database, a, c, CommunityMode, 0, store)
 	if q.IsEmpty() == false {
 		t.Errorf("Queue didn't start empty. isEmpty was false.\n")
 		return
@@ -109,17 +108,14 @@ func TestIsEmpty(t *testing.T) {
 		t.Errorf("Queue still reporting empty after enqueue.\n")
 		return
 	}
-
-	cleanup(autoqTestfile)
-	cleanup(cacheFile)
 }
 
 func TestDump(t *testing.T) {
-	autoqTestfile := "autoqTestDump.test"
 	// Make sure the q starts empty
-	c := cache.NewCache(cacheFile, "localhost:5001")
-	a := auto.NewAQEngine(autoqTestfile, c, 0, 1, 0)
-	q := NewQueue(a, c, false, "localhost:5001")
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", store)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	q := NewQueue(database, a, c, CommunityMode, 0, store)
 
 	q.PlayNext(testSongB)
 	q.PlayNext(testSongB)
@@ -132,17 +128,14 @@ func TestDump(t *testing.T) {
 		t.Errorf("Queue not reporting empty after dump.\n")
 		return
 	}
-
-	cleanup(autoqTestfile)
-	cleanup(cacheFile)
 }
 
 func TestGetQueue(t *testing.T) {
-	autoqTestfile := "autoqTestGetQueue.test"
 	// Make sure the q starts empty
-	c := cache.NewCache(cacheFile, "localhost:5001")
-	a := auto.NewAQEngine(autoqTestfile, c, 0, 1, 0)
-	q := NewQueue(a, c, false, "localhost:5001")
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", store)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	q := NewQueue(database, a, c, CommunityMode, 0, store)
 
 	q.PlayNext(testSongA)
 	q.PlayNext(testSongA)
@@ -151,11 +144,315 @@ func TestGetQueue(t *testing.T) {
 
 	songs := q.GetQueue()
 
-	if songs[0].ResourceID() != "/ipfs/QmQmjmsqhvTNsvZGrwBMhGEX5THCoWs2GWjszJ48tnr3Uf" {
+	if songs[0].ResourceID() != testSongA.ResourceID() {
 		t.Errorf("GetQueue didn't give us the song we put in. Output: %v\n", songs[0])
 		return
 	}
+}
+
+func TestPersist(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", store)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	q := NewQueue(database, a, c, CommunityMode, 0, store)
+
+	q.AddToQueue(testSongA)
+	q.AddToQueue(testSongB)
+
+	// A fresh queue on the same database should come back in the same order
+	q = NewQueue(database, a, c, CommunityMode, 0, store)
+	songs := q.GetQueue()
+	if len(songs) != 2 {
+		t.Errorf("Queue didn't persist. Expected 2 songs, found %d\n", len(songs))
+		return
+	}
+	if songs[0].IpfsPath() != testSongA.IpfsPath() || songs[1].IpfsPath() != testSongB.IpfsPath() {
+		t.Errorf("Queue order changed after persisting. Output: %v\n", songs)
+	}
+}
+
+// storedQueue reads what the queue saved to the database
+func storedQueue(database *db.DB) map[string]string {
+	stored := make(map[string]string)
+	database.ForEach(db.QueueBucket, func(key string, value []byte) error {
+		stored[key] = string(value)
+		return nil
+	})
+	return stored
+}
+
+func TestPersistIncremental(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", store)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	q := NewQueue(database, a, c, CommunityMode, 0, store)
+
+	q.AddToQueue(testSongA)
+	q.AddToQueue(testSongB)
+	before := storedQueue(database)
+
+	// Songs already queued keep their entries when others are added or moved
+	q.PlayNext(testSongC)
+	q.Move(2, 1)
+	after := storedQueue(database)
+	for key, value := range before {
+		if key != orderKey && after[key] != value {
+			t.Errorf("Entry %s was rewritten. Before: %s, after: %s\n", key, value, after[key])
+		}
+	}
+	if len(after) != len(before)+1 {
+		t.Errorf("Expected one new entry, went from %d to %d\n", len(before), len(after))
+	}
+
+	q = NewQueue(database, a, c, CommunityMode, 0, store)
+	songs := q.GetQueue()
+	if len(songs) != 3 || songs[0].IpfsPath() != testSongC.IpfsPath() ||
+		songs[1].IpfsPath() != testSongB.IpfsPath() || songs[2].IpfsPath() != testSongA.IpfsPath() {
+		t.Errorf("Queue order changed after persisting. Output: %v\n", songs)
+	}
+}
+
+func TestPersistConcurrent(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", store)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	q := NewQueue(database, a, c, CommunityMode, 0, store)
+
+	wg := &sync.WaitGroup{}
+	for idx := 0; idx < 20; idx++ {
+		blobPath, _ := store.Put(strings.NewReader(fmt.Sprintf("concurrent song %d", idx)))
+		song, _ := resource.NewSong(blobPath)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			q.AddToQueue(song)
+		}()
+		go func() {
+			defer wg.Done()
+			if q.Length() > 0 {
+				q.Pop()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Whatever order the saves happened in, the last one has to match the queue
+	queued := q.GetQueue()
+	songs := NewQueue(database, a, c, CommunityMode, 0, store).GetQueue()
+	if len(songs) != len(queued) {
+		t.Errorf("Saved queue has %d songs, queue has %d\n", len(songs), len(queued))
+		return
+	}
+	for idx := range songs {
+		if songs[idx].IpfsPath() != queued[idx].IpfsPath() {
+			t.Errorf("Saved queue differs at %d. Saved: %s, queued: %s\n", idx, songs[idx].IpfsPath(), queued[idx].IpfsPath())
+		}
+	}
+}
+
+func newTestQueue(t *testing.T) *Queue {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", store)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	return NewQueue(database, a, c, CommunityMode, 0, store)
+}
+
+func TestRemove(t *testing.T) {
+	q := newTestQueue(t)
+	q.AddToQueue(testSongA)
+	q.AddToQueue(testSongB)
+	q.AddToQueue(testSongC)
+
+	song, err := q.Remove(1)
+	if err != nil || song != testSongB {
+		t.Errorf("Remove didn't take out the song at position 1. Song: %v, Err: %v\n", song, err)
+		return
+	}
+	if _, err = q.Remove(5); err == nil {
+		t.Errorf("Removing outside the queue should give an error\n")
+	}
+
+	song, err = q.RemoveByID(testSongC.ResourceID())
+	if err != nil || song != testSongC {
+		t.Errorf("RemoveByID didn't take out the matching song. Song: %v, Err: %v\n", song, err)
+		return
+	}
+
+	songs := q.GetQueue()
+	if len(songs) != 1 || songs[0] != testSongA {
+		t.Errorf("Queue should only have song A left. Output: %v\n", songs)
+	}
+}
+
+func TestMove(t *testing.T) {
+	q := newTestQueue(t)
+	q.AddToQueue(testSongA)
+	q.AddToQueue(testSongB)
+	q.AddToQueue(testSongC)
+
+	if err := q.Move(2, 0); err != nil {
+		t.Errorf("Failed to move song. Err: %v\n", err)
+		return
+	}
+	songs := q.GetQueue()
+	if songs[0] != testSongC || songs[1] != testSongA || songs[2] != testSongB {
+		t.Errorf("Queue isn't in the expected order after move. Output: %v\n", songs)
+	}
+
+	if err := q.Move(0, 3); err == nil {
+		t.Errorf("Moving outside the queue should give an error\n")
+	}
+}
+
+func TestRequeueLast(t *testing.T) {
+	q := newTestQueue(t)
+	if _, err := q.RequeueLast("foo"); err == nil {
+		t.Errorf("Requeueing before anything played should give an error\n")
+	}
+
+	q.AddToQueue(testSongA)
+	song, _, _, _ := q.Pop()
+	q.NotifyDone(song.IpfsPath(), true)
+
+	if _, err := q.RequeueLast("foo"); err != nil {
+		t.Errorf("Failed to requeue last song. Err: %v\n", err)
+		return
+	}
+	songs := q.GetQueue()
+	if len(songs) != 1 || songs[0].ResourceID() != testSongA.ResourceID() {
+		t.Errorf("Last played song wasn't requeued. Output: %v\n", songs)
+		return
+	}
+	if songs[0].QueuedBy != "foo" {
+		t.Errorf("Requeued song should be attributed to who requeued it. QueuedBy: %s\n", songs[0].QueuedBy)
+	}
+}
+
+func TestModes(t *testing.T) {
+	q := newTestQueue(t)
+	if !q.CanControl("") {
+		t.Errorf("Anyone should be able to control the queue in community mode\n")
+	}
+	if err := q.ClaimDJ("foo"); err == nil {
+		t.Errorf("Shouldn't be able to claim DJ outside of DJ mode\n")
+	}
+
+	q.SetMode(HybridMode)
+	if !q.AutoqEnabled {
+		t.Errorf("Autoq should be on in hybrid mode\n")
+	}
+
+	q.SetMode(DJMode)
+	if q.AutoqEnabled {
+		t.Errorf("Autoq should be off in DJ mode\n")
+	}
+	if err := q.ClaimDJ("foo"); err != nil {
+		t.Errorf("Failed to claim DJ. Err: %v\n", err)
+		return
+	}
+	if err := q.ClaimDJ("bar"); err == nil {
+		t.Errorf("Shouldn't be able to claim DJ while someone else has it\n")
+	}
+	if !q.CanControl("foo") || q.CanControl("bar") {
+		t.Errorf("Only the DJ should be able to control the queue in DJ mode\n")
+	}
 
-	cleanup(autoqTestfile)
-	cleanup(cacheFile)
+	if err := q.ReleaseDJ("bar"); err == nil {
+		t.Errorf("Only the DJ should be able to release it\n")
+	}
+	q.ReleaseDJ("foo")
+	if q.DJ() != "" || q.CanControl("foo") {
+		t.Errorf("Nobody should be DJ after releasing\n")
+	}
+}
+
+func TestLookahead(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", store)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	// Teach the autoq a cycle of a, b, c
+	for i := 0; i < 3; i++ {
+		a.NotifyPlayed(testSongA.IpfsPath(), true)
+		a.NotifyPlayed(testSongB.IpfsPath(), true)
+		a.NotifyPlayed(testSongC.IpfsPath(), true)
+	}
+	q := NewQueue(database, a, c, HybridMode, 2, store)
+	q.fillLookahead(2)
+
+	// Having just heard c, the autoq should plan a then b
+	upcoming := q.GetQueue()
+	if len(upcoming) != 2 || !upcoming[0].AutoPick {
+		t.Errorf("Expected 2 auto picks to be upcoming, got %v\n", upcoming)
+		return
+	}
+	if upcoming[0].IpfsPath() != testSongA.IpfsPath() || upcoming[1].IpfsPath() != testSongB.IpfsPath() {
+		t.Errorf("Picks didn't follow the chain: %s, %s\n", upcoming[0].IpfsPath(), upcoming[1].IpfsPath())
+	}
+
+	// Songs in the fifo come before the picks
+	q.AddToQueue(testSongC)
+	if upcoming = q.GetQueue(); len(upcoming) != 3 || upcoming[0].AutoPick {
+		t.Errorf("Queued songs should come before the picks, got %v\n", upcoming)
+	}
+	q.Pop()
+
+	if _, err := q.Veto(testSongA.IpfsPath()); err != nil {
+		t.Errorf("Failed to veto a pick. Err: %v\n", err)
+	}
+	if _, err := q.Veto(testSongA.IpfsPath()); err == nil {
+		t.Errorf("Vetoing a song that isn't picked should fail\n")
+	}
+	q.fillLookahead(2)
+	for _, song := range q.GetQueue() {
+		if song.IpfsPath() == testSongA.IpfsPath() {
+			t.Errorf("Vetoed song was picked again\n")
+		}
+	}
+
+	// Picks are read out of the store once popped
+	song, reader, isEmpty, fromAuto := q.Pop()
+	if isEmpty || !fromAuto || reader == nil {
+		t.Errorf("Expected a ready auto pick, got %v (empty: %v, auto: %v)\n", song, isEmpty, fromAuto)
+		return
+	}
+	reader.Close()
+
+	q.SetMode(CommunityMode)
+	if upcoming = q.GetQueue(); len(upcoming) != 0 {
+		t.Errorf("Leaving hybrid mode should drop the picks, got %v\n", upcoming)
+	}
+}
+
+func TestLookaheadBlacklist(t *testing.T) {
+	database := db.OpenTemp(t)
+	c := cache.NewCache(database, "", store)
+	a := auto.NewAQEngine(database, "", c, 0, 1, 0)
+	for i := 0; i < 3; i++ {
+		a.NotifyPlayed(testSongA.IpfsPath(), true)
+		a.NotifyPlayed(testSongB.IpfsPath(), true)
+		a.NotifyPlayed(testSongC.IpfsPath(), true)
+	}
+	q := NewQueue(database, a, c, HybridMode, 2, store)
+	q.fillLookahead(2)
+	q.lock.Lock()
+	q.vetoed[testSongC.IpfsPath()] = true
+	q.lock.Unlock()
+
+	// a was picked before it was blacklisted, it still shouldn't play
+	a.Blacklist(testSongA.IpfsPath())
+	song, reader, _, _ := q.Pop()
+	if song == nil || song.IpfsPath() != testSongB.IpfsPath() {
+		t.Errorf("Expected the pick after the blacklisted one to play, got %v\n", song)
+		return
+	}
+	if reader != nil {
+		reader.Close()
+	}
+
+	q.lock.Lock()
+	vetoes := len(q.vetoed)
+	q.lock.Unlock()
+	if vetoes != 0 {
+		t.Errorf("Vetoes should be let go once a pick plays, %d left\n", vetoes)
+	}
 }
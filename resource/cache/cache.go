@@ -5,86 +5,164 @@ package cache
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
 
+	"github.com/VivaLaPanda/uta-stream/db"
 	"github.com/VivaLaPanda/uta-stream/resource"
 	"github.com/VivaLaPanda/uta-stream/resource/download"
-	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
 )
 
 // Cache is a struct which tracks the necessary state to translate
-// resourceIDs into resolveable ipfs hashes or readers
+// resourceIDs into resolveable blob paths or readers
 type Cache struct {
-	songMap       *map[string]*resource.Song
-	ipfs          *shell.Shell
-	cacheFilename string
+	songMap *map[string]*resource.Song
+	lock    *sync.RWMutex
+	store   storage.BlobStore
+	db      *db.DB
 }
 
 // Function which will provide a new cache struct
-// An cache must be provided a file that it can read/write it's data to
-// so that the cache is preserved between launches. The ipfsurl will determine
-// the daemon used to store/fetch ipfs resources. Allows for decoupling the storage
-// engine from the cache.
-func NewCache(cacheFilename string, ipfsUrl string) *Cache {
+// The cache is kept in the provided database so that it is preserved between
+// launches. If cacheFilename points at a cache file from before the database
+// it will be imported once. The store will determine where downloaded resources
+// are kept/fetched from. Allows for decoupling the storage engine from the cache.
+func NewCache(database *db.DB, cacheFilename string, store storage.BlobStore) *Cache {
 	songMap := make(map[string]*resource.Song)
 	c := &Cache{
-		songMap:       &songMap,
-		ipfs:          shell.NewShell(ipfsUrl),
-		cacheFilename: cacheFilename,
+		songMap: &songMap,
+		lock:    &sync.RWMutex{},
+		store:   store,
+		db:      database,
 	}
 
 	// Confirm we can interact with our persitent storage
-	_, err := os.Stat(cacheFilename)
+	err := database.Migrate(db.CacheBucket, cacheFilename, c.Load)
 	if err == nil {
-		err = c.Load(cacheFilename)
-	} else if os.IsNotExist(err) {
-		log.Printf("cacheFilename %s doesn't exist. Creating new cacheFilename", cacheFilename)
-		err = c.Write(cacheFilename)
+		err = c.loadDB()
 	}
 
 	if err != nil {
-		errString := fmt.Sprintf("Fatal error when interacting with cacheFilename on launch.\nErr: %v\n", err)
+		errString := fmt.Sprintf("Fatal error when interacting with the cache database on launch.\nErr: %v\n", err)
 		panic(errString)
 	}
 
 	return c
 }
 
-// Method which will write the cache data to the provided file. Will overwrite
-// a file if one already exists at that location.
-func (c *Cache) Write(filename string) error {
-	cacheFilename, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0660)
+// Method which will load the provided cache data file and save it into the
+// database. Will overwrite the internal state of the object. Should pretty much
+// only be used to import the flat file from before the database existed
+func (c *Cache) Load(filename string) error {
+	file, err := os.OpenFile(filename, os.O_RDONLY, 0660)
 	if err != nil {
 		return err
 	}
-	defer cacheFilename.Close()
+	defer file.Close()
 
-	encoder := json.NewEncoder(cacheFilename)
-	encoder.Encode(c.songMap)
+	decoder := json.NewDecoder(file)
+	c.lock.Lock()
+	err = decoder.Decode(c.songMap)
+	c.lock.Unlock()
+	if err != nil {
+		return err
+	}
 
-	return nil
+	entries := make(map[string][]byte)
+	c.lock.RLock()
+	for url, song := range *c.songMap {
+		if entries[url], err = song.MarshalJSON(); err != nil {
+			break
+		}
+	}
+	c.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return c.db.Replace(db.CacheBucket, entries)
 }
 
-// Method which will load the provided cache data file. Will overwrite the internal
-// state of the object. Should pretty much only be used when the object is created
-// but it is left public in case a client needs to load old data or something
-func (c *Cache) Load(filename string) error {
-	file, err := os.OpenFile(filename, os.O_RDONLY, 0660)
+// loadDB reads every cached song out of the database
+func (c *Cache) loadDB() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.db.ForEach(db.CacheBucket, func(url string, value []byte) error {
+		song := &resource.Song{}
+		if err := song.UnmarshalJSON(value); err != nil {
+			return fmt.Errorf("failed to parse cached song %s. Err: %v", url, err)
+		}
+		(*c.songMap)[url] = song
+		return nil
+	})
+}
+
+// put records the song under the url, both in memory and in the database
+func (c *Cache) put(url string, song *resource.Song) error {
+	c.lock.Lock()
+	(*c.songMap)[url] = song
+	c.lock.Unlock()
+
+	songData, err := song.MarshalJSON()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	return c.db.Put(db.CacheBucket, url, songData)
+}
 
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(c.songMap)
+// Put records the song under the resource ID, for songs that get into the
+// store some way other than being downloaded
+func (c *Cache) Put(resourceID string, song *resource.Song) error {
+	url, err := urlNormalize(resourceID)
+	if err != nil {
+		return err
+	}
+	return c.put(url, song)
+}
+
+// Delete forgets the song cached under the resource ID. Its audio stays in
+// the store.
+func (c *Cache) Delete(resourceID string) error {
+	url, err := urlNormalize(resourceID)
+	if err != nil {
+		return err
+	}
 
-	return err
+	c.lock.Lock()
+	delete(*c.songMap, url)
+	c.lock.Unlock()
+	return c.db.Delete(db.CacheBucket, url)
+}
+
+// Upload stores an uploaded audio file and caches it under its blob path,
+// which is the song's resource ID from then on. A title or artist overrides
+// what the file's tags say.
+func (c *Cache) Upload(file io.Reader, filename string, title string, artist string) (*resource.Song, error) {
+	song, err := download.Upload(file, filename, c.store)
+	if err != nil {
+		return nil, err
+	}
+	if title != "" {
+		song.Title = title
+	}
+	if artist != "" {
+		song.Artist = artist
+	}
+
+	if err = c.put(song.IpfsPath(), song); err != nil {
+		return nil, fmt.Errorf("failed to add upload to the cache. Err: %v", err)
+	}
+	return song, nil
 }
 
 // UrlCacheLookup will check the cache for the provided url, but on a cache miss
-// it will download the resource and add it to the cache, then return the hash
+// it will download the resource and add it to the cache, then return the song
 func (c *Cache) Lookup(resourceID string) (song *resource.Song, err error) {
 	// normalize and create default song to store data in
 	resourceID, err = urlNormalize(resourceID)
@@ -96,18 +174,22 @@ func (c *Cache) Lookup(resourceID string) (song *resource.Song, err error) {
 		return nil, err
 	}
 
-	if !resource.IsIpfs(resourceID) {
+	if !storage.IsBlobPath(resourceID) {
 		url := resourceID
 		// Check the cache for the provided URL
+		c.lock.RLock()
 		cachedSong, exists := (*c.songMap)[url]
+		c.lock.RUnlock()
 
 		if !exists {
-			return c.handleUncachedUrl(song, url, c.ipfs)
+			return c.handleUncachedUrl(song, url)
 		} else {
 			song = cachedSong
 		}
 	} else {
 		// Search for the song
+		c.lock.RLock()
+		defer c.lock.RUnlock()
 		for _, value := range *c.songMap {
 			if song.IpfsPath() == value.IpfsPath() {
 				return value, nil
@@ -118,20 +200,35 @@ func (c *Cache) Lookup(resourceID string) (song *resource.Song, err error) {
 	return song, nil
 }
 
-func (c *Cache) handleUncachedUrl(song *resource.Song, url string, ipfs *shell.Shell) (*resource.Song, error) {
-	song, err := download.Download(song, ipfs)
+// Queued gives a copy of a song from the cache to put in the queue, queued by
+// the named user. The cache hands the same song to everyone that looks it up,
+// so anything only true of one spot in the queue (who queued it, whether the
+// autoq picked it) has to go on a copy, or it would show up everywhere else
+// the song does.
+func (c *Cache) Queued(song *resource.Song, queuedBy string) *resource.Song {
+	song = song.Copy()
+	song.QueuedBy = queuedBy
+	return song
+}
+
+func (c *Cache) handleUncachedUrl(song *resource.Song, url string) (*resource.Song, error) {
+	song, err := download.Download(song, c.store)
 	if err != nil {
 		return song, err
 	}
 
 	// Cache the song once we've resolved it into a playable resource
 	go func() {
-		_, err := song.Resolve(ipfs)
+		reader, err := song.Resolve(c.store)
+		if err == nil {
+			reader.Close()
+		}
 
-		// Double check we have an ipfs path registered
+		// Double check we have a blob path registered
 		if err == nil && song.IpfsPath() != "" {
-			(*c.songMap)[url] = song
-			c.Write(c.cacheFilename)
+			if err = c.put(url, song); err != nil {
+				log.Printf("Failed to save %s to the cache. Err: %v\n", url, err)
+			}
 		}
 	}()
 
@@ -140,7 +237,7 @@ func (c *Cache) handleUncachedUrl(song *resource.Song, url string, ipfs *shell.S
 
 // Try and normalize URLs to reduce duplication in resource cache
 func urlNormalize(rawUrl string) (normalizedUrl string, err error) {
-	if resource.IsIpfs(rawUrl) {
+	if storage.IsBlobPath(rawUrl) {
 		return rawUrl, nil
 	}
 
@@ -149,11 +246,21 @@ func urlNormalize(rawUrl string) (normalizedUrl string, err error) {
 		return "", err
 	}
 
+	// Sites with rules of their own
+	for _, rule := range siteNormalizers {
+		if rule.applies(parsedUrl.Hostname()) {
+			return rule.normalize(parsedUrl), nil
+		}
+	}
+
 	// Handle Youtube URLs
-	if parsedUrl.Hostname() == "youtube.com" || parsedUrl.Hostname() == "www.youtube.com" {
+	if parsedUrl.Hostname() == "youtube.com" || parsedUrl.Hostname() == "www.youtube.com" ||
+		parsedUrl.Hostname() == "m.youtube.com" || parsedUrl.Hostname() == "music.youtube.com" {
 		vidID := parsedUrl.Query().Get("v")
 		normalizedUrl = fmt.Sprintf("https://youtu.be/%s", vidID)
-	} else { // Youtube url is short
+	} else if parsedUrl.Hostname() == "youtu.be" {
+		normalizedUrl = fmt.Sprintf("https://youtu.be/%s", strings.TrimPrefix(parsedUrl.Path, "/"))
+	} else {
 		values := parsedUrl.Query()
 		values.Del("list")
 		parsedUrl.RawQuery = values.Encode()
@@ -162,3 +269,41 @@ func urlNormalize(rawUrl string) (normalizedUrl string, err error) {
 
 	return normalizedUrl, nil
 }
+
+// siteNormalizer boils a site's URLs for the same track down to one. The
+// query and fragment only ever carry tracking and playlist context on these
+// sites, so they're dropped.
+type siteNormalizer struct {
+	domain    string
+	hosts     []string // only these hosts on the domain, any of them if empty
+	normalize func(parsedUrl *url.URL) string
+}
+
+// applies reports whether the rule is for urls on the host
+func (rule siteNormalizer) applies(hostname string) bool {
+	if len(rule.hosts) == 0 {
+		return download.OnDomain(hostname, rule.domain)
+	}
+	for _, host := range rule.hosts {
+		if strings.EqualFold(hostname, host) {
+			return true
+		}
+	}
+	return false
+}
+
+var siteNormalizers = []siteNormalizer{
+	// soundcloud.com/<artist>/<track>, the mobile site has the same paths.
+	// Short links (on.soundcloud.com/<id>) are left for yt-dlp to follow.
+	{"soundcloud.com", []string{"soundcloud.com", "www.soundcloud.com", "m.soundcloud.com"}, func(parsedUrl *url.URL) string {
+		return "https://soundcloud.com" + strings.TrimSuffix(parsedUrl.Path, "/")
+	}},
+	// <artist>.bandcamp.com/track/<track>
+	{"bandcamp.com", nil, func(parsedUrl *url.URL) string {
+		return "https://" + strings.ToLower(parsedUrl.Hostname()) + strings.TrimSuffix(parsedUrl.Path, "/")
+	}},
+	// vimeo.com/<id>, embeds are player.vimeo.com/video/<id>
+	{"vimeo.com", nil, func(parsedUrl *url.URL) string {
+		return "https://vimeo.com" + strings.TrimPrefix(strings.TrimSuffix(parsedUrl.Path, "/"), "/video")
+	}},
+}
@@ -1,67 +1,69 @@
 package cache
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/VivaLaPanda/uta-stream/db"
 	"github.com/VivaLaPanda/uta-stream/resource"
-	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
 )
 
-func cleanupCache(cacheTestfile string) {
-	_, err := os.Stat(cacheTestfile)
-	if err == nil {
-		err := os.Remove(cacheTestfile)
-		if err != nil {
-			panic("Test cleanup failed")
-		}
+func newTestStore(t *testing.T) storage.BlobStore {
+	store, err := storage.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create test store. Err: %v\n", err)
 	}
+	return store
 }
 
 func TestWrite(t *testing.T) {
-	// Ensure the file isn't already there.
-	cacheTestfile := "cache.db.test"
-	cleanupCache(cacheTestfile)
-	c := NewCache(cacheTestfile, "localhost:5001")
-	_, err := os.Stat(cacheTestfile)
-	if err != nil {
-		t.Errorf("Failed to stat cacheFile after initing cache. Err: %v\n", err)
+	testIpfsPath := "/ipfs/QmQmjmsqhvTNsvZGrwBMhGEX5THCoWs2GWjszJ48tnr3Uf"
+	database := db.OpenTemp(t)
+	store := newTestStore(t)
+	c := NewCache(database, "", store)
+
+	testSong, _ := resource.NewSong(testIpfsPath)
+	if err := c.put("foo", testSong); err != nil {
+		t.Errorf("Failed to write to the cache. Err: %v\n", err)
+		return
 	}
 
-	// Try writing again
-	err = c.Write(cacheTestfile)
-	if err != nil {
-		t.Errorf("Failed to write after launching. Err: %v\n", err)
+	// A fresh cache on the same database should see the song
+	c = NewCache(database, "", store)
+	storedSong, exists := (*c.songMap)["foo"]
+	if !exists {
+		t.Errorf("Value we stored didn't load properly\n")
+		return
+	}
+	if storedSong.IpfsPath() != testIpfsPath {
+		t.Errorf("Value changed after store and load. e: %v, a: %v\n", testIpfsPath, storedSong.IpfsPath())
 	}
 }
 
 func TestLoad(t *testing.T) {
 	testIpfsPath := "/ipfs/QmQmjmsqhvTNsvZGrwBMhGEX5THCoWs2GWjszJ48tnr3Uf"
-	// Ensure the file isn't already there.
-	cacheTestfile := "cache.db.test"
-	cleanupCache(cacheTestfile)
-	c := NewCache(cacheTestfile, "localhost:5001")
-	_, err := os.Stat(cacheTestfile)
-	if err != nil {
-		t.Errorf("Failed to stat cacheFile after initing cache. Err: %v\n", err)
+	// Write out a cache file the way it used to be stored
+	cacheTestfile := filepath.Join(t.TempDir(), "cache.db")
+	legacyData := fmt.Sprintf(`{"foo":{"ipfsPath":"%s","url":"https://youtu.be/nAwTw1aYy6M","title":"Foo","duration":0}}`, testIpfsPath)
+	if err := ioutil.WriteFile(cacheTestfile, []byte(legacyData), 0660); err != nil {
+		t.Errorf("Failed to write legacy cacheFile. Err: %v\n", err)
 		return
 	}
 
-	// Now try to load
-	err = c.Load(cacheTestfile)
-	if err != nil {
-		t.Errorf("Failed to load cacheFile. Err: %v\n", err)
-		return
+	// Now try to import it
+	database := db.OpenTemp(t)
+	NewCache(database, cacheTestfile, newTestStore(t))
+	if _, err := os.Stat(cacheTestfile); !os.IsNotExist(err) {
+		t.Errorf("cacheFile should have been moved aside after import\n")
 	}
 
-	testSong, _ := resource.NewSong(testIpfsPath)
-	(*c.songMap)["foo"] = testSong
-
-	// Try write and loading
-	c.Write(cacheTestfile)
-	c.Load(cacheTestfile)
-
+	// The import should have made it into the database
+	c := NewCache(database, "", newTestStore(t))
 	storedSong, exists := (*c.songMap)["foo"]
 	if !exists {
 		t.Errorf("Value we stored didn't load properly\n")
@@ -80,6 +82,15 @@ func TestUrlNormalize(t *testing.T) {
 		{"https://youtu.be/nAwTw1aYy6M", "https://youtu.be/nAwTw1aYy6M"},
 		{"https://www.youtube.com/watch?v=JLpJPzKy6fY&feature=youtu.be", "https://youtu.be/JLpJPzKy6fY"},
 		{"http://youtube.com/watch?v=JLpJPzKy6fY", "https://youtu.be/JLpJPzKy6fY"},
+		{"https://music.youtube.com/watch?v=JLpJPzKy6fY&list=RDAMVM", "https://youtu.be/JLpJPzKy6fY"},
+		{"https://youtu.be/JLpJPzKy6fY?si=tracking", "https://youtu.be/JLpJPzKy6fY"},
+		{"https://m.soundcloud.com/artist/track?in=artist/sets/album", "https://soundcloud.com/artist/track"},
+		{"http://soundcloud.com/artist/track/?utm_source=clipboard", "https://soundcloud.com/artist/track"},
+		{"https://on.soundcloud.com/AbC123", "https://on.soundcloud.com/AbC123"},
+		{"https://Artist.bandcamp.com/track/song-name?from=embed", "https://artist.bandcamp.com/track/song-name"},
+		{"https://player.vimeo.com/video/76979871?h=abc", "https://vimeo.com/76979871"},
+		{"https://vimeo.com/76979871#t=30s", "https://vimeo.com/76979871"},
+		{"https://example.com/song.mp3?list=abc", "https://example.com/song.mp3"},
 	}
 
 	for _, test := range testTable {
@@ -92,32 +103,30 @@ func TestUrlNormalize(t *testing.T) {
 
 func TestLookup(t *testing.T) {
 	testUrl := "https://youtu.be/nAwTw1aYy6M"
-	testIpfsPath := "/ipfs/QmQmjmsqhvTNsvZGrwBMhGEX5THCoWs2GWjszJ48tnr3Uf"
-	ipfsUrl := "localhost:5001"
-	cacheTestfile := "cache.db.test"
-	cleanupCache(cacheTestfile)
-	c := NewCache(cacheTestfile, "localhost:5001")
-	ipfs := shell.NewShell(ipfsUrl)
+	store := newTestStore(t)
+	c := NewCache(db.OpenTemp(t), "", store)
 
-	// Lookup the url, the result shouldn't be able to find the IPFS url right away
+	// Lookup the url, the result shouldn't be able to find the blob path right away
 	song, _ := c.Lookup(testUrl)
 	if resourceID := song.ResourceID(); resourceID != testUrl {
 		t.Errorf("cache lookup resulted in incorrect resourceID")
 	}
 
 	// Block until we're done with the DL
-	_, _ = song.Resolve(ipfs)
+	_, _ = song.Resolve(store)
+	testBlobPath := song.IpfsPath()
+	if !store.Has(testBlobPath) {
+		t.Errorf("download didn't end up in the store")
+	}
 	// Avodiing tiny race condition where cache lookup right after resolve might fail
 	time.Sleep(500 * time.Millisecond)
 	song, _ = c.Lookup(testUrl)
-	if resourceID := song.ResourceID(); resourceID != testIpfsPath {
+	if resourceID := song.ResourceID(); resourceID != testBlobPath {
 		t.Errorf("cache didn't find url even after it should have stored")
 	}
 
-	song, _ = c.Lookup(testIpfsPath)
-	if resourceID := song.ResourceID(); resourceID != testIpfsPath {
+	song, _ = c.Lookup(testBlobPath)
+	if resourceID := song.ResourceID(); resourceID != testBlobPath {
 		t.Errorf("cache lookup resulted in incorrect resourceID")
 	}
-
-	c.Write(cacheTestfile)
 }
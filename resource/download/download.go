@@ -3,6 +3,8 @@
 package download
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"log"
@@ -12,15 +14,17 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/VivaLaPanda/uta-stream/events"
 	"github.com/VivaLaPanda/uta-stream/resource"
-	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
+	"github.com/VivaLaPanda/uta-stream/resource/tags"
 )
 
-var knownProviders = [...]string{"youtube.com", "youtu.be"}
 var youtubeHosts = map[string]bool{
 	"youtu.be":          true,
 	"youtube.com":       true,
@@ -28,37 +32,103 @@ var youtubeHosts = map[string]bool{
 	"m.youtube.com":     true,
 	"music.youtube.com": true,
 }
+
+// Sites besides YouTube that are downloaded through yt-dlp. Subdomains are
+// included, so bandcamp.com covers every artist's page. Change with
+// SetYtDlpHosts.
+var ytDlpHosts = []string{"soundcloud.com", "bandcamp.com", "vimeo.com"}
 var tempDLFolder = "TEMP-DL"
 var maxYTDownloaders = make(chan int, 3)
 
+// siteMeta is how to get a song's details out of yt-dlp for a site. Each is a
+// yt-dlp output template, commas give fields to fall back on.
+type siteMeta struct {
+	title  string
+	artist string
+}
+
+// Sites keep the artist in different places, and some have a track name
+// that's cleaner than the title of the page
+var (
+	youtubeMeta = siteMeta{title: "%(title)s", artist: "%(artist,creator,uploader)s"}
+	genericMeta = siteMeta{title: "%(track,title)s", artist: "%(artist,uploader)s"}
+	siteMetas   = map[string]siteMeta{
+		"soundcloud.com": {title: "%(title)s", artist: "%(uploader)s"},
+		"bandcamp.com":   {title: "%(track,title)s", artist: "%(artist,uploader)s"},
+		"vimeo.com":      {title: "%(title)s", artist: "%(uploader)s"},
+	}
+)
+
 // cookiesFile is resolved relative to the process working directory
 // (the systemd unit sets WorkingDirectory to the uta-stream dir).
 var cookiesFile = "cookies.txt"
 
+// SetYtDlpHosts replaces the sites besides YouTube that are downloaded
+// through yt-dlp. Subdomains of each host are included.
+func SetYtDlpHosts(hosts []string) {
+	ytDlpHosts = hosts
+}
+
+// OnDomain reports whether the hostname is the domain or one of its subdomains
+func OnDomain(hostname string, domain string) bool {
+	hostname, domain = strings.ToLower(hostname), strings.ToLower(domain)
+	return hostname == domain || strings.HasSuffix(hostname, "."+domain)
+}
+
+// ytDlpSite finds which of the yt-dlp hosts the hostname belongs to
+func ytDlpSite(hostname string) (site string, found bool) {
+	for _, host := range ytDlpHosts {
+		if OnDomain(hostname, host) {
+			return host, true
+		}
+	}
+	return "", false
+}
+
+// metaFor gives how to get a song's details from the site
+func metaFor(site string) siteMeta {
+	for domain, meta := range siteMetas {
+		if OnDomain(site, domain) {
+			return meta
+		}
+	}
+	return genericMeta
+}
+
 // Master download router. Looks at the url and determins which service needs
 // to hand the url. hotWriter is used to allow for playing the audio
 // without waiting for the DL to finish. If you pass a writer the data will be
 // pushed into that reader at the same time it's written to disk. I recommend
 // a buffered reader, as I'm using TeeReader which works best with buffers
-func Download(song *resource.Song, ipfs *shell.Shell) (*resource.Song, error) {
+// Once downloaded the audio is put into the provided store and the song resolved
+// with the resulting path.
+func Download(song *resource.Song, store storage.BlobStore) (*resource.Song, error) {
 	// Ensure the temporary directory for storing downloads exists
 	if _, err := os.Stat(tempDLFolder); os.IsNotExist(err) {
 		os.Mkdir(tempDLFolder, os.ModePerm)
 	}
 
+	// Local files only get in through the library, never by asking for them
+	if song.URL().Scheme == "file" {
+		return song, fmt.Errorf("%s isn't in the library", song.URL())
+	}
+
 	// Route to different handlers based on hostname
 	if youtubeHosts[song.URL().Hostname()] {
-		return downloadYoutube(song, ipfs)
+		return downloadYoutube(song, store)
+	}
+	if site, found := ytDlpSite(song.URL().Hostname()); found {
+		return downloadYtDlp(song, store, metaFor(site))
 	}
 
 	// Get the ext
 	ext := path.Ext(song.URL().Path)
 	if ext == ".mp3" || ext == ".flac" {
-		return downloadMp3(song, ipfs)
+		return downloadMp3(song, store)
 	}
 
 	return song, fmt.Errorf("URL hostname (%v) doesn't match a known provider. "+
-		"Should be one of: %v", song.URL().Hostname(), knownProviders)
+		"Should be one of: %v", song.URL().Hostname(), append([]string{"youtube.com", "youtu.be"}, ytDlpHosts...))
 }
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -71,7 +141,7 @@ func randSeq(n int) string {
 	return string(b)
 }
 
-func downloadMp3(song *resource.Song, ipfs *shell.Shell) (*resource.Song, error) {
+func downloadMp3(song *resource.Song, store storage.BlobStore) (*resource.Song, error) {
 	// Get the filename from the web
 	webPath := song.URL().Path
 	filename := path.Base(webPath)
@@ -113,7 +183,7 @@ func downloadMp3(song *resource.Song, ipfs *shell.Shell) (*resource.Song, error)
 		}
 		defer resp.Body.Close()
 
-		io.Copy(input, resp.Body)
+		io.Copy(input, newProgressReader(resp.Body, song.URL().String(), resp.ContentLength))
 		defer input.Close()
 
 		log.Printf("Downloading of %v complete\n", song.URL().String())
@@ -130,7 +200,7 @@ func downloadMp3(song *resource.Song, ipfs *shell.Shell) (*resource.Song, error)
 		mp3File.Close()
 	}()
 
-	// Place into IPFS and resolve the placeholder
+	// Place into the store and resolve the placeholder
 	go func() {
 		// BLock until DL finishes, nil for success, else will be an error
 		err := <-dlError
@@ -139,13 +209,16 @@ func downloadMp3(song *resource.Song, ipfs *shell.Shell) (*resource.Song, error)
 			return
 		}
 
-		// Add to ipfs
-		ipfsPath, err := addToIpfs(fileLocation, ipfs)
+		// The filename was only standing in until we could read the tags
+		describe(song, fileLocation, store, filename)
+
+		// Add to the store
+		blobPath, err := addToStore(fileLocation, store)
 		if err != nil {
-			song.DLFailure <- fmt.Errorf("failed to add %s to IPFS. Err: %v", song.URL().String(), err)
+			song.DLFailure <- fmt.Errorf("failed to add %s to storage. Err: %v", song.URL().String(), err)
 			return
 		}
-		song.DLResult <- ipfsPath
+		song.DLResult <- blobPath
 
 		// Remove the mp3 now that we've added
 		if err = os.Remove(fileLocation); err != nil {
@@ -159,10 +232,40 @@ func downloadMp3(song *resource.Song, ipfs *shell.Shell) (*resource.Song, error)
 // downloadYoutube fetches audio from YouTube using yt-dlp. yt-dlp handles the
 // bot-check (via the cookies file), the n-challenge (via a JS runtime), and the
 // PoToken (via the bgutil provider), then extracts the audio to mp3. We add the
-// resulting file to IPFS and resolve the song via its DLResult channel.
+// resulting file to the store and resolve the song via its DLResult channel.
 //
 // Requires yt-dlp (and ffmpeg for the audio extraction) to be in PATH.
-func downloadYoutube(song *resource.Song, ipfs *shell.Shell) (*resource.Song, error) {
+func downloadYoutube(song *resource.Song, store storage.BlobStore) (*resource.Song, error) {
+	return downloadYtDlp(song, store, youtubeMeta)
+}
+
+// applyMeta fills in the song's details from the lines yt-dlp printed for the
+// title, artist and duration. yt-dlp prints NA for fields it doesn't have.
+func applyMeta(song *resource.Song, metaLines []string) {
+	field := func(idx int) string {
+		if idx >= len(metaLines) {
+			return ""
+		}
+		value := strings.TrimSpace(metaLines[idx])
+		if value == "NA" {
+			return ""
+		}
+		return value
+	}
+
+	if title := field(0); title != "" {
+		song.Title = title
+	}
+	song.Artist = field(1)
+	if secs, perr := strconv.ParseFloat(field(2), 64); perr == nil {
+		song.Duration = time.Duration(secs) * time.Second
+	}
+}
+
+// downloadYtDlp fetches audio from any site yt-dlp supports, the same way
+// downloadYoutube does. meta says where to find the song's details on the
+// site.
+func downloadYtDlp(song *resource.Song, store storage.BlobStore, meta siteMeta) (*resource.Song, error) {
 	ytDlp, err := exec.LookPath("yt-dlp")
 	if err != nil {
 		return song, fmt.Errorf("yt-dlp was not found in PATH. Please install yt-dlp")
@@ -175,48 +278,41 @@ func downloadYoutube(song *resource.Song, ipfs *shell.Shell) (*resource.Song, er
 	// request) rather than disappearing into a background goroutine.
 	metaOut, err := exec.Command(ytDlp,
 		"--no-playlist", "--cookies", cookiesFile, "--skip-download",
-		"--print", "%(title)s", "--print", "%(duration)s", rawURL).Output()
+		"--print", meta.title, "--print", meta.artist, "--print", "%(duration)s", rawURL).Output()
 	if err != nil {
-		return song, fmt.Errorf("failed to fetch provided Youtube url. Err: %v", err)
-	}
-	metaLines := strings.Split(strings.TrimSpace(string(metaOut)), "\n")
-	if len(metaLines) >= 1 {
-		song.Title = strings.TrimSpace(metaLines[0])
-	}
-	if len(metaLines) >= 2 {
-		if secs, perr := strconv.ParseFloat(strings.TrimSpace(metaLines[1]), 64); perr == nil {
-			song.Duration = time.Duration(secs) * time.Second
-		}
+		return song, fmt.Errorf("failed to fetch provided url %s. Err: %v", rawURL, err)
 	}
+	applyMeta(song, strings.Split(strings.TrimSpace(string(metaOut)), "\n"))
 
 	// yt-dlp extracts to <fileBase>.mp3 (it downloads bestaudio then converts).
 	fileBase := filepath.Join(tempDLFolder, randSeq(12))
 	fileLocation := fileBase + ".mp3"
 
 	go func() {
-		// Bound concurrent YouTube downloads
+		// Bound concurrent yt-dlp downloads
 		maxYTDownloaders <- 0
 		defer func() { <-maxYTDownloaders }()
 
 		log.Printf("Starting yt-dlp download of %v\n", rawURL)
-		out, err := exec.Command(ytDlp,
-			"--no-playlist", "--cookies", cookiesFile,
+		out, err := runYtDlpDownload(ytDlp, rawURL,
+			"--no-playlist", "--cookies", cookiesFile, "--newline",
 			"-f", "bestaudio", "-x", "--audio-format", "mp3",
-			"-o", fileBase+".%(ext)s", rawURL).CombinedOutput()
+			"-o", fileBase+".%(ext)s", rawURL)
 		if err != nil {
 			song.DLFailure <- fmt.Errorf("yt-dlp failed to download %s. Err: %v. Output: %s",
-				rawURL, err, string(out))
+				rawURL, err, out)
 			return
 		}
 		log.Printf("Downloading of %v complete\n", rawURL)
+		describe(song, fileLocation, store, "")
 
-		// Add to ipfs
-		ipfsPath, err := addToIpfs(fileLocation, ipfs)
+		// Add to the store
+		blobPath, err := addToStore(fileLocation, store)
 		if err != nil {
-			song.DLFailure <- fmt.Errorf("failed to add %s to IPFS. Err: %v", rawURL, err)
+			song.DLFailure <- fmt.Errorf("failed to add %s to storage. Err: %v", rawURL, err)
 			return
 		}
-		song.DLResult <- ipfsPath
+		song.DLResult <- blobPath
 
 		// Remove the mp3 now that we've added
 		if err = os.Remove(fileLocation); err != nil {
@@ -227,26 +323,138 @@ func downloadYoutube(song *resource.Song, ipfs *shell.Shell) (*resource.Song, er
 	return song, nil
 }
 
-// Fetch IPFS will get the provided IPFS resource and return the reader of its
-// data
-func FetchIpfs(ipfsPath string, ipfs *shell.Shell) (r io.ReadCloser, err error) {
-	go func() {
-		err := ipfs.Pin(ipfsPath) // Any time we fetch we also pin. This goes away eventually
-		if err != nil {
-			log.Printf("Failed to pin IPFS path! %v may not play later\n", err)
+// runYtDlpDownload runs yt-dlp with the provided args, publishing the
+// progress it reports for rawURL along the way. The full output is returned
+// so it can be included in errors.
+func runYtDlpDownload(ytDlp string, rawURL string, args ...string) (output string, err error) {
+	cmd := exec.Command(ytDlp, args...)
+	stdoutLines := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err = cmd.Start(); err != nil {
+		return "", err
+	}
+
+	lastPublish := time.Time{}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		stdoutLines.WriteString(line + "\n")
+
+		match := ytDlpProgress.FindStringSubmatch(line)
+		if match == nil || time.Since(lastPublish) < time.Second {
+			continue
 		}
-	}()
+		if percent, perr := strconv.ParseFloat(match[1], 64); perr == nil {
+			publishProgress(rawURL, percent)
+			lastPublish = time.Now()
+		}
+	}
+	err = cmd.Wait()
+
+	return stdoutLines.String() + stderr.String(), err
+}
+
+// Matches yt-dlp's progress lines, eg "[download]  42.1% of 3.20MiB at ..."
+var ytDlpProgress = regexp.MustCompile(`^\[download\]\s+([\d.]+)%`)
 
-	return ipfs.Cat(ipfsPath)
+// publishProgress lets subscribers know how far along a download is. percent
+// is -1 if we can't tell.
+func publishProgress(rawURL string, percent float64) {
+	events.Publish(events.DownloadProgress, struct {
+		URL     string  `json:"url"`
+		Percent float64 `json:"percent"`
+	}{rawURL, percent})
 }
 
-// Add the file at the provided location to ipfs and return its IPFS
+// progressReader publishes the progress of a download as it's read, at most
+// once a second
+type progressReader struct {
+	r           io.Reader
+	url         string
+	total       int64
+	read        int64
+	lastPublish time.Time
+}
+
+func newProgressReader(r io.Reader, rawURL string, total int64) *progressReader {
+	return &progressReader{r: r, url: rawURL, total: total}
+}
+
+func (p *progressReader) Read(b []byte) (n int, err error) {
+	n, err = p.r.Read(b)
+	p.read += int64(n)
+
+	if err == io.EOF || time.Since(p.lastPublish) >= time.Second {
+		percent := -1.0
+		if p.total > 0 {
+			percent = float64(p.read) / float64(p.total) * 100
+		}
+		publishProgress(p.url, percent)
+		p.lastPublish = time.Now()
+	}
+
+	return n, err
+}
+
+// probe reads the tags of downloaded files, swapped out in tests
+var probe = tags.Read
+
+// describe fills in the details the song is missing from the tags of its
+// downloaded audio, and gives it the exact duration. Songs are still playable
+// without them, so failing to read the tags is only logged. See applyTags for
+// placeholder.
+func describe(song *resource.Song, fileLocation string, store storage.BlobStore, placeholder string) {
+	found, err := probe(fileLocation)
+	if err != nil {
+		log.Printf("Failed to read the tags of %s. Err: %v\n", fileLocation, err)
+		return
+	}
+	applyTags(song, found, fileLocation, store, placeholder)
+}
+
+// applyTags fills in the song's details from the tags read from its audio,
+// putting any cover art into the store. A title of placeholder was only
+// standing in until the tags were read, the tagged title replaces it and
+// songs left without one get it. Downloads may already be shared, so the
+// details are set under the song's lock.
+func applyTags(song *resource.Song, found tags.Tags, fileLocation string, store storage.BlobStore, placeholder string) {
+	song.SetDetails(func(song *resource.Song) {
+		if song.Title == placeholder {
+			song.Title = ""
+		}
+		found.Apply(song)
+		if song.Title == "" {
+			song.Title = placeholder
+		}
+	})
+	if !found.Cover {
+		return
+	}
+	cover, err := tags.StoreCover(fileLocation, store)
+	if err != nil {
+		log.Printf("Failed to store the cover of %s. Err: %v\n", fileLocation, err)
+		return
+	}
+	song.SetDetails(func(song *resource.Song) {
+		if song.Cover == "" {
+			song.Cover = cover
+		}
+	})
+}
+
+// Add the file at the provided location to the store and return its blob
 // path
-func addToIpfs(fileLocation string, ipfs *shell.Shell) (ipfsPath string, err error) {
+func addToStore(fileLocation string, store storage.BlobStore) (blobPath string, err error) {
 	mp3File, err := os.Open(fileLocation)
 	if err != nil {
 		return "", fmt.Errorf("failed to open downloaded mp3. Err: %v", err)
 	}
+	defer mp3File.Close()
 
 	fileInfo, _ := os.Stat(fileLocation)
 
@@ -254,13 +462,5 @@ func addToIpfs(fileLocation string, ipfs *shell.Shell) (ipfsPath string, err err
 		return "", fmt.Errorf("file was 0 bytes, didn't cache")
 	}
 
-	ipfsPath, err = ipfs.Add(mp3File)
-	if err != nil {
-		return "", fmt.Errorf("failed to add to IPFS. Err: %v", err)
-	}
-
-	// Formatting as proper ipfs path, not just hash
-	ipfsPath = "/ipfs/" + ipfsPath
-
-	return ipfsPath, err
+	return store.Put(mp3File)
 }
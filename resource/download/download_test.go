@@ -6,7 +6,7 @@ import (
 	"testing"
 
 	"github.com/VivaLaPanda/uta-stream/resource"
-	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
 )
 
 func TestSplitAudio(t *testing.T) {
@@ -41,20 +41,18 @@ func TestSplitAudio(t *testing.T) {
 
 func TestDownloadYoutube(t *testing.T) {
 	rawUrl := "https://youtu.be/nAwTw1aYy6M"
-	ipfsUrl := "localhost:5001"
-
-	// Setup shell and testing url
-	ipfs := shell.NewShell(ipfsUrl)
+	// Setup store and testing url
+	store, _ := storage.NewLocalStore(t.TempDir())
 	songToTest, _ := resource.NewSong(rawUrl)
 
 	// Commence the download
-	song, err := downloadYoutube(songToTest, ipfs)
+	song, err := downloadYoutube(songToTest, store)
 	if err != nil {
 		t.Errorf("TestDownloadYoutube failed due to an error: %v", err)
 		return
 	}
 
-	_, err = song.Resolve(ipfs)
+	_, err = song.Resolve(store)
 	if err != nil {
 		t.Errorf("TestDownloadYoutube failed due to an error: %v", err)
 		return
@@ -70,31 +68,65 @@ func TestDownloadYoutube(t *testing.T) {
 
 func TestDownloadMP3(t *testing.T) {
 	rawUrl := "https://www.mediacollege.com/audio/tone/files/100Hz_44100Hz_16bit_05sec.mp3"
-	ipfsUrl := "localhost:5001"
-
-	// Setup shell and testing url
-	ipfs := shell.NewShell(ipfsUrl)
+	// Setup store and testing url
+	store, _ := storage.NewLocalStore(t.TempDir())
 	songToTest, _ := resource.NewSong(rawUrl)
 
 	// Commence the download
-	song, err := downloadMp3(songToTest, ipfs)
+	song, err := downloadMp3(songToTest, store)
 	if err != nil {
 		t.Errorf("TestDownloadMP3 failed due to an error: %v", err)
 		return
 	}
 
-	song.Resolve(ipfs)
+	song.Resolve(store)
 }
 
-func TestFetchIpfs(t *testing.T) {
-	ipfsUrl := "localhost:5001"
-	ipfsPath := "/ipfs/QmZem7HHzLuhq8Qa4CHD6Q4VUdn9ihP5vaEihhfUhqqyPN"
+func TestAddToStore(t *testing.T) {
+	store, _ := storage.NewLocalStore(t.TempDir())
+
+	blobPath, err := addToStore("test_vid.mp4", store)
+	if err != nil {
+		t.Errorf("Failed to add file to store. Err: %s", err)
+		return
+	}
+	if !store.Has(blobPath) {
+		t.Errorf("Store doesn't have the file we just added: %s", blobPath)
+	}
+}
 
-	// Setup shell and testing url
-	ipfs := shell.NewShell(ipfsUrl)
+func TestYtDlpSite(t *testing.T) {
+	testTable := []struct {
+		hostname string
+		site     string
+		found    bool
+	}{
+		{"soundcloud.com", "soundcloud.com", true},
+		{"m.soundcloud.com", "soundcloud.com", true},
+		{"someartist.bandcamp.com", "bandcamp.com", true},
+		{"player.vimeo.com", "vimeo.com", true},
+		{"notsoundcloud.com", "", false},
+		{"example.com", "", false},
+	}
+
+	for _, test := range testTable {
+		site, found := ytDlpSite(test.hostname)
+		if site != test.site || found != test.found {
+			t.Errorf("Wrong site for %s. E: %s, A: %s\n", test.hostname, test.site, site)
+		}
+	}
+}
+
+func TestApplyMeta(t *testing.T) {
+	song, _ := resource.NewSong("https://someartist.bandcamp.com/track/song")
+	applyMeta(song, []string{"Song", "Some Artist", "183.5"})
+	if song.Title != "Song" || song.Artist != "Some Artist" || song.Duration.Seconds() != 183 {
+		t.Errorf("Metadata wasn't applied: %s, %s, %v\n", song.Title, song.Artist, song.Duration)
+	}
 
-	reader, err := FetchIpfs(ipfsPath, ipfs)
-	if reader == nil {
-		t.Errorf("Failed to fetch IPFS path. Err: %s", err)
+	// yt-dlp prints NA for fields the site doesn't have
+	applyMeta(song, []string{"Other Song", "NA", "NA"})
+	if song.Title != "Other Song" || song.Artist != "" {
+		t.Errorf("NA should mean no value: %s, %s\n", song.Title, song.Artist)
 	}
 }
@@ -0,0 +1,174 @@
+package download
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Remote playlists are small text files, anything bigger isn't one
+const maxPlaylistSize = 1 << 20
+
+var playlistClient = &http.Client{Timeout: 30 * time.Second}
+
+// ExpandPlaylist gives the URLs of the songs in a playlist, in order. YouTube
+// playlists, SoundCloud sets and anything else yt-dlp can list are expanded
+// with yt-dlp, remote M3U and PLS files are fetched and read. At most limit
+// songs are returned, 0 means no limit.
+func ExpandPlaylist(rawURL string, limit int) ([]string, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("playlist url is malformed. Err: %v", err)
+	}
+
+	var songs []string
+	switch ext := strings.ToLower(path.Ext(parsedURL.Path)); {
+	case ext == ".m3u" || ext == ".m3u8" || ext == ".pls":
+		songs, err = fetchPlaylistFile(parsedURL, ext)
+	case youtubeHosts[parsedURL.Hostname()]:
+		songs, err = listYtDlpPlaylist(rawURL, limit)
+	default:
+		if _, found := ytDlpSite(parsedURL.Hostname()); !found {
+			return nil, fmt.Errorf("%s isn't a playlist we know how to read, "+
+				"should be an m3u or pls file or from one of: %v",
+				rawURL, append([]string{"youtube.com"}, ytDlpHosts...))
+		}
+		songs, err = listYtDlpPlaylist(rawURL, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(songs) > limit {
+		songs = songs[:limit]
+	}
+	return songs, nil
+}
+
+// listYtDlpPlaylist asks yt-dlp for the songs in the playlist without
+// downloading any of them
+func listYtDlpPlaylist(rawURL string, limit int) ([]string, error) {
+	ytDlp, err := exec.LookPath("yt-dlp")
+	if err != nil {
+		return nil, fmt.Errorf("yt-dlp was not found in PATH. Please install yt-dlp")
+	}
+
+	args := []string{"--yes-playlist", "--flat-playlist", "--cookies", cookiesFile,
+		"--print", "%(webpage_url,url)s"}
+	if limit > 0 {
+		// Some playlists (like YouTube mixes) never end
+		args = append(args, "--playlist-end", strconv.Itoa(limit))
+	}
+	out, err := exec.Command(ytDlp, append(args, rawURL)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list playlist %s. Err: %v", rawURL, err)
+	}
+
+	songs := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" && line != "NA" {
+			songs = append(songs, line)
+		}
+	}
+	return songs, nil
+}
+
+// fetchPlaylistFile downloads an M3U or PLS file and reads the songs out of it
+func fetchPlaylistFile(playlistURL *url.URL, ext string) ([]string, error) {
+	resp, err := playlistClient.Get(playlistURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch playlist %s. Err: %v", playlistURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch playlist %s, got %s", playlistURL, resp.Status)
+	}
+
+	body := io.LimitReader(resp.Body, maxPlaylistSize)
+	if ext == ".pls" {
+		return parsePLS(body, playlistURL)
+	}
+	return parseM3U(body, playlistURL)
+}
+
+// resolveEntry turns a playlist entry into an absolute URL. Entries can be
+// relative to where the playlist lives.
+func resolveEntry(entry string, base *url.URL) (string, error) {
+	entryURL, err := url.Parse(entry)
+	if err != nil {
+		return "", err
+	}
+	resolved := base.ResolveReference(entryURL)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return "", fmt.Errorf("playlist entry %s isn't a web url", entry)
+	}
+	return resolved.String(), nil
+}
+
+// parseM3U reads the songs out of an M3U playlist. Every line that isn't
+// blank or a comment (#EXTINF and friends) is a song. HLS streams are m3u8
+// files too, but their entries are pieces of one stream rather than songs,
+// so anything with #EXT-X- tags is refused.
+func parseM3U(playlist io.Reader, base *url.URL) ([]string, error) {
+	songs := []string{}
+	scanner := bufio.NewScanner(playlist)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#EXT-X-") {
+			return nil, fmt.Errorf("%s is an HLS stream, not a playlist of songs", base)
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		song, err := resolveEntry(line, base)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read m3u playlist. Err: %v", err)
+		}
+		songs = append(songs, song)
+	}
+
+	return songs, scanner.Err()
+}
+
+// parsePLS reads the songs out of a PLS playlist, in the order of their
+// FileN entries
+func parsePLS(playlist io.Reader, base *url.URL) ([]string, error) {
+	entries := make(map[int]string)
+	scanner := bufio.NewScanner(playlist)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(strings.ToLower(parts[0]), "file") {
+			continue
+		}
+		number, err := strconv.Atoi(parts[0][len("file"):])
+		if err != nil {
+			continue
+		}
+		if entries[number], err = resolveEntry(strings.TrimSpace(parts[1]), base); err != nil {
+			return nil, fmt.Errorf("failed to read pls playlist. Err: %v", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	numbers := make([]int, 0, len(entries))
+	for number := range entries {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	songs := make([]string, len(numbers))
+	for idx, number := range numbers {
+		songs[idx] = entries[number]
+	}
+	return songs, nil
+}
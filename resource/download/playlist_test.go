@@ -0,0 +1,65 @@
+package download
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseM3U(t *testing.T) {
+	base, _ := url.Parse("https://example.com/music/list.m3u")
+	playlist := `#EXTM3U
+#EXTINF:183,Artist - First
+first.mp3
+
+#EXTINF:200,Artist - Second
+https://youtu.be/nAwTw1aYy6M
+/other/third.flac
+`
+	songs, err := parseM3U(strings.NewReader(playlist), base)
+	expected := []string{
+		"https://example.com/music/first.mp3",
+		"https://youtu.be/nAwTw1aYy6M",
+		"https://example.com/other/third.flac",
+	}
+	if err != nil || strings.Join(songs, " ") != strings.Join(expected, " ") {
+		t.Errorf("M3U wasn't read correctly. Songs: %v, Err: %v\n", songs, err)
+	}
+
+	if _, err = parseM3U(strings.NewReader("file:///etc/passwd\n"), base); err == nil {
+		t.Errorf("Local files in a remote playlist should be refused\n")
+	}
+
+	hls := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:6
+#EXTINF:6.000,
+segment0.ts
+`
+	if _, err = parseM3U(strings.NewReader(hls), base); err == nil {
+		t.Errorf("HLS streams shouldn't be read as playlists of songs\n")
+	}
+}
+
+func TestParsePLS(t *testing.T) {
+	base, _ := url.Parse("https://example.com/music/list.pls")
+	playlist := `[playlist]
+File2=https://youtu.be/nAwTw1aYy6M
+Title2=Second
+File1=first.mp3
+Title1=First
+NumberOfEntries=2
+Version=2
+`
+	songs, err := parsePLS(strings.NewReader(playlist), base)
+	if err != nil || len(songs) != 2 || songs[0] != "https://example.com/music/first.mp3" ||
+		songs[1] != "https://youtu.be/nAwTw1aYy6M" {
+		t.Errorf("PLS wasn't read correctly. Songs: %v, Err: %v\n", songs, err)
+	}
+}
+
+func TestExpandPlaylistUnknown(t *testing.T) {
+	if _, err := ExpandPlaylist("https://example.com/not-a-playlist", 10); err == nil {
+		t.Errorf("Expanding an unknown site should fail\n")
+	}
+}
@@ -0,0 +1,90 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/VivaLaPanda/uta-stream/resource"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
+)
+
+// File types that can be uploaded, by extension. Change with
+// SetUploadFormats.
+var uploadFormats = []string{"mp3", "flac", "ogg", "opus", "m4a", "wav"}
+
+// ErrNotAudio is returned for uploads we won't play, as opposed to ones we
+// failed to store
+var ErrNotAudio = errors.New("not a supported audio file")
+
+// SetUploadFormats replaces the file types that can be uploaded. Formats are
+// extensions, with or without the dot.
+func SetUploadFormats(formats []string) {
+	uploadFormats = []string{}
+	for _, format := range formats {
+		uploadFormats = append(uploadFormats, strings.ToLower(strings.TrimPrefix(format, ".")))
+	}
+}
+
+// uploadFormat reports whether the file is a type that can be uploaded
+func uploadFormat(filename string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	for _, format := range uploadFormats {
+		if ext == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Upload puts an uploaded audio file into the store. The file is checked with
+// ffprobe first, anything that isn't playable audio is refused with
+// ErrNotAudio. The song's details come from the file's tags, with the
+// filename as the title if it has none.
+func Upload(file io.Reader, filename string, store storage.BlobStore) (*resource.Song, error) {
+	if !uploadFormat(filename) {
+		return nil, fmt.Errorf("%w, should be one of: %v", ErrNotAudio, uploadFormats)
+	}
+
+	// ffprobe needs a file it can seek around in
+	if _, err := os.Stat(tempDLFolder); os.IsNotExist(err) {
+		os.Mkdir(tempDLFolder, os.ModePerm)
+	}
+	fileLocation := filepath.Join(tempDLFolder, "upload-"+randSeq(8)+filepath.Ext(filename))
+	tempFile, err := os.Create(fileLocation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file for upload. Err: %v", err)
+	}
+	defer func() {
+		if err := os.Remove(fileLocation); err != nil {
+			log.Printf("Failed to remove upload %s. Err: %v\n", fileLocation, err)
+		}
+	}()
+	_, err = io.Copy(tempFile, file)
+	tempFile.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save upload. Err: %v", err)
+	}
+
+	found, err := probe(fileLocation)
+	if err != nil {
+		log.Printf("Failed to probe upload %s. Err: %v\n", filename, err)
+		return nil, fmt.Errorf("%w, ffmpeg couldn't read it", ErrNotAudio)
+	}
+	if !found.Audio {
+		return nil, fmt.Errorf("%w, it has no audio", ErrNotAudio)
+	}
+
+	blobPath, err := addToStore(fileLocation, store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add %s to storage. Err: %v", filename, err)
+	}
+
+	song := resource.NewStoredSong(blobPath, nil)
+	applyTags(song, found, fileLocation, store, strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)))
+	return song, nil
+}
@@ -0,0 +1,54 @@
+package download
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
+	"github.com/VivaLaPanda/uta-stream/resource/tags"
+)
+
+func TestUpload(t *testing.T) {
+	store, _ := storage.NewLocalStore(t.TempDir())
+	oldTempDLFolder := tempDLFolder
+	tempDLFolder = t.TempDir()
+	found := tags.Tags{Artist: "Some Artist", Duration: 3 * time.Minute, Audio: true}
+	probe = func(filename string) (tags.Tags, error) { return found, nil }
+	t.Cleanup(func() {
+		tempDLFolder = oldTempDLFolder
+		probe = tags.Read
+	})
+
+	song, err := Upload(strings.NewReader("audio"), "My Song.MP3", store)
+	if err != nil {
+		t.Errorf("Failed to upload. Err: %v\n", err)
+		return
+	}
+	if !store.Has(song.IpfsPath()) {
+		t.Errorf("Store doesn't have the upload: %s\n", song.IpfsPath())
+	}
+	// Untitled files are named after the file
+	if song.Title != "My Song" || song.Artist != "Some Artist" || song.Duration != 3*time.Minute {
+		t.Errorf("Upload details weren't taken from the tags: %+v\n", song)
+	}
+	if song.ResourceID() != song.IpfsPath() {
+		t.Errorf("Uploads should be known by their blob path, got %s\n", song.ResourceID())
+	}
+
+	// Files ffprobe finds no audio in are refused, as are other formats
+	found.Audio = false
+	if _, err = Upload(strings.NewReader("cover art"), "cover.mp3", store); !errors.Is(err, ErrNotAudio) {
+		t.Errorf("File without audio should be refused, got %v\n", err)
+	}
+	if _, err = Upload(strings.NewReader("audio"), "song.exe", store); !errors.Is(err, ErrNotAudio) {
+		t.Errorf("File with the wrong extension should be refused, got %v\n", err)
+	}
+
+	SetUploadFormats([]string{".EXE"})
+	defer SetUploadFormats([]string{"mp3", "flac", "ogg", "opus", "m4a", "wav"})
+	if !uploadFormat("song.exe") || uploadFormat("song.mp3") {
+		t.Errorf("Upload formats weren't replaced: %v\n", uploadFormats)
+	}
+}
@@ -0,0 +1,316 @@
+// Package library imports audio files from local directories, so songs can
+// be played without downloading them first.
+package library
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/db"
+	"github.com/VivaLaPanda/uta-stream/resource"
+	"github.com/VivaLaPanda/uta-stream/resource/cache"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
+	"github.com/VivaLaPanda/uta-stream/resource/tags"
+)
+
+// Files with these extensions are imported, anything else is ignored
+var audioExtensions = map[string]bool{
+	".mp3":  true,
+	".flac": true,
+	".ogg":  true,
+	".opus": true,
+	".m4a":  true,
+	".wav":  true,
+}
+
+// Read the tags and cover art of a file, swapped out in tests
+var (
+	readTags   = tags.Read
+	storeCover = tags.StoreCover
+)
+
+// entry is what we remember about an imported file, enough to tell whether
+// it has changed since
+type entry struct {
+	ResourceID string    `json:"resourceID"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	BlobPath   string    `json:"blobPath"`
+}
+
+// ScanResult sums up what a scan did
+type ScanResult struct {
+	Added     int       `json:"added"`
+	Updated   int       `json:"updated"`
+	Removed   int       `json:"removed"`
+	Unchanged int       `json:"unchanged"`
+	Failed    []string  `json:"failed"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+}
+
+// Status is what the library is up to
+type Status struct {
+	Dirs     []string    `json:"dirs"`
+	Songs    int         `json:"songs"`
+	Scanning bool        `json:"scanning"`
+	LastScan *ScanResult `json:"lastScan,omitempty"`
+}
+
+// Library keeps the songs in some directories imported into the store and
+// cache. Each song's resource ID is the file:// url of the file, so it stays
+// the same however many times the file is scanned.
+type Library struct {
+	dirs  []string
+	cache *cache.Cache
+	store storage.BlobStore
+	db    *db.DB
+
+	lock     *sync.Mutex
+	entries  map[string]*entry // keyed by resource ID
+	scanning bool
+	lastScan *ScanResult
+	scanLock *sync.Mutex // only one scan at a time
+}
+
+// NewLibrary gives a library of the audio files in dirs. What has been
+// imported is kept in the database, so only files that changed while we
+// weren't running need importing again. Call Scan or Watch to do that.
+func NewLibrary(database *db.DB, dirs []string, c *cache.Cache, store storage.BlobStore) (*Library, error) {
+	l := &Library{
+		cache:    c,
+		store:    store,
+		db:       database,
+		lock:     &sync.Mutex{},
+		entries:  make(map[string]*entry),
+		scanLock: &sync.Mutex{},
+	}
+	for _, dir := range dirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("can't use library directory %s. Err: %v", dir, err)
+		}
+		l.dirs = append(l.dirs, absDir)
+	}
+
+	err := database.ForEach(db.LibraryBucket, func(key string, value []byte) error {
+		e := &entry{}
+		if err := json.Unmarshal(value, e); err != nil {
+			return fmt.Errorf("failed to parse library entry %s. Err: %v", key, err)
+		}
+		l.entries[key] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// ResourceID gives the stable resource ID of the file at path
+func ResourceID(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// Watch rescans the library every interval, picking up files that were
+// added, changed or deleted. Blocks forever, run it in its own goroutine.
+func (l *Library) Watch(interval time.Duration) {
+	for {
+		result := l.Scan()
+		if result.Added+result.Updated+result.Removed+len(result.Failed) > 0 {
+			log.Printf("Library scan added %d, updated %d and removed %d songs, %d failed\n",
+				result.Added, result.Updated, result.Removed, len(result.Failed))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Status reports what the library is up to
+func (l *Library) Status() Status {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return Status{
+		Dirs:     l.dirs,
+		Songs:    len(l.entries),
+		Scanning: l.scanning,
+		LastScan: l.lastScan,
+	}
+}
+
+// Scan walks the library directories, importing new and changed files and
+// forgetting ones that have gone. If a scan is already running this waits
+// for it and scans again.
+func (l *Library) Scan() ScanResult {
+	l.scanLock.Lock()
+	defer l.scanLock.Unlock()
+
+	l.lock.Lock()
+	l.scanning = true
+	l.lock.Unlock()
+
+	result := ScanResult{Started: time.Now(), Failed: []string{}}
+	seen := make(map[string]bool)
+	// Files under a directory we couldn't read might still be there, like
+	// when the NAS drops off the network, so they aren't treated as deleted
+	unreadable := []string{}
+	for _, dir := range l.dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// Keep going, one unreadable directory shouldn't stop the scan
+				result.Failed = append(result.Failed, path)
+				unreadable = append(unreadable, path)
+				log.Printf("Failed to read %s while scanning the library. Err: %v\n", path, err)
+				return nil
+			}
+			if info.IsDir() || !audioExtensions[strings.ToLower(filepath.Ext(path))] {
+				return nil
+			}
+
+			resourceID := ResourceID(path)
+			seen[resourceID] = true
+			l.lock.Lock()
+			known, exists := l.entries[resourceID]
+			l.lock.Unlock()
+			if exists && known.Size == info.Size() && known.ModTime.Equal(info.ModTime()) {
+				result.Unchanged++
+				return nil
+			}
+
+			if err = l.importFile(resourceID, path, info); err != nil {
+				result.Failed = append(result.Failed, path)
+				log.Printf("Failed to import %s into the library. Err: %v\n", path, err)
+				return nil
+			}
+			if exists {
+				result.Updated++
+			} else {
+				result.Added++
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to scan library directory %s. Err: %v\n", dir, err)
+		}
+	}
+
+	// Anything we didn't come across has been deleted
+	l.lock.Lock()
+	gone := []string{}
+	for resourceID, e := range l.entries {
+		if !seen[resourceID] && !under(e.Path, unreadable) {
+			gone = append(gone, resourceID)
+		}
+	}
+	l.lock.Unlock()
+	sort.Strings(gone)
+	for _, resourceID := range gone {
+		if err := l.remove(resourceID); err != nil {
+			log.Printf("Failed to remove %s from the library. Err: %v\n", resourceID, err)
+			continue
+		}
+		result.Removed++
+	}
+
+	result.Finished = time.Now()
+	l.lock.Lock()
+	l.scanning = false
+	l.lastScan = &result
+	l.lock.Unlock()
+
+	return result
+}
+
+// under reports whether path is one of dirs or inside one of them
+func under(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// importFile puts the file into the store and the cache, under its resource
+// ID. When a changed file is imported again the audio from before stays in
+// the store, same as for removed files. The queue and the autoq know songs by
+// their blob path, so the old one may still be queued or playing, and the
+// autoq can pick it again from what it learned. We can't tell when nothing
+// refers to it anymore.
+func (l *Library) importFile(resourceID string, path string, info os.FileInfo) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	blobPath, err := l.store.Put(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to add to storage. Err: %v", err)
+	}
+
+	// A file we can't read the tags of is still playable
+	found, err := readTags(path)
+	if err != nil {
+		log.Printf("Failed to read the tags of %s. Err: %v\n", path, err)
+	}
+	if found.Title == "" {
+		found.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	source, _ := url.Parse(resourceID)
+	song := resource.NewStoredSong(blobPath, source)
+	found.Apply(song)
+	if found.Cover {
+		if song.Cover, err = storeCover(path, l.store); err != nil {
+			log.Printf("Failed to store the cover of %s. Err: %v\n", path, err)
+		}
+	}
+	if err = l.cache.Put(resourceID, song); err != nil {
+		return fmt.Errorf("failed to add to the cache. Err: %v", err)
+	}
+
+	e := &entry{
+		ResourceID: resourceID,
+		Path:       path,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		BlobPath:   blobPath,
+	}
+	entryData, err := json.Marshal(e)
+	if err == nil {
+		err = l.db.Put(db.LibraryBucket, resourceID, entryData)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save library entry. Err: %v", err)
+	}
+
+	l.lock.Lock()
+	l.entries[resourceID] = e
+	l.lock.Unlock()
+	return nil
+}
+
+// remove forgets a file that has been deleted. Its audio stays in the store,
+// as it may still be queued or playing.
+func (l *Library) remove(resourceID string) error {
+	if err := l.cache.Delete(resourceID); err != nil {
+		return err
+	}
+	if err := l.db.Delete(db.LibraryBucket, resourceID); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	delete(l.entries, resourceID)
+	l.lock.Unlock()
+	return nil
+}
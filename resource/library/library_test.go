@@ -0,0 +1,85 @@
+package library
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/db"
+	"github.com/VivaLaPanda/uta-stream/resource/cache"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
+	"github.com/VivaLaPanda/uta-stream/resource/tags"
+)
+
+func init() {
+	// Don't depend on ffprobe, tag everything by the same artist
+	readTags = func(filename string) (tags.Tags, error) {
+		return tags.Tags{Artist: "Test Artist", Duration: time.Minute}, nil
+	}
+}
+
+func TestScan(t *testing.T) {
+	database := db.OpenTemp(t)
+	store, _ := storage.NewLocalStore(t.TempDir())
+	c := cache.NewCache(database, "", store)
+	musicDir := t.TempDir()
+	os.MkdirAll(filepath.Join(musicDir, "album"), os.ModePerm)
+	songA := filepath.Join(musicDir, "album", "01 Song A.flac")
+	songB := filepath.Join(musicDir, "Song B.mp3")
+	ioutil.WriteFile(songA, []byte("song a"), 0644)
+	ioutil.WriteFile(songB, []byte("song b"), 0644)
+	ioutil.WriteFile(filepath.Join(musicDir, "cover.jpg"), []byte("not a song"), 0644)
+
+	l, err := NewLibrary(database, []string{musicDir}, c, store)
+	if err != nil {
+		t.Errorf("Failed to create library. Err: %v\n", err)
+		return
+	}
+	if result := l.Scan(); result.Added != 2 || len(result.Failed) != 0 {
+		t.Errorf("Expected 2 songs added, got %+v\n", result)
+	}
+
+	song, err := c.Lookup(ResourceID(songA))
+	if err != nil || song.Title != "01 Song A" || song.Artist != "Test Artist" || !store.Has(song.IpfsPath()) {
+		t.Errorf("Song A wasn't imported properly: %v (Err: %v)\n", song, err)
+	}
+
+	// Nothing changed, so nothing to do. Same goes for a fresh library.
+	l, _ = NewLibrary(database, []string{musicDir}, c, store)
+	if result := l.Scan(); result.Unchanged != 2 || result.Added != 0 {
+		t.Errorf("Expected both songs unchanged, got %+v\n", result)
+	}
+
+	ioutil.WriteFile(songA, []byte("song a, remastered"), 0644)
+	os.Chtimes(songA, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	os.Remove(songB)
+	if result := l.Scan(); result.Updated != 1 || result.Removed != 1 {
+		t.Errorf("Expected one song updated and one removed, got %+v\n", result)
+	}
+	if _, err = c.Lookup(ResourceID(songB)); err == nil {
+		t.Errorf("Deleted song is still in the cache\n")
+	}
+	if status := l.Status(); status.Songs != 1 || status.Scanning {
+		t.Errorf("Expected 1 song in an idle library, got %+v\n", status)
+	}
+}
+
+func TestUnreadableDir(t *testing.T) {
+	database := db.OpenTemp(t)
+	store, _ := storage.NewLocalStore(t.TempDir())
+	c := cache.NewCache(database, "", store)
+	musicDir := filepath.Join(t.TempDir(), "nas")
+	os.MkdirAll(musicDir, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(musicDir, "song.mp3"), []byte("song"), 0644)
+
+	l, _ := NewLibrary(database, []string{musicDir}, c, store)
+	l.Scan()
+
+	// The NAS went away, the songs shouldn't
+	os.Rename(musicDir, musicDir+"-gone")
+	if result := l.Scan(); result.Removed != 0 || l.Status().Songs != 1 {
+		t.Errorf("Songs were removed when their directory couldn't be read: %+v\n", result)
+	}
+}
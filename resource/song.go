@@ -8,20 +8,29 @@ import (
 	"sync"
 	"time"
 
-	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/VivaLaPanda/uta-stream/events"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
 )
 
 type Song struct {
 	ipfsPath      string
 	url           *url.URL
 	Title         string
+	Artist        string
+	Album         string
+	Track         int    // Position on the album, 0 if unknown
+	Year          int    // Year released, 0 if unknown
+	Cover         string // Blob path of the cover art, empty if there's none
 	Duration      time.Duration
+	QueuedBy      string // Name of the user that asked for the song, empty for autoq picks
+	AutoPick      bool   // Whether the autoq picked the song
 	DLResult      chan string
 	DLFailure     chan error
 	reader        io.ReadCloser
 	Writer        io.WriteCloser
 	resolved      *sync.WaitGroup
 	resolutionErr error
+	lock          sync.RWMutex // guards what's filled in once resolved: ipfsPath, resolutionErr and a copy's details
 }
 
 func NewSong(resourceID string) (song *Song, err error) {
@@ -35,7 +44,7 @@ func NewSong(resourceID string) (song *Song, err error) {
 		resolved:  &sync.WaitGroup{},
 	}
 
-	if IsIpfs(resourceID) {
+	if storage.IsBlobPath(resourceID) {
 		song.ipfsPath = resourceID
 	} else {
 		song.url, err = url.Parse(resourceID)
@@ -51,6 +60,18 @@ func NewSong(resourceID string) (song *Song, err error) {
 	return song, nil
 }
 
+// NewStoredSong gives a song whose audio is already in the store at blobPath.
+// source is where the audio came from, it's shown as the song's url.
+func NewStoredSong(blobPath string, source *url.URL) *Song {
+	return &Song{
+		ipfsPath:  blobPath,
+		url:       source,
+		DLResult:  make(chan string, 1),
+		DLFailure: make(chan error, 1),
+		resolved:  &sync.WaitGroup{},
+	}
+}
+
 func (s *Song) MarshalJSON() ([]byte, error) {
 	var rawURL string
 	if s.URL() != nil {
@@ -59,24 +80,42 @@ func (s *Song) MarshalJSON() ([]byte, error) {
 		rawURL = ""
 	}
 
+	s.lock.RLock()
+	ipfsPath, d := s.ipfsPath, s.details()
+	s.lock.RUnlock()
+
 	// Sane defaults
-	if rawURL == "" {
-		rawURL = "https://ipfs.io" + s.IpfsPath()
+	if rawURL == "" && IsIpfs(ipfsPath) {
+		rawURL = "https://ipfs.io" + ipfsPath
 	}
-	if s.Title == "" {
-		s.Title = "Unknown Track"
+	if d.Title == "" {
+		d.Title = "Unknown Track"
 	}
 
 	return json.Marshal(&struct {
 		IpfsPath string        `json:"ipfsPath"`
 		URL      string        `json:"url"`
 		Title    string        `json:"title"`
+		Artist   string        `json:"artist,omitempty"`
+		Album    string        `json:"album,omitempty"`
+		Track    int           `json:"track,omitempty"`
+		Year     int           `json:"year,omitempty"`
+		Cover    string        `json:"cover,omitempty"`
 		Duration time.Duration `json:"duration"`
+		QueuedBy string        `json:"queuedBy,omitempty"`
+		AutoPick bool          `json:"autoPick,omitempty"`
 	}{
-		IpfsPath: s.IpfsPath(),
+		IpfsPath: ipfsPath,
 		URL:      rawURL,
-		Title:    s.Title,
-		Duration: s.Duration,
+		Title:    d.Title,
+		Artist:   d.Artist,
+		Album:    d.Album,
+		Track:    d.Track,
+		Year:     d.Year,
+		Cover:    d.Cover,
+		Duration: d.Duration,
+		QueuedBy: s.QueuedBy,
+		AutoPick: s.AutoPick,
 	})
 }
 
@@ -85,14 +124,21 @@ func (s *Song) UnmarshalJSON(data []byte) error {
 		IpfsPath string        `json:"ipfsPath"`
 		URL      string        `json:"url"`
 		Title    string        `json:"title"`
+		Artist   string        `json:"artist"`
+		Album    string        `json:"album"`
+		Track    int           `json:"track"`
+		Year     int           `json:"year"`
+		Cover    string        `json:"cover"`
 		Duration time.Duration `json:"duration"`
+		QueuedBy string        `json:"queuedBy"`
+		AutoPick bool          `json:"autoPick"`
 	}{}
 	if err := json.Unmarshal(data, &aux); err != nil {
 		return err
 	}
 
 	// Sane defaults
-	if aux.URL == "" {
+	if aux.URL == "" && IsIpfs(aux.IpfsPath) {
 		aux.URL = "https://ipfs.io" + aux.IpfsPath
 	}
 	if aux.Title == "" {
@@ -102,7 +148,14 @@ func (s *Song) UnmarshalJSON(data []byte) error {
 	// Construct the song
 	s.ipfsPath = aux.IpfsPath
 	s.Title = aux.Title
+	s.Artist = aux.Artist
+	s.Album = aux.Album
+	s.Track = aux.Track
+	s.Year = aux.Year
+	s.Cover = aux.Cover
 	s.Duration = aux.Duration
+	s.QueuedBy = aux.QueuedBy
+	s.AutoPick = aux.AutoPick
 	var err error
 	if s.url, err = url.Parse(aux.URL); err != nil {
 		s.url = nil
@@ -114,24 +167,147 @@ func (s *Song) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Copy gives a new song for the same audio that resolves when this one does.
+// Songs from the cache are shared, so this is used to give a queued song
+// details of its own, like who queued it. Details found while downloading
+// are passed on, unless the copy's have been changed.
+func (s *Song) Copy() *Song {
+	s.lock.RLock()
+	song := &Song{
+		ipfsPath:  s.ipfsPath,
+		url:       s.url,
+		Title:     s.Title,
+		Artist:    s.Artist,
+		Album:     s.Album,
+		Track:     s.Track,
+		Year:      s.Year,
+		Cover:     s.Cover,
+		Duration:  s.Duration,
+		QueuedBy:  s.QueuedBy,
+		AutoPick:  s.AutoPick,
+		DLResult:  make(chan string, 1),
+		DLFailure: make(chan error, 1),
+		resolved:  &sync.WaitGroup{},
+	}
+	s.lock.RUnlock()
+
+	copied := song.details()
+	song.resolved.Add(1)
+	go func() {
+		defer song.resolved.Done()
+		if s.resolved != nil {
+			s.resolved.Wait()
+		}
+		s.lock.RLock()
+		ipfsPath, resolutionErr, found := s.ipfsPath, s.resolutionErr, s.details()
+		s.lock.RUnlock()
+
+		// The copy is likely queued by now, so others may be reading it
+		song.lock.Lock()
+		defer song.lock.Unlock()
+		if song.ipfsPath == "" {
+			song.ipfsPath = ipfsPath
+		}
+		song.resolutionErr = resolutionErr
+		song.updateDetails(copied, found)
+	}()
+
+	return song
+}
+
+// details are what describe a song, as opposed to where its audio is
+type details struct {
+	Title    string
+	Artist   string
+	Album    string
+	Track    int
+	Year     int
+	Cover    string
+	Duration time.Duration
+}
+
+func (s *Song) details() details {
+	return details{s.Title, s.Artist, s.Album, s.Track, s.Year, s.Cover, s.Duration}
+}
+
+// SetDetails changes the song's details under its lock, for details found
+// while the song may already be shared, like once its download finishes. set
+// must only touch the song's fields.
+func (s *Song) SetDetails(set func(song *Song)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	set(s)
+}
+
+// updateDetails takes the details from src that this song still has as they
+// were in copied. The caller holds the lock.
+func (s *Song) updateDetails(copied details, src details) {
+	if s.Title == copied.Title {
+		s.Title = src.Title
+	}
+	if s.Artist == copied.Artist {
+		s.Artist = src.Artist
+	}
+	if s.Album == copied.Album {
+		s.Album = src.Album
+	}
+	if s.Track == copied.Track {
+		s.Track = src.Track
+	}
+	if s.Year == copied.Year {
+		s.Year = src.Year
+	}
+	if s.Cover == copied.Cover {
+		s.Cover = src.Cover
+	}
+	if s.Duration == copied.Duration {
+		s.Duration = src.Duration
+	}
+}
+
+// Name is how the song is shown to listeners, the artist and title
+func (s *Song) Name() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.Artist != "" {
+		return s.Artist + " - " + s.Title
+	}
+	return s.Title
+}
+
+// ResourceID gives the blob path if the song has one, otherwise its url. Songs
+// that are neither, like the placeholder shown while the next song loads,
+// give an empty string.
 func (s *Song) ResourceID() (resourceID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	// If we have the IPFS path fetch it right away
 	if s.ipfsPath != "" {
 		return s.ipfsPath
 	}
 
 	// Check to see if a download we were wairing on finished, if so
-	// return the IPFS path, otherwise just return the URL
+	// return the blob path, otherwise just return the URL
 	select {
 	case resourceID = <-s.DLResult:
 		s.ipfsPath = resourceID
+		// Hand it back, the resolver is waiting on it too
+		s.DLResult <- resourceID
 		return resourceID
 	default:
+		if s.url == nil {
+			return ""
+		}
 		return s.url.String()
 	}
 }
 
+// IpfsPath returns where the song's audio lives in the blob store. Named from
+// before the store was pluggable, the path may not be an IPFS one.
 func (s *Song) IpfsPath() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.ipfsPath
 }
 
@@ -144,39 +320,56 @@ func (s *Song) resolver() {
 
 	if s.reader != nil {
 		return
-	} else if s.ipfsPath != "" {
+	} else if s.IpfsPath() != "" {
 		return
 	} else if s.DLResult == nil {
+		s.lock.Lock()
 		s.resolutionErr = fmt.Errorf("song was cached without download hash")
+		s.lock.Unlock()
 		return
 	}
 
 	// Check to see if we had a DL we were waiting on, if so store the result
 	select {
-	case s.resolutionErr = <-s.DLFailure:
+	case err := <-s.DLFailure:
+		s.lock.Lock()
+		s.resolutionErr = err
+		title := s.Title
+		s.lock.Unlock()
+		events.Publish(events.DownloadFailure, struct {
+			URL   string `json:"url"`
+			Title string `json:"title"`
+			Error string `json:"error"`
+		}{s.url.String(), title, err.Error()})
 		return
-	case s.ipfsPath = <-s.DLResult:
+	case ipfsPath := <-s.DLResult:
+		s.lock.Lock()
+		s.ipfsPath = ipfsPath
+		s.lock.Unlock()
 		return
 	}
 }
 
 // Resolve works sort of like a js Observable, in that n callers will wait
 // until the song is resolved, and then all get the same data.
-func (s *Song) Resolve(ipfs *shell.Shell) (reader io.ReadCloser, err error) {
+func (s *Song) Resolve(store storage.BlobStore) (reader io.ReadCloser, err error) {
 	s.resolved.Wait()
+	s.lock.RLock()
+	ipfsPath, resolutionErr := s.ipfsPath, s.resolutionErr
+	s.lock.RUnlock()
 
 	// If we have a reader from the DL, that's the priority, otherwise return the
-	// ipfs reader if we can
-	if s.resolutionErr != nil {
-		return nil, s.resolutionErr
-	} else if s.ipfsPath != "" {
-		reader, err = ipfs.Cat(s.ipfsPath)
+	// store's reader if we can
+	if resolutionErr != nil {
+		return nil, resolutionErr
+	} else if ipfsPath != "" {
+		reader, err = store.Get(ipfsPath)
 
 		// Sometimes ipfs just stops responding under heavy load
 		// Wait 5 sec and retry
 		if err != nil {
 			time.Sleep(5 * time.Second)
-			return ipfs.Cat(s.ipfsPath)
+			return store.Get(ipfsPath)
 		}
 		return reader, err
 	}
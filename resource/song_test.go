@@ -1,9 +1,10 @@
 package resource
 
 import (
+	"strings"
 	"testing"
 
-	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
 )
 
 func TestNewSong(t *testing.T) {
@@ -33,6 +34,77 @@ func TestJson(t *testing.T) {
 	}
 }
 
+func TestCopy(t *testing.T) {
+	store, err := storage.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Errorf("Failed to make store. Err: %v\n", err)
+		return
+	}
+	blobPath, _ := store.Put(strings.NewReader("song"))
+	original, _ := NewSong(blobPath)
+
+	song := original.Copy()
+	song.QueuedBy = "foo"
+	if original.QueuedBy != "" {
+		t.Errorf("Changing the copy shouldn't change the original\n")
+	}
+
+	reader, err := song.Resolve(store)
+	if err != nil {
+		t.Errorf("Copy should resolve like the original. Err: %v\n", err)
+		return
+	}
+	reader.Close()
+
+	json, _ := song.MarshalJSON()
+	restored := &Song{}
+	restored.UnmarshalJSON(json)
+	if restored.QueuedBy != "foo" {
+		t.Errorf("QueuedBy was lost in JSON. Output: %s\n", json)
+	}
+}
+
+func TestJsonDetails(t *testing.T) {
+	song, _ := NewSong("https://example.com/song.mp3")
+	song.Title, song.Artist, song.Album = "Title", "Artist", "Album"
+	song.Track, song.Year, song.Cover = 3, 1999, "/ipfs/QmRRKwCPfmAf8A9crYCisfFuSDbwerthf5NBQ2h334vQsb"
+
+	json, _ := song.MarshalJSON()
+	restored := &Song{}
+	if err := restored.UnmarshalJSON(json); err != nil {
+		t.Errorf("failed to unmarshal JSON. Err: %s", err)
+		return
+	}
+	if restored.Album != "Album" || restored.Track != 3 || restored.Year != 1999 || restored.Cover != song.Cover {
+		t.Errorf("Details were lost in JSON. Output: %s\n", json)
+	}
+
+	// Songs saved before the details existed still load
+	old := &Song{}
+	err := old.UnmarshalJSON([]byte(`{"ipfsPath":"","url":"https://example.com/song.mp3","title":"Title","duration":0}`))
+	if err != nil || old.Title != "Title" || old.Album != "" || old.Track != 0 {
+		t.Errorf("Old song didn't load. Err: %v, Song: %+v\n", err, old)
+	}
+}
+
+func TestCopyDetails(t *testing.T) {
+	original, _ := NewSong("https://example.com/song.mp3")
+	original.Title = "song.mp3"
+
+	song := original.Copy()
+	song.Artist = "Someone Else"
+
+	// Details read from the download make it onto the copy, unless the copy
+	// has its own
+	original.Title, original.Artist, original.Album = "Title", "Artist", "Album"
+	original.DLResult <- "/ipfs/QmRRKwCPfmAf8A9crYCisfFuSDbwerthf5NBQ2h334vQsb"
+	song.resolved.Wait()
+
+	if song.Title != "Title" || song.Album != "Album" || song.Artist != "Someone Else" {
+		t.Errorf("Copy didn't get the right details: %+v\n", song)
+	}
+}
+
 func TestResourceID(t *testing.T) {
 	rawUrl := "https://youtu.be/nAwTw1aYy6M"
 	song, _ := NewSong(rawUrl)
@@ -63,18 +135,73 @@ func TestResourceID(t *testing.T) {
 	}
 }
 
+func TestPlaceholderResourceID(t *testing.T) {
+	// The mixer shows these while nothing is playing
+	placeholder := &Song{Title: "Loading Next Song"}
+	if resourceID := placeholder.ResourceID(); resourceID != "" {
+		t.Errorf("Placeholder shouldn't have a resource ID, got %s\n", resourceID)
+	}
+}
+
 func TestResolve(t *testing.T) {
 	rawUrl := "https://youtu.be/nAwTw1aYy6M"
-	ipfsUrl := "localhost:5001"
 
-	// Setup shell and testing url
-	sh := shell.NewShell(ipfsUrl)
+	// Setup store and testing url
+	store, _ := storage.NewLocalStore(t.TempDir())
 	song, _ := NewSong(rawUrl)
 
-	expectedIpfs := "/ipfs/QmQmjmsqhvTNsvZGrwBMhGEX5THCoWs2GWjszJ48tnr3Uf"
-	song.DLResult <- expectedIpfs
-	reader, err := song.Resolve(sh)
+	blobPath, _ := store.Put(strings.NewReader("not really audio"))
+	song.DLResult <- blobPath
+	reader, err := song.Resolve(store)
 	if reader == nil {
 		t.Errorf("Resolve failed to produce a reader. Err: %s", err)
 	}
 }
+
+func TestCopyReadWhileResolving(t *testing.T) {
+	original, _ := NewSong("https://example.com/song.mp3")
+	song := original.Copy()
+
+	// A queued copy gets saved and listed while its download finishes, run
+	// with -race to check the details are handed over safely
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			song.MarshalJSON()
+			song.Name()
+			song.ResourceID()
+		}
+		done <- true
+	}()
+	original.Title = "Title"
+	original.DLResult <- "/ipfs/QmRRKwCPfmAf8A9crYCisfFuSDbwerthf5NBQ2h334vQsb"
+	<-done
+	song.resolved.Wait()
+
+	if song.Name() != "Title" {
+		t.Errorf("Copy didn't get the title, got %s\n", song.Name())
+	}
+}
+
+func TestSetDetailsWhileShared(t *testing.T) {
+	song, _ := NewSong("https://example.com/song.mp3")
+
+	// Downloads fill in details while the song is being copied and listed,
+	// run with -race to check that's safe
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			song.Copy()
+			song.MarshalJSON()
+		}
+		done <- true
+	}()
+	song.SetDetails(func(song *Song) {
+		song.Title, song.Artist = "Title", "Artist"
+	})
+	<-done
+
+	if song.Name() != "Artist - Title" {
+		t.Errorf("Details weren't set, got %s\n", song.Name())
+	}
+}
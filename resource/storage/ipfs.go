@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+const ipfsPrefix = "/ipfs/"
+
+// IpfsStore keeps blobs in the IPFS daemon at the provided url. Everything
+// added or fetched is pinned so the daemon won't garbage collect it.
+type IpfsStore struct {
+	ipfs *shell.Shell
+}
+
+// NewIpfsStore returns a store backed by the IPFS daemon at ipfsUrl
+func NewIpfsStore(ipfsUrl string) *IpfsStore {
+	ipfs := shell.NewShell(ipfsUrl)
+	ipfs.SetTimeout(time.Minute * 30)
+
+	return &IpfsStore{ipfs: ipfs}
+}
+
+// Put adds the data to IPFS and returns it as a proper ipfs path, not just hash
+func (s *IpfsStore) Put(r io.Reader) (path string, err error) {
+	hash, err := s.ipfs.Add(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to add to IPFS. Err: %v", err)
+	}
+
+	return ipfsPrefix + hash, nil
+}
+
+// Get will fetch the provided ipfs path. Any time we fetch we also pin.
+func (s *IpfsStore) Get(path string) (io.ReadCloser, error) {
+	go func() {
+		err := s.ipfs.Pin(path)
+		if err != nil {
+			log.Printf("Failed to pin IPFS path! %v may not play later\n", err)
+		}
+	}()
+
+	return s.ipfs.Cat(path)
+}
+
+// Has reports whether the local daemon has the path pinned
+func (s *IpfsStore) Has(path string) bool {
+	err := s.ipfs.Request("pin/ls", path).
+		Option("type", shell.RecursivePin).
+		Exec(context.Background(), nil)
+
+	return err == nil
+}
+
+// Delete unpins the path. IPFS can't really delete anything, but once it's
+// unpinned the daemon is free to garbage collect it.
+func (s *IpfsStore) Delete(path string) error {
+	return s.ipfs.Unpin(path)
+}
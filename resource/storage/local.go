@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const localPrefix = "/blob/"
+
+// LocalStore keeps blobs as plain files in a directory on disk, named after
+// the sha256 of their contents. Lets the server run without an IPFS daemon.
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore returns a store which keeps its files in dir, creating the
+// directory if it doesn't exist yet
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory %s. Err: %v", dir, err)
+	}
+
+	return &LocalStore{dir: dir}, nil
+}
+
+// Put writes the data to a temp file while hashing it, then moves it into
+// place under its hash
+func (s *LocalStore) Put(r io.Reader) (path string, err error) {
+	tempFile, err := ioutil.TempFile(s.dir, "incoming-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create blob file. Err: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tempFile, hasher), r)
+	tempFile.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to write blob. Err: %v", err)
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if err = os.Rename(tempFile.Name(), filepath.Join(s.dir, hash)); err != nil {
+		return "", fmt.Errorf("failed to move blob into place. Err: %v", err)
+	}
+
+	return localPrefix + hash, nil
+}
+
+// Get opens the file for the provided path
+func (s *LocalStore) Get(path string) (io.ReadCloser, error) {
+	filename, err := s.filename(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(filename)
+}
+
+// Has reports whether there is a file for the provided path
+func (s *LocalStore) Has(path string) bool {
+	filename, err := s.filename(path)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filename)
+
+	return err == nil
+}
+
+// Delete removes the file for the provided path
+func (s *LocalStore) Delete(path string) error {
+	filename, err := s.filename(path)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(filename)
+}
+
+// filename translates a blob path into the file on disk, refusing anything
+// that isn't a plain hash so paths can't escape the directory
+func (s *LocalStore) filename(path string) (string, error) {
+	if !strings.HasPrefix(path, localPrefix) {
+		return "", fmt.Errorf("%s is not a local blob path", path)
+	}
+	hash := path[len(localPrefix):]
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+		return "", fmt.Errorf("%s is not a valid blob hash", hash)
+	}
+
+	return filepath.Join(s.dir, hash), nil
+}
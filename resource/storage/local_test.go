@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLocalPutGet(t *testing.T) {
+	s, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Errorf("Failed to create local store. Err: %v\n", err)
+		return
+	}
+
+	data := []byte("not really an mp3")
+	path, err := s.Put(bytes.NewReader(data))
+	if err != nil {
+		t.Errorf("Failed to put blob. Err: %v\n", err)
+		return
+	}
+	if !IsBlobPath(path) {
+		t.Errorf("Put returned a path that isn't recognized as a blob path: %s\n", path)
+	}
+
+	// Same data, same path
+	secondPath, _ := s.Put(bytes.NewReader(data))
+	if secondPath != path {
+		t.Errorf("Putting the same data twice gave different paths. %s != %s\n", path, secondPath)
+	}
+
+	if !s.Has(path) {
+		t.Errorf("Store doesn't report having a blob we just put\n")
+	}
+
+	reader, err := s.Get(path)
+	if err != nil {
+		t.Errorf("Failed to get blob. Err: %v\n", err)
+		return
+	}
+	stored, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if !bytes.Equal(stored, data) {
+		t.Errorf("Blob changed after put and get. e: %s, a: %s\n", data, stored)
+	}
+}
+
+func TestLocalDelete(t *testing.T) {
+	s, _ := NewLocalStore(t.TempDir())
+	path, _ := s.Put(bytes.NewReader([]byte("foo")))
+
+	if err := s.Delete(path); err != nil {
+		t.Errorf("Failed to delete blob. Err: %v\n", err)
+	}
+	if s.Has(path) {
+		t.Errorf("Store still has blob after delete\n")
+	}
+}
+
+func TestLocalBadPath(t *testing.T) {
+	s, _ := NewLocalStore(t.TempDir())
+
+	badPaths := []string{"/ipfs/QmQmjmsqhvTNsvZGrwBMhGEX5THCoWs2GWjszJ48tnr3Uf", "/blob/../../etc/passwd", "/blob/abc"}
+	for _, path := range badPaths {
+		if _, err := s.Get(path); err == nil {
+			t.Errorf("Get should have refused path %s\n", path)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Package storage provides the content-addressed blob stores that hold the
+// audio for every cached song. Which backend is used is decided at launch, the
+// rest of the server only talks to the BlobStore interface.
+package storage
+
+import (
+	"io"
+	"strings"
+)
+
+// BlobStore describes somewhere audio can be put and later fetched back by the
+// path the store handed out. Paths are content addressed, so putting the same
+// data twice will give back the same path.
+type BlobStore interface {
+	// Put stores all the data from the reader and returns the path to fetch it
+	Put(r io.Reader) (path string, err error)
+	// Get returns a reader for the data at the provided path. Callers must close it.
+	Get(path string) (io.ReadCloser, error)
+	// Has reports whether the store holds the data at the provided path
+	Has(path string) bool
+	// Delete removes the data at the provided path from the store
+	Delete(path string) error
+}
+
+// IsBlobPath reports whether the resourceID is a path handed out by one of the
+// blob stores, as opposed to a url that still needs downloading
+func IsBlobPath(resourceID string) bool {
+	return strings.HasPrefix(resourceID, ipfsPrefix) || strings.HasPrefix(resourceID, localPrefix)
+}
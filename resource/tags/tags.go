@@ -0,0 +1,153 @@
+// Package tags reads the details embedded in audio files, like title and
+// artist, using ffprobe.
+package tags
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/resource"
+	"github.com/VivaLaPanda/uta-stream/resource/storage"
+)
+
+// Tags are the details found in an audio file. Anything the file doesn't
+// have is left empty.
+type Tags struct {
+	Title    string
+	Artist   string
+	Album    string
+	Track    int
+	Year     int
+	Duration time.Duration
+	Audio    bool // whether there's an audio stream, images and text probe fine too
+	Cover    bool // whether there's cover art embedded, get it with StoreCover
+}
+
+// probeOutput is the part of ffprobe's json we care about
+type probeOutput struct {
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType   string `json:"codec_type"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+}
+
+// Read gets the tags out of the audio file. Requires ffprobe (which comes
+// with ffmpeg) to be in PATH.
+func Read(filename string) (Tags, error) {
+	ffprobe, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return Tags{}, fmt.Errorf("ffprobe was not found in PATH. Please install ffmpeg")
+	}
+
+	out, err := exec.Command(ffprobe, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", filename).Output()
+	if err != nil {
+		return Tags{}, fmt.Errorf("ffprobe couldn't read %s. Err: %v", filename, err)
+	}
+	return parse(out)
+}
+
+// parse reads the tags out of ffprobe's json
+func parse(probeData []byte) (Tags, error) {
+	probe := probeOutput{}
+	if err := json.Unmarshal(probeData, &probe); err != nil {
+		return Tags{}, fmt.Errorf("failed to parse ffprobe output. Err: %v", err)
+	}
+
+	// Tag names differ in case between formats, FLAC tends to shout
+	fields := make(map[string]string)
+	for name, value := range probe.Format.Tags {
+		fields[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+	first := func(names ...string) string {
+		for _, name := range names {
+			if fields[name] != "" {
+				return fields[name]
+			}
+		}
+		return ""
+	}
+
+	found := Tags{
+		Title:  first("title"),
+		Artist: first("artist", "album_artist"),
+		Album:  first("album"),
+		// Tracks are often "3/12", dates "2019-05-01"
+		Track: leadingNumber(first("track", "tracknumber")),
+		Year:  leadingNumber(first("date", "year", "originaldate")),
+	}
+	if secs, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		found.Duration = time.Duration(secs * float64(time.Second))
+	}
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "audio" {
+			found.Audio = true
+		} else if stream.CodecType == "video" && stream.Disposition.AttachedPic == 1 {
+			found.Cover = true
+		}
+	}
+	return found, nil
+}
+
+// leadingNumber reads the number the value starts with, 0 if there isn't one
+func leadingNumber(value string) int {
+	end := 0
+	for end < len(value) && value[end] >= '0' && value[end] <= '9' {
+		end++
+	}
+	number, _ := strconv.Atoi(value[:end])
+	return number
+}
+
+// Apply fills in the details the song is missing from the tags. The
+// duration is always replaced, the file's is exact where a site's isn't.
+func (found Tags) Apply(song *resource.Song) {
+	if song.Title == "" {
+		song.Title = found.Title
+	}
+	if song.Artist == "" {
+		song.Artist = found.Artist
+	}
+	if song.Album == "" {
+		song.Album = found.Album
+	}
+	if song.Track == 0 {
+		song.Track = found.Track
+	}
+	if song.Year == 0 {
+		song.Year = found.Year
+	}
+	if found.Duration > 0 {
+		song.Duration = found.Duration
+	}
+}
+
+// StoreCover puts the cover art embedded in the audio file into the store
+// and returns its blob path. Requires ffmpeg to be in PATH.
+func StoreCover(filename string, store storage.BlobStore) (blobPath string, err error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg was not found in PATH. Please install ffmpeg")
+	}
+
+	// The cover is kept as it was embedded, usually a jpeg or png
+	out, err := exec.Command(ffmpeg, "-v", "quiet", "-i", filename,
+		"-an", "-map", "0:v:0", "-c:v", "copy", "-frames:v", "1", "-f", "image2pipe", "-").Output()
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg couldn't get the cover out of %s. Err: %v", filename, err)
+	}
+	if len(out) == 0 {
+		return "", fmt.Errorf("%s has no cover", filename)
+	}
+	return store.Put(bytes.NewReader(out))
+}
@@ -0,0 +1,46 @@
+package tags
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/resource"
+)
+
+func TestParse(t *testing.T) {
+	probeData := []byte(`{"format": {
+		"filename": "song.flac",
+		"duration": "183.500000",
+		"tags": {"TITLE": "Song", "ALBUM_ARTIST": "Some Artist", "ALBUM": "Album", "track": "3/12", "DATE": "1999-05-01"}
+	}, "streams": [{"codec_type": "audio"}, {"codec_type": "video", "disposition": {"attached_pic": 1}}]}`)
+
+	found, err := parse(probeData)
+	if err != nil {
+		t.Errorf("Failed to parse ffprobe output. Err: %v\n", err)
+		return
+	}
+	if found.Title != "Song" || found.Artist != "Some Artist" || found.Duration != 183500*time.Millisecond || !found.Audio {
+		t.Errorf("Tags weren't read correctly: %+v\n", found)
+	}
+	if found.Album != "Album" || found.Track != 3 || found.Year != 1999 || !found.Cover {
+		t.Errorf("Album details weren't read correctly: %+v\n", found)
+	}
+
+	// Files without tags are fine, they just don't tell us much
+	if found, err = parse([]byte(`{"format": {}}`)); err != nil || found.Title != "" || found.Audio || found.Cover {
+		t.Errorf("Untagged file should give empty tags, got %+v (Err: %v)\n", found, err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	song, _ := resource.NewSong("https://example.com/song.mp3")
+	song.Title = "Site Title"
+	song.Duration = 183 * time.Second
+
+	found := Tags{Title: "Tag Title", Artist: "Artist", Track: 3, Duration: 183500 * time.Millisecond}
+	found.Apply(song)
+	// What the song already knows stays, but the file's duration is exact
+	if song.Title != "Site Title" || song.Artist != "Artist" || song.Track != 3 || song.Duration != 183500*time.Millisecond {
+		t.Errorf("Tags weren't applied correctly: %+v\n", song)
+	}
+}
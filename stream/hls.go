@@ -0,0 +1,202 @@
+package stream
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many old segments to keep around past the end of the playlist, so that
+// clients that fetched the playlist just before it rolled can still get them
+const hlsSpareSegments = 2
+
+// segment is one piece of the rolling HLS stream
+type segment struct {
+	seq      int
+	data     []byte
+	duration time.Duration
+	start    time.Time
+	title    string
+	songID   int  // counts up every time the title changes
+	newSong  bool // whether a song starts in this segment
+}
+
+// segmenter cuts a live mp3 stream into segments of roughly the target
+// length, always at a frame boundary, and keeps the last few of them to be
+// served as an HLS playlist
+type segmenter struct {
+	bytesPerSecond int
+	target         time.Duration
+	window         int
+	nowPlaying     func() string
+	now            func() time.Time
+
+	lock      *sync.RWMutex
+	segments  []*segment
+	nextSeq   int
+	pending   []byte
+	nextStart time.Time
+	songID    int
+	lastTitle string
+}
+
+func newSegmenter(bitrate int, target time.Duration, window int, nowPlaying func() string) *segmenter {
+	return &segmenter{
+		bytesPerSecond: bitrate * 1000 / 8,
+		target:         target,
+		window:         window,
+		nowPlaying:     nowPlaying,
+		now:            time.Now,
+		lock:           &sync.RWMutex{},
+	}
+}
+
+// isFrameSync reports whether a valid mp3 frame header starts at idx
+func isFrameSync(data []byte, idx int) bool {
+	if idx+2 >= len(data) {
+		return false
+	}
+	return data[idx] == 0xFF && data[idx+1]&0xE0 == 0xE0 &&
+		data[idx+2]>>4 != 0xF && (data[idx+2]>>2)&0x3 != 0x3
+}
+
+// write takes the next piece of the stream, closing off a segment whenever
+// enough audio has built up
+func (s *segmenter) write(audio []byte) {
+	if s.nextStart.IsZero() {
+		s.nextStart = s.now()
+	}
+	s.pending = append(s.pending, audio...)
+
+	targetBytes := int(s.target.Seconds() * float64(s.bytesPerSecond))
+	for len(s.pending) > targetBytes {
+		cut := -1
+		for idx := targetBytes; idx < len(s.pending); idx++ {
+			if isFrameSync(s.pending, idx) {
+				cut = idx
+				break
+			}
+		}
+		if cut == -1 {
+			// The next frame hasn't arrived yet
+			return
+		}
+		s.addSegment(s.pending[:cut])
+		s.pending = append([]byte{}, s.pending[cut:]...)
+	}
+}
+
+// addSegment appends the data as a new segment and drops any that have
+// fallen too far out of the window
+func (s *segmenter) addSegment(data []byte) {
+	seg := &segment{
+		seq:      s.nextSeq,
+		data:     append([]byte{}, data...),
+		duration: time.Duration(float64(len(data)) / float64(s.bytesPerSecond) * float64(time.Second)),
+		start:    s.nextStart,
+		title:    s.nowPlaying(),
+	}
+	if seg.seq == 0 || seg.title != s.lastTitle {
+		s.songID++
+		seg.newSong = true
+		s.lastTitle = seg.title
+	}
+	seg.songID = s.songID
+	s.nextSeq++
+	s.nextStart = seg.start.Add(seg.duration)
+
+	s.lock.Lock()
+	s.segments = append(s.segments, seg)
+	if len(s.segments) > s.window+hlsSpareSegments {
+		s.segments = s.segments[len(s.segments)-s.window-hlsSpareSegments:]
+	}
+	s.lock.Unlock()
+}
+
+// playlist renders the live m3u8 for the newest segments. segmentPath is
+// the prefix segment numbers are appended to.
+func (s *segmenter) playlist(segmentPath string) string {
+	s.lock.RLock()
+	live := s.segments
+	if len(live) > s.window {
+		live = live[len(live)-s.window:]
+	}
+	s.lock.RUnlock()
+
+	maxDuration := s.target
+	for _, seg := range live {
+		if seg.duration > maxDuration {
+			maxDuration = seg.duration
+		}
+	}
+	firstSeq := 0
+	if len(live) > 0 {
+		firstSeq = live[0].seq
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "#EXTM3U\n")
+	fmt.Fprintf(b, "#EXT-X-VERSION:3\n")
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(maxDuration.Seconds())))
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", firstSeq)
+	for _, seg := range live {
+		fmt.Fprintf(b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.start.UTC().Format("2006-01-02T15:04:05.000Z"))
+		if seg.newSong {
+			fmt.Fprintf(b, "#EXT-X-DATERANGE:ID=\"song-%d\",START-DATE=\"%s\",X-TITLE=\"%s\"\n",
+				seg.songID, seg.start.UTC().Format("2006-01-02T15:04:05.000Z"), strings.ReplaceAll(seg.title, "\"", "'"))
+		}
+		fmt.Fprintf(b, "#EXTINF:%.3f,%s\n", seg.duration.Seconds(), strings.ReplaceAll(seg.title, "\n", " "))
+		fmt.Fprintf(b, "%s%d.mp3\n", segmentPath, seg.seq)
+	}
+
+	return b.String()
+}
+
+// segment finds the data for the segment with the provided sequence number
+func (s *segmenter) segment(seq int) []byte {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, seg := range s.segments {
+		if seg.seq == seq {
+			return seg.data
+		}
+	}
+	return nil
+}
+
+// servePlaylist is the handler for the mount's m3u8
+func (s *segmenter) servePlaylist(segmentPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		fmt.Fprint(w, s.playlist(segmentPath))
+	}
+}
+
+// serveSegments is the handler for the segments themselves, requested as
+// segmentPath followed by the sequence number and .mp3
+func (s *segmenter) serveSegments(segmentPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, segmentPath), ".mp3")
+		seq, err := strconv.Atoi(name)
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		data := s.segment(seq)
+		if data == nil {
+			http.NotFound(w, req)
+			return
+		}
+
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(data)
+	}
+}
@@ -0,0 +1,58 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeMp3 makes n bytes of stream with a frame header every frameLen bytes
+func fakeMp3(n int, frameLen int) []byte {
+	data := make([]byte, n)
+	for idx := 0; idx+2 < n; idx += frameLen {
+		data[idx], data[idx+1], data[idx+2] = 0xFF, 0xFB, 0x90
+	}
+	return data
+}
+
+func TestSegmenter(t *testing.T) {
+	title := "Song A"
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// 8kbps is 1000 bytes a second, so segments should be 1000 bytes
+	s := newSegmenter(8, time.Second, 2, func() string { return title })
+	s.now = func() time.Time { return start }
+
+	s.write(fakeMp3(2500, 100))
+	if len(s.segments) != 2 {
+		t.Errorf("Expected 2 segments, got %d\n", len(s.segments))
+		return
+	}
+	if len(s.segments[0].data) != 1000 || s.segments[0].duration != time.Second {
+		t.Errorf("Segment should be cut at the first frame past 1s. Length: %d, duration: %v\n",
+			len(s.segments[0].data), s.segments[0].duration)
+	}
+	if !s.segments[1].start.Equal(start.Add(time.Second)) {
+		t.Errorf("Second segment should start where the first ended. Start: %v\n", s.segments[1].start)
+	}
+
+	title = "Song B"
+	s.write(fakeMp3(1500, 100))
+	playlist := s.playlist("/stream/")
+
+	// Window is 2, so only segments 1 and 2 should be listed
+	if !strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:1\n") ||
+		strings.Contains(playlist, "/stream/0.mp3") || !strings.Contains(playlist, "/stream/2.mp3") {
+		t.Errorf("Playlist didn't list the right window of segments:\n%s\n", playlist)
+	}
+	if !strings.Contains(playlist, "#EXT-X-PROGRAM-DATE-TIME:2020-01-01T00:00:02.000Z") {
+		t.Errorf("Playlist is missing segment dates:\n%s\n", playlist)
+	}
+	if !strings.Contains(playlist, `X-TITLE="Song B"`) || strings.Contains(playlist, `X-TITLE="Song A"`) {
+		t.Errorf("Playlist should mark the start of song B only:\n%s\n", playlist)
+	}
+
+	// Old segments stick around briefly for slow clients
+	if s.segment(0) == nil {
+		t.Errorf("Segment that just left the window should still be available\n")
+	}
+}
@@ -0,0 +1,103 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// How many bytes of audio we send between metadata blocks. Clients are told
+// this through the icy-metaint header.
+const icyMetaInt = 16000
+
+// The length byte counts in 16 byte blocks, so this is the most a metadata
+// block can hold
+const icyMaxMeta = 255 * 16
+
+// icyWriter interleaves SHOUTcast style metadata into an audio stream. Every
+// metaInt bytes of audio it writes a length byte followed by the metadata,
+// or a zero length byte if the title hasn't changed since the last block.
+type icyWriter struct {
+	out        io.Writer
+	metaInt    int
+	nowPlaying func() string
+
+	untilMeta int    // audio bytes left before the next metadata block
+	lastTitle string // what we last told the client was playing
+	sentTitle bool
+}
+
+func newIcyWriter(out io.Writer, metaInt int, nowPlaying func() string) *icyWriter {
+	return &icyWriter{
+		out:        out,
+		metaInt:    metaInt,
+		nowPlaying: nowPlaying,
+		untilMeta:  metaInt,
+	}
+}
+
+// Write passes the audio through, splitting it wherever a metadata block is due
+func (w *icyWriter) Write(audio []byte) (n int, err error) {
+	for len(audio) > 0 {
+		chunk := audio
+		if len(chunk) > w.untilMeta {
+			chunk = chunk[:w.untilMeta]
+		}
+		written, err := w.out.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		audio = audio[len(chunk):]
+
+		w.untilMeta -= len(chunk)
+		if w.untilMeta == 0 {
+			if _, err = w.out.Write(w.metaBlock()); err != nil {
+				return n, err
+			}
+			w.untilMeta = w.metaInt
+		}
+	}
+
+	return n, nil
+}
+
+// metaBlock builds the next metadata block, length byte included
+func (w *icyWriter) metaBlock() []byte {
+	title := w.nowPlaying()
+	if w.sentTitle && title == w.lastTitle {
+		return []byte{0}
+	}
+	w.lastTitle = title
+	w.sentTitle = true
+
+	return icyMetadata(title)
+}
+
+// icyMetadata formats the title as a StreamTitle block, zero padded to a
+// multiple of 16 bytes and prefixed with its length in 16 byte units
+func icyMetadata(title string) []byte {
+	// There's no escaping in icy metadata and clients end the title at the
+	// first quote, so swap quotes for apostrophes that look the same
+	title = strings.ReplaceAll(title, "'", "’")
+
+	// Cut the title down rather than the terminator so clients can still
+	// parse it, and back up to the start of a character so none get split
+	maxTitle := icyMaxMeta - len("StreamTitle='';")
+	if len(title) > maxTitle {
+		cut := maxTitle
+		for cut > 0 && !utf8.RuneStart(title[cut]) {
+			cut--
+		}
+		title = title[:cut]
+	}
+	meta := fmt.Sprintf("StreamTitle='%s';", title)
+
+	blocks := (len(meta) + 15) / 16
+	block := make([]byte, 1+blocks*16)
+	block[0] = byte(blocks)
+	copy(block[1:], meta)
+
+	return block
+}
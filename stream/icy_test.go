@@ -0,0 +1,67 @@
+package stream
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestIcyMetadata(t *testing.T) {
+	block := icyMetadata("Song")
+	meta := "StreamTitle='Song';"
+	if int(block[0]) != 2 || len(block) != 33 {
+		t.Errorf("Metadata should take 2 blocks of 16 bytes. Length byte: %d, total: %d\n", block[0], len(block))
+		return
+	}
+	if !bytes.HasPrefix(block[1:], []byte(meta)) {
+		t.Errorf("Metadata block didn't contain the title. Output: %q\n", block[1:])
+	}
+
+	long := icyMetadata(string(bytes.Repeat([]byte("a"), 5000)))
+	if int(long[0]) != 255 || !bytes.HasSuffix(long, []byte("';")) {
+		t.Errorf("Long titles should be cut to fit. Length byte: %d\n", long[0])
+	}
+
+	quoted := icyMetadata("Don't Stop")
+	if !bytes.HasPrefix(quoted[1:], []byte("StreamTitle='Don\u2019t Stop';")) {
+		t.Errorf("Quotes in the title should be swapped out. Output: %q\n", quoted[1:])
+	}
+
+	// 4 byte characters don't fill the space evenly, so one would get split
+	wide := icyMetadata(strings.Repeat("\U0001F3B5", 2000))
+	wideMeta := bytes.TrimRight(wide[1:], "\x00")
+	if !utf8.Valid(wideMeta) || !bytes.HasSuffix(wideMeta, []byte("';")) {
+		t.Errorf("Long titles should be cut between characters. Output ends: %q\n", wideMeta[len(wideMeta)-8:])
+	}
+}
+
+func TestIcyWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	title := "Song A"
+	w := newIcyWriter(out, 10, func() string { return title })
+
+	// Split across writes to check the interval carries over
+	w.Write(bytes.Repeat([]byte{1}, 6))
+	w.Write(bytes.Repeat([]byte{1}, 14))
+	w.Write(bytes.Repeat([]byte{1}, 10))
+
+	expected := &bytes.Buffer{}
+	expected.Write(bytes.Repeat([]byte{1}, 10))
+	expected.Write(icyMetadata("Song A"))
+	expected.Write(bytes.Repeat([]byte{1}, 10))
+	expected.Write([]byte{0}) // Title hasn't changed
+	expected.Write(bytes.Repeat([]byte{1}, 10))
+	expected.Write([]byte{0})
+
+	if !bytes.Equal(out.Bytes(), expected.Bytes()) {
+		t.Errorf("Metadata wasn't interleaved at the interval.\ne: %q\na: %q\n", expected.Bytes(), out.Bytes())
+	}
+
+	title = "Song B"
+	out.Reset()
+	w.Write(bytes.Repeat([]byte{1}, 10))
+	if !bytes.Contains(out.Bytes(), []byte("StreamTitle='Song B';")) {
+		t.Errorf("New title wasn't sent after it changed. Output: %q\n", out.Bytes())
+	}
+}
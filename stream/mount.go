@@ -0,0 +1,189 @@
+package stream
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VivaLaPanda/uta-stream/events"
+)
+
+// Content types for the codecs a mount can carry
+var contentTypes = map[string]string{
+	"mp3":  "audio/mpeg",
+	"opus": "audio/ogg",
+}
+
+// Mount is one of the streams published by the audio server. Each mount has
+// its own path, encoding and set of listeners.
+type Mount struct {
+	Path    string
+	Codec   string // mp3 or opus
+	Bitrate int    // in kbps
+
+	consumers      map[string]chan []byte
+	killConsumer   chan string
+	consumerWLock  *sync.Mutex
+	lastChunks     *list.List
+	lastChunksLock *sync.RWMutex
+
+	hlsSegment time.Duration
+	hlsWindow  int
+	hls        *segmenter
+	hlsClients map[string]time.Time // when each HLS client last fetched the playlist, guarded by consumerWLock
+}
+
+// Mounts is the full set of streams the audio server publishes
+type Mounts []*Mount
+
+// NewMount makes a mount serving audio in the codec at the bitrate on the path
+func NewMount(path string, codec string, bitrate int) (*Mount, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("mount path %s should start with /", path)
+	}
+	if _, exists := contentTypes[codec]; !exists {
+		return nil, fmt.Errorf("unknown codec %s for mount %s, should be mp3 or opus", codec, path)
+	}
+	if bitrate <= 0 {
+		return nil, fmt.Errorf("bitrate for mount %s should be positive, got %d", path, bitrate)
+	}
+
+	return &Mount{
+		Path:           path,
+		Codec:          codec,
+		Bitrate:        bitrate,
+		consumers:      make(map[string]chan []byte),
+		killConsumer:   make(chan string),
+		consumerWLock:  &sync.Mutex{},
+		lastChunks:     list.New(),
+		lastChunksLock: &sync.RWMutex{},
+		hlsClients:     make(map[string]time.Time),
+	}, nil
+}
+
+// EnableHLS makes the audio server also publish the mount as a live HLS
+// playlist, cut into segments of about segmentLength with window of them
+// listed at a time. Only mp3 mounts can be segmented.
+func (m *Mount) EnableHLS(segmentLength time.Duration, window int) error {
+	if m.Codec != "mp3" {
+		return fmt.Errorf("can't serve %s as HLS, only mp3 mounts are supported", m.Path)
+	}
+	if segmentLength <= 0 || window <= 0 {
+		return fmt.Errorf("HLS segment length and window for %s should be positive", m.Path)
+	}
+	m.hlsSegment = segmentLength
+	m.hlsWindow = window
+
+	return nil
+}
+
+// hlsPaths gives where the mount's playlist and segments are served,
+// eg /stream.m3u8 and /stream/<seq>.mp3 for /stream.mp3
+func (m *Mount) hlsPaths() (playlistPath string, segmentPath string) {
+	base := strings.TrimSuffix(m.Path, path.Ext(m.Path))
+	if base == "/" || base == "" {
+		base = "/live"
+	}
+	return base + ".m3u8", base + "/"
+}
+
+// ParseMounts reads a comma separated list of mounts in the form
+// path:codec:bitrate, eg "/stream.mp3:mp3:160,/low.mp3:mp3:64,/stream.ogg:opus:96"
+func ParseMounts(spec string) (Mounts, error) {
+	mounts := Mounts{}
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("mount %s should look like path:codec:bitrate", entry)
+		}
+		bitrate, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("mount %s has a bad bitrate. Err: %v", entry, err)
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("mount path %s is used more than once", parts[0])
+		}
+		seen[parts[0]] = true
+
+		mount, err := NewMount(parts[0], parts[1], bitrate)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount)
+	}
+	if len(mounts) == 0 {
+		return nil, fmt.Errorf("at least one mount is needed")
+	}
+
+	return mounts, nil
+}
+
+// ListenerCount gives how many clients are listening to the mount, counting
+// both the ones connected to the stream and the ones following it over HLS
+func (m *Mount) ListenerCount() int {
+	m.consumerWLock.Lock()
+	defer m.consumerWLock.Unlock()
+
+	// HLS clients don't stay connected, they refetch the playlist every
+	// segment or so. Anyone that hasn't for a whole window has gone.
+	for client, lastSeen := range m.hlsClients {
+		if time.Since(lastSeen) > m.hlsSegment*time.Duration(m.hlsWindow) {
+			delete(m.hlsClients, client)
+		}
+	}
+	return len(m.consumers) + len(m.hlsClients)
+}
+
+// countHLSClients wraps the mount's HLS playlist handler, noting who fetched
+// it so they're counted as listeners
+func (m *Mount) countHLSClients(playlist http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		// Strip the port, players may open a new connection for each fetch
+		client := req.RemoteAddr
+		if idx := strings.LastIndex(client, ":"); idx != -1 {
+			client = client[:idx]
+		}
+
+		m.consumerWLock.Lock()
+		m.hlsClients[client] = time.Now()
+		m.consumerWLock.Unlock()
+
+		playlist(w, req)
+	}
+}
+
+// publishListenerCount lets subscribers know the mount's listeners changed
+func (m *Mount) publishListenerCount() {
+	events.Publish(events.ListenerCount, struct {
+		Mount     string `json:"mount"`
+		Listeners int    `json:"listeners"`
+	}{m.Path, m.ListenerCount()})
+}
+
+// ListenerCount gives how many clients are connected across all mounts
+func (ms Mounts) ListenerCount() int {
+	total := 0
+	for _, mount := range ms {
+		total += mount.ListenerCount()
+	}
+	return total
+}
+
+// ListenerCounts gives how many clients are connected to each mount, by path
+func (ms Mounts) ListenerCounts() map[string]int {
+	counts := make(map[string]int, len(ms))
+	for _, mount := range ms {
+		counts[mount.Path] = mount.ListenerCount()
+	}
+	return counts
+}
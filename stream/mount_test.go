@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseMounts(t *testing.T) {
+	mounts, err := ParseMounts("/stream.mp3:mp3:160, /low.mp3:mp3:64,/stream.ogg:opus:96")
+	if err != nil {
+		t.Errorf("Failed to parse mounts. Err: %v\n", err)
+		return
+	}
+	if len(mounts) != 3 {
+		t.Errorf("Expected 3 mounts, got %d\n", len(mounts))
+		return
+	}
+	if mounts[1].Path != "/low.mp3" || mounts[1].Codec != "mp3" || mounts[1].Bitrate != 64 {
+		t.Errorf("Mount wasn't parsed correctly: %+v\n", mounts[1])
+	}
+
+	bad := []string{"", "/a.mp3:mp3", "/a.mp3:flac:160", "a.mp3:mp3:160", "/a.mp3:mp3:fast", "/a.mp3:mp3:64,/a.mp3:mp3:160"}
+	for _, spec := range bad {
+		if _, err = ParseMounts(spec); err == nil {
+			t.Errorf("Mount spec %q should give an error\n", spec)
+		}
+	}
+}
+
+func TestListenerCounts(t *testing.T) {
+	mounts, _ := ParseMounts("/a.mp3:mp3:160,/b.mp3:mp3:64")
+	mounts[0].consumers["foo"] = make(chan []byte)
+	mounts[1].consumers["bar"] = make(chan []byte)
+	mounts[1].consumers["baz"] = make(chan []byte)
+
+	counts := mounts.ListenerCounts()
+	if counts["/a.mp3"] != 1 || counts["/b.mp3"] != 2 {
+		t.Errorf("Listener counts were wrong: %v\n", counts)
+	}
+	if mounts.ListenerCount() != 3 {
+		t.Errorf("Total listener count should be 3, got %d\n", mounts.ListenerCount())
+	}
+}
+
+func TestHLSListenerCount(t *testing.T) {
+	mounts, _ := ParseMounts("/a.mp3:mp3:160")
+	mount := mounts[0]
+	mount.EnableHLS(time.Second, 3)
+	mount.consumers["foo"] = make(chan []byte)
+	playlist := mount.countHLSClients(func(w http.ResponseWriter, req *http.Request) {})
+
+	// Refetching from a new port is still the same client
+	for _, addr := range []string{"10.0.0.1:1000", "10.0.0.1:1001", "10.0.0.2:1000"} {
+		req := httptest.NewRequest("GET", "/a.m3u8", nil)
+		req.RemoteAddr = addr
+		playlist(httptest.NewRecorder(), req)
+	}
+	if count := mount.ListenerCount(); count != 3 {
+		t.Errorf("Expected 1 stream and 2 HLS listeners, got %d\n", count)
+	}
+
+	// A client that stopped fetching for a whole window has left
+	mount.hlsClients["10.0.0.2"] = time.Now().Add(-time.Minute)
+	if count := mount.ListenerCount(); count != 2 {
+		t.Errorf("Expected the stale HLS client to be dropped, got %d listeners\n", count)
+	}
+}
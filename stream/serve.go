@@ -3,22 +3,15 @@
 package stream
 
 import (
-	"container/list"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
-	"sync"
 	"time"
 )
 
-var consumers = make(map[string]chan []byte)
-var killConsumer = make(chan string)
-var consumerWLock = sync.Mutex{}
-var lastChunks = list.New()
-var lastChunksLock = sync.RWMutex{}
-
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 // Seed the random generator
@@ -35,48 +28,67 @@ func randIDGenerator(n int) string {
 	return string(b)
 }
 
-func generateNewStream(w http.ResponseWriter, req *http.Request) {
+// generateNewStream makes the handler that streams the mount's audio to a
+// client. Clients that send Icy-MetaData: 1 get the title from nowPlaying
+// mixed into the stream
+func generateNewStream(mount *Mount, stationName string, nowPlaying func() string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		mount.streamToClient(w, req, stationName, nowPlaying)
+	}
+}
+
+func (m *Mount) streamToClient(w http.ResponseWriter, req *http.Request, stationName string, nowPlaying func() string) {
 	// Setup flusher and headers
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		panic("expected http.ResponseWriter to be an http.Flusher")
 	}
 	w.Header().Set("Transfer-Encoding", "chunked")
-	w.Header().Set("Content-Type", "audio/mpeg")
+	w.Header().Set("Content-Type", contentTypes[m.Codec])
 	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("icy-name", stationName)
+	w.Header().Set("icy-br", fmt.Sprintf("%d", m.Bitrate))
+
+	// Only clients that ask for metadata can cope with it in the stream
+	var audioOut io.Writer = w
+	if req.Header.Get("Icy-MetaData") == "1" {
+		w.Header().Set("icy-metaint", fmt.Sprintf("%d", icyMetaInt))
+		audioOut = newIcyWriter(w, icyMetaInt, nowPlaying)
+	}
 
 	// Register stream
 	mediaConsumer := make(chan []byte, 4)
 	consumerID := randIDGenerator(32)
 
-	consumerWLock.Lock()
-	consumers[consumerID] = mediaConsumer
-	consumerWLock.Unlock()
+	m.consumerWLock.Lock()
+	m.consumers[consumerID] = mediaConsumer
+	m.consumerWLock.Unlock()
+	m.publishListenerCount()
 
 	// If the connection is closed, kill the consumer
 	done := req.Context().Done()
 	go func() {
 		<-done
-		log.Printf("User %s disconnected", req.RemoteAddr)
-		killConsumer <- consumerID
+		log.Printf("User %s disconnected from %s", req.RemoteAddr, m.Path)
+		m.killConsumer <- consumerID
 	}()
 
-	log.Printf("User %s connected", req.RemoteAddr)
+	log.Printf("User %s connected to %s", req.RemoteAddr, m.Path)
 
 	// Write the last chunk to bootstrap the stream
-	lastChunksLock.RLock()
-	for bytes := lastChunks.Front(); bytes != nil; bytes = bytes.Next() {
-		w.Write(bytes.Value.([]byte))
+	m.lastChunksLock.RLock()
+	for bytes := m.lastChunks.Front(); bytes != nil; bytes = bytes.Next() {
+		audioOut.Write(bytes.Value.([]byte))
 	}
-	lastChunksLock.RUnlock()
+	m.lastChunksLock.RUnlock()
 	flusher.Flush()
 
 	// Recive bytes from the channel and respond with them
 	var err error
 	for bytesToStream := range mediaConsumer {
-		_, err = w.Write(bytesToStream)
+		_, err = audioOut.Write(bytesToStream)
 		if err != nil {
-			_, err = w.Write(bytesToStream) // Retry once
+			_, err = audioOut.Write(bytesToStream) // Retry once
 			if err != nil {
 				log.Printf("User %s disconnected", req.RemoteAddr)
 				return
@@ -86,86 +98,113 @@ func generateNewStream(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func ListenerCount() int {
-	return len(consumers)
-}
-
-func ServeAudioOverHttp(inputAudio <-chan []byte, port int) {
-	/* Net listener */
-	n := "tcp"
-	addr := fmt.Sprintf("127.0.0.1:%d", port)
-	l, err := net.Listen(n, addr)
-	if err != nil {
-		panic("Failed to start audio server")
-	}
-
+// broadcast pushes the audio coming out of inputAudio to every client
+// listening to the mount
+func (m *Mount) broadcast(inputAudio <-chan []byte) {
 	// Listen for channels that need to be closed
 	// Potential race condition if the consumer is deleted after the broadcaster
 	// below already enters it in the loop
 	// TODO: Fix that race condition https://github.com/VivaLaPanda/uta-stream/issues/2
-	go func() {
-
-	}()
 
 	// Init fifo queue of size 3
 	var emptyArr []byte
 	for idx := 0; idx < 16; idx++ {
-		lastChunks.PushBack(emptyArr)
+		m.lastChunks.PushBack(emptyArr)
 	}
 
 	// Listen to incoming audio bytes and push them out to all consumers
 	// If a consumer is blocking, just ignore it and keep going
-	go func() {
-		for audioBytes := range inputAudio {
-			// Bytes need to be spaced out to keep the client from getting too
-			// far ahead
-			time.Sleep(500 * time.Millisecond)
+	for audioBytes := range inputAudio {
+		// Bytes need to be spaced out to keep the client from getting too
+		// far ahead
+		time.Sleep(500 * time.Millisecond)
 
-			badConsumerCounter := make(map[string]int, len(consumers))
+		if m.hls != nil {
+			m.hls.write(audioBytes)
+		}
 
-			// If we've been given a kill signal for a consumer handle that now
-			select {
-			case consumerToKill := <-killConsumer:
-				chanCopy := consumers[consumerToKill]
+		badConsumerCounter := make(map[string]int, len(m.consumers))
 
-				consumerWLock.Lock()
-				delete(consumers, consumerToKill)
-				consumerWLock.Unlock()
+		// If we've been given a kill signal for a consumer handle that now
+		select {
+		case consumerToKill := <-m.killConsumer:
+			m.consumerWLock.Lock()
+			chanCopy := m.consumers[consumerToKill]
+			delete(m.consumers, consumerToKill)
+			m.consumerWLock.Unlock()
 
-				close(chanCopy)
-			default:
-			}
+			close(chanCopy)
+			m.publishListenerCount()
+		default:
+		}
 
-			for id, consumer := range consumers {
+		m.consumerWLock.Lock()
+		for id, consumer := range m.consumers {
 
-				select {
-				case consumer <- audioBytes:
-					// Send was good, do nothing
-				default:
-					// Consumers that refuse to consume data will eventually cause a fatal overflow
-					// If a consumer repeatedly fails, forcibly disconnect them.
-					log.Printf("Overburdened consumer")
+			select {
+			case consumer <- audioBytes:
+				// Send was good, do nothing
+			default:
+				// Consumers that refuse to consume data will eventually cause a fatal overflow
+				// If a consumer repeatedly fails, forcibly disconnect them.
+				log.Printf("Overburdened consumer on %s", m.Path)
 
-					badConsumerCounter[id] += 1
-					if badConsumerCounter[id] > 10 {
-						delete(badConsumerCounter, id)
+				badConsumerCounter[id] += 1
+				if badConsumerCounter[id] > 10 {
+					delete(badConsumerCounter, id)
 
-						killConsumer <- id
-					}
+					go func(id string) { m.killConsumer <- id }(id)
 				}
 			}
+		}
+		m.consumerWLock.Unlock()
 
-			// Maintain fifo queue
-			lastChunksLock.Lock()
-			lastChunks.Remove(lastChunks.Front())
-			lastChunks.PushBack(audioBytes)
-			lastChunksLock.Unlock()
+		// Maintain fifo queue
+		m.lastChunksLock.Lock()
+		m.lastChunks.Remove(m.lastChunks.Front())
+		m.lastChunks.PushBack(audioBytes)
+		m.lastChunksLock.Unlock()
+	}
+}
+
+// ServeAudioOverHttp publishes each mount on the port, streaming the audio
+// from the matching entry of inputs to every client that connects. The first
+// mount is also served at / for older clients. stationName is advertised in
+// the icy headers, and nowPlaying is polled for the stream title.
+func ServeAudioOverHttp(mounts Mounts, inputs []chan []byte, port int, stationName string, nowPlaying func() string) {
+	if len(mounts) != len(inputs) {
+		log.Fatalf("Audio server got %d mounts but %d inputs\n", len(mounts), len(inputs))
+	}
+
+	/* Net listener */
+	n := "tcp"
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	l, err := net.Listen(n, addr)
+	if err != nil {
+		panic("Failed to start audio server")
+	}
+
+	handler := http.NewServeMux()
+	for idx, mount := range mounts {
+		handler.Handle(mount.Path, generateNewStream(mount, stationName, nowPlaying))
+		log.Printf("Serving %s at %dk on %s", mount.Codec, mount.Bitrate, mount.Path)
+
+		if mount.hlsSegment > 0 {
+			mount.hls = newSegmenter(mount.Bitrate, mount.hlsSegment, mount.hlsWindow, nowPlaying)
+			playlistPath, segmentPath := mount.hlsPaths()
+			handler.Handle(playlistPath, mount.countHLSClients(mount.hls.servePlaylist(segmentPath)))
+			handler.Handle(segmentPath, mount.hls.serveSegments(segmentPath))
+			log.Printf("Serving %s as HLS on %s", mount.Path, playlistPath)
 		}
-	}()
+		go mount.broadcast(inputs[idx])
+	}
+	if mounts[0].Path != "/" {
+		handler.Handle("/", generateNewStream(mounts[0], stationName, nowPlaying))
+	}
 
 	/* HTTP server */
 	server := http.Server{
-		Handler: http.HandlerFunc(generateNewStream),
+		Handler: handler,
 	}
 	log.Printf("Audio server is listening at %s", addr)
 	if err := server.Serve(l); err != nil && err != http.ErrServerClosed {